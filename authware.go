@@ -5,11 +5,13 @@ import (
 )
 
 var (
-	factories map[string]Factory
+	factories       map[string]Factory
+	configFactories map[string]ConfigFactory
 )
 
 func init() {
 	factories = make(map[string]Factory)
+	configFactories = make(map[string]ConfigFactory)
 }
 
 // RegisterFactory idempotently registers factories for later
@@ -35,3 +37,27 @@ func Initialize(s string) (Authenticator, error) {
 	}
 	return f()
 }
+
+// RegisterConfigFactory idempotently registers factories that can be
+// initialized with an explicit configuration rather than from the
+// environment.
+func RegisterConfigFactory(s string, f ConfigFactory) {
+	if _, exists := configFactories[s]; exists {
+		slog.Warn("ConfigFactory name collission", "name", s)
+		return
+	}
+	configFactories[s] = f
+	slog.Debug("Registered Configurable Auth Mechanism", "mechanism", s)
+}
+
+// InitializeWithConfig is like Initialize, but the authenticator
+// obtains its configuration by calling decode with a pointer to its
+// own config structure.
+func InitializeWithConfig(s string, decode func(any) error) (Authenticator, error) {
+	f, ok := configFactories[s]
+	if !ok {
+		slog.Error("Non existant mechanism requested", "mechanism", s)
+		return nil, new(ErrDoesNotExist)
+	}
+	return f(decode)
+}
@@ -0,0 +1,75 @@
+package authware
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// GroupRequirement describes the group membership that a user must
+// possess in order to proceed down the handler chain.
+type GroupRequirement struct {
+	// Groups is the list of groups to check the user against.
+	Groups []string
+
+	// All requires that the user be a member of every group in
+	// Groups rather than just one of them.
+	All bool
+
+	// Forbidden is served when a user is authenticated but does
+	// not satisfy the requirement.  If it is nil, a plain 403 is
+	// returned instead.
+	Forbidden http.Handler
+}
+
+// RequireGroups returns a middleware that enforces the given group
+// requirement against the User that was placed into the request
+// context by one of the authenticating handlers.  It must therefore
+// be placed in the chain after BasicHandler, LoginHandler,
+// SessionHandler, or MultiAuthHandler.  Requests without a User are
+// rejected as unauthenticated, while requests with a User that lacks
+// the required membership are rejected as forbidden.
+func RequireGroups(req GroupRequirement) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := UserFromContext(r.Context())
+			if !ok {
+				slog.Debug("Received request with no user in group restricted area", "url", r.URL.String())
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintln(w, "Authentication Required")
+				return
+			}
+
+			if !req.satisfiedBy(user) {
+				slog.Debug("Denying request for missing group membership", "user", user.Identity, "groups", req.Groups)
+				if req.Forbidden != nil {
+					req.Forbidden.ServeHTTP(w, r)
+					return
+				}
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintln(w, "Forbidden")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireAnyGroup returns a middleware that admits users that are a
+// member of at least one of the listed groups.
+func RequireAnyGroup(groups ...string) Middleware {
+	return RequireGroups(GroupRequirement{Groups: groups})
+}
+
+// RequireAllGroups returns a middleware that admits only users that
+// are a member of every one of the listed groups.
+func RequireAllGroups(groups ...string) Middleware {
+	return RequireGroups(GroupRequirement{Groups: groups, All: true})
+}
+
+func (g GroupRequirement) satisfiedBy(u User) bool {
+	if g.All {
+		return u.InAllGroups(g.Groups...)
+	}
+	return len(g.Groups) == 0 || u.InAnyGroup(g.Groups...)
+}
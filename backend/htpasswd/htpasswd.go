@@ -12,10 +12,14 @@ import (
 	"github.com/the-maldridge/authware"
 )
 
-var (
-	htpasswdFile string
-	htgroupFile  string
-)
+// Config contains the settings for the htpasswd backend.
+type Config struct {
+	// PasswdFile is the path to the htpasswd file.
+	PasswdFile string `mapstructure:"passwd_file"`
+
+	// GroupFile is the path to the htgroup file.
+	GroupFile string `mapstructure:"group_file"`
+}
 
 type htpasswdBackend struct {
 	f *htpasswd.File
@@ -23,27 +27,44 @@ type htpasswdBackend struct {
 }
 
 func init() {
-	htpasswdFile = os.Getenv("AUTHWARE_HTPASSWD_FILE")
-	if htpasswdFile == "" {
-		htpasswdFile = ".htpasswd"
-	}
+	authware.RegisterFactory("htpasswd", func() (authware.Authenticator, error) {
+		return New(ConfigFromEnv())
+	})
+	authware.RegisterConfigFactory("htpasswd", func(decode func(any) error) (authware.Authenticator, error) {
+		var cfg Config
+		if err := decode(&cfg); err != nil {
+			return nil, err
+		}
+		return New(cfg)
+	})
+}
 
-	htgroupFile = os.Getenv("AUTHWARE_HTGROUP_FILE")
-	if htgroupFile == "" {
-		htgroupFile = ".htgroup"
+// ConfigFromEnv obtains the backend configuration from
+// AUTHWARE_HTPASSWD_FILE and AUTHWARE_HTGROUP_FILE.
+func ConfigFromEnv() Config {
+	return Config{
+		PasswdFile: os.Getenv("AUTHWARE_HTPASSWD_FILE"),
+		GroupFile:  os.Getenv("AUTHWARE_HTGROUP_FILE"),
 	}
-
-	authware.RegisterFactory("htpasswd", New)
 }
 
-// New can be used to get a new instance of this backend
-func New() (authware.Authenticator, error) {
-	f, err := htpasswd.New(htpasswdFile, htpasswd.DefaultSystems, nil)
+// New can be used to get a new instance of this backend.  Files that
+// are not specified in the config default to .htpasswd and .htgroup
+// in the current directory.
+func New(cfg Config) (authware.Authenticator, error) {
+	if cfg.PasswdFile == "" {
+		cfg.PasswdFile = ".htpasswd"
+	}
+	if cfg.GroupFile == "" {
+		cfg.GroupFile = ".htgroup"
+	}
+
+	f, err := htpasswd.New(cfg.PasswdFile, htpasswd.DefaultSystems, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	g, err := htpasswd.NewGroups(htgroupFile, nil)
+	g, err := htpasswd.NewGroups(cfg.GroupFile, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -69,9 +90,10 @@ func New() (authware.Authenticator, error) {
 		}
 	}()
 
-	slog.Info("Initialized", "htpasswd", htpasswdFile, "htgroup", htgroupFile)
+	slog.Info("Initialized", "htpasswd", cfg.PasswdFile, "htgroup", cfg.GroupFile)
 	return &x, nil
 }
+
 func (h *htpasswdBackend) AuthUserPassword(ctx context.Context, user, pass string) error {
 	if !h.f.Match(user, pass) {
 		slog.Debug("User unauthenticated", "user", user)
@@ -14,7 +14,32 @@ import (
 )
 
 func init() {
-	authware.RegisterFactory("ldap", New)
+	authware.RegisterFactory("ldap", func() (authware.Authenticator, error) {
+		return New(ConfigFromEnv())
+	})
+	authware.RegisterConfigFactory("ldap", func(decode func(any) error) (authware.Authenticator, error) {
+		var cfg Config
+		if err := decode(&cfg); err != nil {
+			return nil, err
+		}
+		return New(cfg)
+	})
+}
+
+// Config contains the settings for the LDAP backend.
+type Config struct {
+	// URL of the LDAP server, starting with ldap:// or ldaps://
+	URL string `mapstructure:"url"`
+
+	// BaseDN is the root path to search under for users.
+	BaseDN string `mapstructure:"base_dn"`
+
+	// GroupAttr is the attribute on a user that lists groups.
+	GroupAttr string `mapstructure:"group_attr"`
+
+	// BindTemplate is the DN a user will bind as, with %s where
+	// the username goes.
+	BindTemplate string `mapstructure:"bind_template"`
 }
 
 type ldapBackend struct {
@@ -24,28 +49,39 @@ type ldapBackend struct {
 	bindTmpl  string
 }
 
+// ConfigFromEnv obtains the backend configuration from the
+// AUTHWARE_LDAP_* environment variables.
+func ConfigFromEnv() Config {
+	return Config{
+		URL:          os.Getenv("AUTHWARE_LDAP_URL"),
+		BaseDN:       os.Getenv("AUTHWARE_LDAP_BASEDN"),
+		GroupAttr:    os.Getenv("AUTHWARE_LDAP_GROUPATTR"),
+		BindTemplate: os.Getenv("AUTHWARE_LDAP_BIND_TEMPLATE"),
+	}
+}
+
 // New obtains a new authentication service that uses an LDAP server.
-func New() (authware.Authenticator, error) {
+func New(cfg Config) (authware.Authenticator, error) {
 	x := ldapBackend{
-		url:       os.Getenv("AUTHWARE_LDAP_URL"),
-		base:      os.Getenv("AUTHWARE_LDAP_BASEDN"),
-		groupAttr: os.Getenv("AUTHWARE_LDAP_GROUPATTR"),
-		bindTmpl:  os.Getenv("AUTHWARE_LDAP_BIND_TEMPLATE"),
+		url:       cfg.URL,
+		base:      cfg.BaseDN,
+		groupAttr: cfg.GroupAttr,
+		bindTmpl:  cfg.BindTemplate,
 	}
 
 	if x.url == "" {
-		slog.Error("Missing required config value", "key", "AUTHWARE_LDAP_URL")
-		return nil, errors.New("must specify AUTHWARE_LDAP_URL")
+		slog.Error("Missing required config value", "key", "URL")
+		return nil, errors.New("must specify an LDAP URL")
 	}
 
 	if x.base == "" {
-		slog.Error("Missing required config value", "key", "AUTHWARE_LDAP_BASEDN")
-		return nil, errors.New("must specify AUTHWARE_LDAP_BASEDN")
+		slog.Error("Missing required config value", "key", "BaseDN")
+		return nil, errors.New("must specify an LDAP BaseDN")
 	}
 
 	if x.bindTmpl == "" {
-		slog.Error("Missing required config value", "key", "AUTHWARE_LDAP_BIND_TEMPLATE")
-		return nil, errors.New("must specify AUTHWARE_LDAP_BIND_TEMPLATE")
+		slog.Error("Missing required config value", "key", "BindTemplate")
+		return nil, errors.New("must specify an LDAP BindTemplate")
 	}
 
 	return &x, nil
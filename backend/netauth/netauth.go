@@ -13,7 +13,28 @@ import (
 )
 
 func init() {
-	authware.RegisterFactory("netauth", New)
+	authware.RegisterFactory("netauth", func() (authware.Authenticator, error) {
+		return New(Config{})
+	})
+	authware.RegisterConfigFactory("netauth", func(decode func(any) error) (authware.Authenticator, error) {
+		var cfg Config
+		if err := decode(&cfg); err != nil {
+			return nil, err
+		}
+		return New(cfg)
+	})
+}
+
+// Config contains the settings for the NetAuth backend.
+type Config struct {
+	// ConfigFile is the path to a NetAuth config file.  If it is
+	// not set, the file will be searched for in the standard
+	// NetAuth locations.
+	ConfigFile string `mapstructure:"config_file"`
+
+	// ServiceName is reported to the NetAuth server and defaults
+	// to authware.
+	ServiceName string `mapstructure:"service_name"`
 }
 
 type netAuthBackend struct {
@@ -21,24 +42,34 @@ type netAuthBackend struct {
 }
 
 // New obtains a new authentication service that uses the NetAuth
-// backend.
-func New() (authware.Authenticator, error) {
-	viper.SetConfigName("config")
-	viper.AddConfigPath("/etc/netauth/")
-	viper.AddConfigPath("$HOME/.netauth")
-	viper.AddConfigPath(".")
+// backend.  The NetAuth client library reads its configuration from
+// the global viper instance, so all NetAuth backends in a process
+// share the same server settings.
+func New(cfg Config) (authware.Authenticator, error) {
+	if cfg.ConfigFile != "" {
+		viper.SetConfigFile(cfg.ConfigFile)
+	} else {
+		viper.SetConfigName("config")
+		viper.AddConfigPath("/etc/netauth/")
+		viper.AddConfigPath("$HOME/.netauth")
+		viper.AddConfigPath(".")
+	}
 	if err := viper.ReadInConfig(); err != nil {
 		slog.Error("Fatal error reading configuration", "error", err)
 		return nil, err
 	}
 
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "authware"
+	}
+
 	// Grab a client
 	c, err := netauth.New()
 	if err != nil {
 		slog.Error("Error during NetAuth initialization", "error", err)
 		return nil, err
 	}
-	c.SetServiceName("authware")
+	c.SetServiceName(cfg.ServiceName)
 
 	x := netAuthBackend{
 		nacl: c,
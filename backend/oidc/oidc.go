@@ -0,0 +1,344 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"github.com/the-maldridge/authware"
+)
+
+// flowName names the cookie that carries the state of a login that
+// is in progress at the identity provider.
+const flowName = "oidc"
+
+// authTimeLeeway allows for auth_time only having a resolution of one
+// second, and for the provider's clock being slightly ahead of ours.
+const authTimeLeeway = 30 * time.Second
+
+// Config contains the settings for the OpenID Connect relying party.
+type Config struct {
+	// Issuer is the URL of the identity provider.  Its discovery
+	// document is fetched from
+	// <Issuer>/.well-known/openid-configuration.
+	Issuer string `mapstructure:"issuer"`
+
+	// ClientID and ClientSecret are the credentials registered
+	// with the identity provider.
+	ClientID     string `mapstructure:"client_id"`
+	ClientSecret string `mapstructure:"client_secret"`
+
+	// RedirectURL is the absolute URL at which CallbackHandler is
+	// mounted, and must be registered with the identity provider.
+	RedirectURL string `mapstructure:"redirect_url"`
+
+	// Scopes requested in addition to "openid".  It defaults to
+	// "profile" and "email".
+	Scopes []string `mapstructure:"scopes"`
+
+	// IdentityClaim is the ID token claim that becomes the user's
+	// Identity.  It defaults to "sub".
+	IdentityClaim string `mapstructure:"identity_claim"`
+
+	// GroupsClaim is the ID token claim that lists the user's
+	// groups.  It defaults to "groups".
+	GroupsClaim string `mapstructure:"groups_claim"`
+
+	// DefaultNext is where users are sent after logging in if the
+	// login did not carry a next parameter.  It defaults to "/".
+	DefaultNext string `mapstructure:"default_next"`
+
+	// HTTPClient is used to talk to the identity provider.  If it
+	// is nil, http.DefaultClient is used.
+	HTTPClient *http.Client `mapstructure:"-"`
+}
+
+// RelyingParty logs users in with an OpenID Connect identity provider
+// using the authorization code flow with PKCE.
+type RelyingParty struct {
+	b        *authware.BasicMiddleware
+	client   *http.Client
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+
+	identityClaim string
+	groupsClaim   string
+	defaultNext   string
+}
+
+// pending is the state of a login that has been sent to the identity
+// provider and not yet returned.
+type pending struct {
+	State    string
+	Nonce    string
+	Verifier string
+	Next     string
+
+	// MaxAge is how recently the user must have authenticated at
+	// the identity provider.  It is only checked if HasMaxAge is
+	// set, which it is when the login was requested by
+	// RequireRecentAuth.
+	MaxAge    time.Duration
+	HasMaxAge bool
+}
+
+// verified is what is learned from a valid ID token.
+type verified struct {
+	user     authware.User
+	amr      []string
+	authTime time.Time
+}
+
+// ConfigFromEnv obtains the relying party configuration from
+// AUTHWARE_OIDC_ISSUER, AUTHWARE_OIDC_CLIENT_ID,
+// AUTHWARE_OIDC_CLIENT_SECRET, AUTHWARE_OIDC_REDIRECT_URL,
+// AUTHWARE_OIDC_SCOPES (comma separated),
+// AUTHWARE_OIDC_IDENTITY_CLAIM, and AUTHWARE_OIDC_GROUPS_CLAIM.
+func ConfigFromEnv() Config {
+	cfg := Config{
+		Issuer:        os.Getenv("AUTHWARE_OIDC_ISSUER"),
+		ClientID:      os.Getenv("AUTHWARE_OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("AUTHWARE_OIDC_CLIENT_SECRET"),
+		RedirectURL:   os.Getenv("AUTHWARE_OIDC_REDIRECT_URL"),
+		IdentityClaim: os.Getenv("AUTHWARE_OIDC_IDENTITY_CLAIM"),
+		GroupsClaim:   os.Getenv("AUTHWARE_OIDC_GROUPS_CLAIM"),
+	}
+	if scopes := os.Getenv("AUTHWARE_OIDC_SCOPES"); scopes != "" {
+		cfg.Scopes = strings.Split(scopes, ",")
+	}
+	return cfg
+}
+
+// New fetches the discovery document of the identity provider and
+// returns a relying party that issues sessions through b.
+func New(cfg Config, b *authware.BasicMiddleware) (*RelyingParty, error) {
+	for key, value := range map[string]string{
+		"Issuer":      cfg.Issuer,
+		"ClientID":    cfg.ClientID,
+		"RedirectURL": cfg.RedirectURL,
+	} {
+		if value == "" {
+			slog.Error("Missing required config value", "key", key)
+			return nil, fmt.Errorf("must specify an OIDC %s", key)
+		}
+	}
+	if cfg.Scopes == nil {
+		cfg.Scopes = []string{"profile", "email"}
+	}
+	if cfg.IdentityClaim == "" {
+		cfg.IdentityClaim = "sub"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	if cfg.DefaultNext == "" {
+		cfg.DefaultNext = "/"
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+
+	x := &RelyingParty{
+		b:             b,
+		client:        cfg.HTTPClient,
+		identityClaim: cfg.IdentityClaim,
+		groupsClaim:   cfg.GroupsClaim,
+		defaultNext:   cfg.DefaultNext,
+	}
+
+	ctx, cancel := context.WithTimeout(x.context(context.Background()), 30*time.Second)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	x.verifier = provider.Verifier(&oidc.Config{ClientID: cfg.ClientID})
+	x.oauth = oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  cfg.RedirectURL,
+		Scopes:       append([]string{oidc.ScopeOpenID}, cfg.Scopes...),
+	}
+
+	slog.Info("Initialized", "oidc", cfg.Issuer)
+	return x, nil
+}
+
+// Name is recorded as the AuthedBy of users that log in through the
+// identity provider.
+func (rp *RelyingParty) Name() string { return "oidc" }
+
+// LoginHandler sends the client to the identity provider.  Mount it
+// at the path passed to BasicMiddleware.LoginHandler so that
+// unauthenticated users are sent to the identity provider instead of
+// a local login form.  The next query parameter is carried through
+// the login in the same way as it is for LoginFormHandler.  A max age
+// from RequireRecentAuth is passed on to the identity provider, which
+// must then ask the user to authenticate again unless they did so
+// recently enough.
+func (rp *RelyingParty) LoginHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := pending{
+			State:    rand.Text(),
+			Nonce:    rand.Text(),
+			Verifier: oauth2.GenerateVerifier(),
+			Next:     rp.b.SafeNext(r.URL.Query().Get("next"), rp.defaultNext),
+		}
+		opts := []oauth2.AuthCodeOption{oidc.Nonce(p.Nonce), oauth2.S256ChallengeOption(p.Verifier)}
+		if secs, err := strconv.Atoi(r.URL.Query().Get(authware.MaxAgeParam)); err == nil && secs >= 0 {
+			p.MaxAge = time.Duration(secs) * time.Second
+			p.HasMaxAge = true
+			opts = append(opts, oauth2.SetAuthURLParam("max_age", strconv.Itoa(secs)))
+		}
+		if err := rp.b.SetFlowState(w, flowName, p, 10*time.Minute); err != nil {
+			slog.Error("Error saving OIDC login state", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "Internal Server Error")
+			return
+		}
+
+		target := rp.oauth.AuthCodeURL(p.State, opts...)
+		http.Redirect(w, r, target, http.StatusFound)
+	})
+}
+
+// CallbackHandler completes the login when the identity provider
+// returns the client to RedirectURL.  The authorization code is
+// exchanged for an ID token, which is verified and then used to issue
+// the same session cookie that LoginFormHandler would.
+func (rp *RelyingParty) CallbackHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p pending
+		if err := rp.b.TakeFlowState(w, r, flowName, &p); err != nil {
+			slog.Debug("Received OIDC callback with no login in progress", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "No Login In Progress")
+			return
+		}
+
+		q := r.URL.Query()
+		if subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(p.State)) != 1 {
+			slog.Debug("Received OIDC callback with mismatched state")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "Invalid State")
+			return
+		}
+		if e := q.Get("error"); e != "" {
+			slog.Debug("Identity provider refused login", "error", e, "description", q.Get("error_description"))
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Access Denied")
+			return
+		}
+
+		v, err := rp.exchange(r.Context(), q.Get("code"), p)
+		if err != nil {
+			slog.Info("OIDC login failed", "error", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Access Denied")
+			return
+		}
+
+		if err := rp.b.StartSessionAt(w, r, v.user, v.authTime, v.amr...); err != nil {
+			slog.Error("Error creating session", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, rp.b.SafeNext(p.Next, rp.defaultNext), http.StatusSeeOther)
+	})
+}
+
+// exchange redeems the code and verifies the ID token.  Along with
+// the User, the authentication methods and time are taken from the
+// amr and auth_time claims if the provider sent them.  If the login
+// has a max age, auth_time is required and must be recent enough.
+func (rp *RelyingParty) exchange(ctx context.Context, code string, p pending) (verified, error) {
+	ctx = rp.context(ctx)
+	token, err := rp.oauth.Exchange(ctx, code, oauth2.VerifierOption(p.Verifier))
+	if err != nil {
+		return verified{}, err
+	}
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return verified{}, errors.New("token response did not contain an id_token")
+	}
+	idToken, err := rp.verifier.Verify(ctx, raw)
+	if err != nil {
+		return verified{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(p.Nonce)) != 1 {
+		return verified{}, errors.New("id_token nonce does not match")
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return verified{}, err
+	}
+	user, err := rp.userFromClaims(claims)
+	if err != nil {
+		return verified{}, err
+	}
+	v := verified{user: user}
+
+	if methods, ok := claims["amr"].([]any); ok {
+		for _, m := range methods {
+			if s, ok := m.(string); ok {
+				v.amr = append(v.amr, s)
+			}
+		}
+	}
+	if at, ok := claims["auth_time"].(float64); ok {
+		v.authTime = time.Unix(int64(at), 0)
+	}
+	if p.HasMaxAge {
+		if v.authTime.IsZero() {
+			return verified{}, errors.New("id_token has no auth_time claim, but a max_age was requested")
+		}
+		if time.Since(v.authTime) > p.MaxAge+authTimeLeeway {
+			return verified{}, fmt.Errorf("id_token auth_time is older than the max_age of %s", p.MaxAge)
+		}
+	}
+	return v, nil
+}
+
+// userFromClaims maps the configured claims onto a User.  The groups
+// claim may be either a list or a single string.
+func (rp *RelyingParty) userFromClaims(claims map[string]any) (authware.User, error) {
+	identity, _ := claims[rp.identityClaim].(string)
+	if identity == "" {
+		return authware.User{}, fmt.Errorf("id_token has no %s claim", rp.identityClaim)
+	}
+
+	u := authware.User{
+		Identity: identity,
+		Groups:   make(map[string]struct{}),
+		AuthedBy: rp.Name(),
+	}
+	switch g := claims[rp.groupsClaim].(type) {
+	case string:
+		u.Groups[g] = struct{}{}
+	case []any:
+		for _, v := range g {
+			if s, ok := v.(string); ok {
+				u.Groups[s] = struct{}{}
+			}
+		}
+	}
+	return u, nil
+}
+
+func (rp *RelyingParty) context(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, rp.client)
+}
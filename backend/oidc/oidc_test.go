@@ -0,0 +1,420 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	jwtlib "github.com/golang-jwt/jwt/v5"
+
+	"github.com/the-maldridge/authware"
+	"github.com/the-maldridge/authware/jwt"
+)
+
+const testClientID = "app"
+
+// stubIdP is just enough of an OpenID Provider to complete the
+// authorization code flow.  The test plays the part of the browser at
+// the authorization endpoint by calling authorize directly.
+type stubIdP struct {
+	*httptest.Server
+
+	key  *rsa.PrivateKey
+	jwks jwt.JWKS
+
+	// discoveryIssuer, if set, is advertised instead of the real
+	// issuer URL.
+	discoveryIssuer string
+
+	mu    sync.Mutex
+	codes map[string]grant
+}
+
+// grant is an authorization code and what the token endpoint will
+// do when it is redeemed.
+type grant struct {
+	challenge string
+	claims    jwtlib.MapClaims
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := jwt.NewRSAKey("test", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk, _ := k.JWK()
+
+	s := &stubIdP{key: key, jwks: jwt.JWKS{Keys: []jwt.JWK{jwk}}, codes: make(map[string]grant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(s.jwks)
+	})
+	mux.HandleFunc("POST /token", s.token)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stubIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	issuer := s.URL
+	if s.discoveryIssuer != "" {
+		issuer = s.discoveryIssuer
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                issuer,
+		"authorization_endpoint":                s.URL + "/authorize",
+		"token_endpoint":                        s.URL + "/token",
+		"jwks_uri":                              s.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+// authorize issues a code for the request that LoginHandler sent the
+// browser to.  The ID token carries the standard claims for that
+// request, with extra merged over them.
+func (s *stubIdP) authorize(t *testing.T, target *url.URL, extra jwtlib.MapClaims) string {
+	t.Helper()
+	q := target.Query()
+	if q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("expected S256 PKCE, got %q", q.Get("code_challenge_method"))
+	}
+	now := time.Now()
+	claims := jwtlib.MapClaims{
+		"iss":   s.URL,
+		"aud":   testClientID,
+		"sub":   "alice",
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": q.Get("nonce"),
+	}
+	for k, v := range extra {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+
+	code := rand.Text()
+	s.mu.Lock()
+	s.codes[code] = grant{challenge: q.Get("code_challenge"), claims: claims}
+	s.mu.Unlock()
+	return code
+}
+
+func (s *stubIdP) token(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	g, ok := s.codes[r.FormValue("code")]
+	delete(s.codes, r.FormValue("code"))
+	s.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	tok := jwtlib.NewWithClaims(jwtlib.SigningMethodRS256, g.claims)
+	tok.Header["kid"] = "test"
+	signed, err := tok.SignedString(s.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "opaque",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     signed,
+	})
+}
+
+// browser carries cookies between requests to the relying party.
+type browser map[string]*http.Cookie
+
+func (b browser) do(h http.Handler, target string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, c := range b {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(b, c.Name)
+		} else {
+			b[c.Name] = c
+		}
+	}
+	return w
+}
+
+func (b browser) session(t *testing.T, mw *authware.BasicMiddleware) (authware.Session, error) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range b {
+		r.AddCookie(c)
+	}
+	return mw.CurrentSession(r)
+}
+
+func newRelyingParty(t *testing.T, idp *stubIdP) (*RelyingParty, *authware.BasicMiddleware) {
+	t.Helper()
+	mw, err := authware.NewAuth(authware.WithAuthenticators())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := New(Config{
+		Issuer:      idp.URL,
+		ClientID:    testClientID,
+		RedirectURL: "https://app.example.com/login/callback",
+	}, mw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rp, mw
+}
+
+// login starts a login at the relying party, has the stub issue a code
+// with the given claims, and returns the callback response.
+func login(t *testing.T, idp *stubIdP, rp *RelyingParty, b browser, start string, extra jwtlib.MapClaims) *httptest.ResponseRecorder {
+	t.Helper()
+	w := b.do(rp.LoginHandler(), start)
+	if w.Code != http.StatusFound {
+		t.Fatalf("login returned %d", w.Code)
+	}
+	target, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := idp.authorize(t, target, extra)
+	q := url.Values{"code": {code}, "state": {target.Query().Get("state")}}
+	return b.do(rp.CallbackHandler(), "/login/callback?"+q.Encode())
+}
+
+func TestDiscovery(t *testing.T) {
+	idp := newStubIdP(t)
+	rp, _ := newRelyingParty(t, idp)
+	if rp.oauth.Endpoint.TokenURL != idp.URL+"/token" {
+		t.Errorf("token endpoint was not discovered, got %q", rp.oauth.Endpoint.TokenURL)
+	}
+
+	idp.discoveryIssuer = "https://elsewhere.example.com"
+	mw, _ := authware.NewAuth(authware.WithAuthenticators())
+	if _, err := New(Config{Issuer: idp.URL, ClientID: testClientID, RedirectURL: "https://app.example.com/cb"}, mw); err == nil {
+		t.Error("discovery document for another issuer was accepted")
+	}
+}
+
+func TestLogin(t *testing.T) {
+	idp := newStubIdP(t)
+	rp, mw := newRelyingParty(t, idp)
+
+	b := browser{}
+	authTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	w := login(t, idp, rp, b, "/login?next=/private", jwtlib.MapClaims{
+		"groups":    []string{"admins", "staff"},
+		"amr":       []string{"pwd", "otp"},
+		"auth_time": authTime.Unix(),
+	})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/private" {
+		t.Fatalf("expected redirect to /private, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	s, err := b.session(t, mw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.User.Identity != "alice" || s.User.AuthedBy != "oidc" {
+		t.Errorf("unexpected user %+v", s.User)
+	}
+	if _, ok := s.User.Groups["admins"]; !ok || len(s.User.Groups) != 2 {
+		t.Errorf("unexpected groups %v", s.User.Groups)
+	}
+	if len(s.AMR) != 2 || s.AMR[0] != "pwd" || s.AMR[1] != "otp" {
+		t.Errorf("unexpected amr %v", s.AMR)
+	}
+	if !s.AuthTime.Equal(authTime) {
+		t.Errorf("expected auth time %s, got %s", authTime, s.AuthTime)
+	}
+}
+
+func TestLoginWithoutAuthTime(t *testing.T) {
+	idp := newStubIdP(t)
+	rp, mw := newRelyingParty(t, idp)
+
+	b := browser{}
+	if w := login(t, idp, rp, b, "/login", nil); w.Code != http.StatusSeeOther {
+		t.Fatalf("login failed with %d", w.Code)
+	}
+	s, err := b.session(t, mw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.AuthTime.IsZero() {
+		t.Errorf("auth time should be unknown, got %s", s.AuthTime)
+	}
+}
+
+func TestCallbackRejects(t *testing.T) {
+	cases := []struct {
+		name   string
+		claims jwtlib.MapClaims
+	}{
+		{"nonce mismatch", jwtlib.MapClaims{"nonce": "not-the-nonce"}},
+		{"issuer mismatch", jwtlib.MapClaims{"iss": "https://elsewhere.example.com"}},
+		{"audience mismatch", jwtlib.MapClaims{"aud": "other-app"}},
+		{"expired", jwtlib.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}},
+		{"no identity", jwtlib.MapClaims{"sub": nil}},
+	}
+	idp := newStubIdP(t)
+	rp, mw := newRelyingParty(t, idp)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := browser{}
+			if w := login(t, idp, rp, b, "/login", c.claims); w.Code != http.StatusUnauthorized {
+				t.Errorf("expected 401, got %d", w.Code)
+			}
+			if _, err := b.session(t, mw); err == nil {
+				t.Error("session was issued")
+			}
+		})
+	}
+}
+
+func TestCallbackStateMismatch(t *testing.T) {
+	idp := newStubIdP(t)
+	rp, _ := newRelyingParty(t, idp)
+
+	b := browser{}
+	w := b.do(rp.LoginHandler(), "/login")
+	target, _ := url.Parse(w.Header().Get("Location"))
+	code := idp.authorize(t, target, nil)
+
+	q := url.Values{"code": {code}, "state": {"forged"}}
+	if w := b.do(rp.CallbackHandler(), "/login/callback?"+q.Encode()); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for forged state, got %d", w.Code)
+	}
+
+	// The flow state is consumed by the first callback, so the
+	// real state cannot be used afterwards either.
+	q.Set("state", target.Query().Get("state"))
+	if w := b.do(rp.CallbackHandler(), "/login/callback?"+q.Encode()); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 after the login was abandoned, got %d", w.Code)
+	}
+}
+
+func TestPKCEVerifierMismatch(t *testing.T) {
+	idp := newStubIdP(t)
+	rp, _ := newRelyingParty(t, idp)
+
+	b := browser{}
+	w := b.do(rp.LoginHandler(), "/login")
+	target, _ := url.Parse(w.Header().Get("Location"))
+	code := idp.authorize(t, target, nil)
+
+	// A code obtained by another client cannot be redeemed with
+	// this client's verifier.
+	idp.mu.Lock()
+	g := idp.codes[code]
+	g.challenge = "someone-elses-challenge"
+	idp.codes[code] = g
+	idp.mu.Unlock()
+
+	q := url.Values{"code": {code}, "state": {target.Query().Get("state")}}
+	if w := b.do(rp.CallbackHandler(), "/login/callback?"+q.Encode()); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", w.Code)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	idp := newStubIdP(t)
+	rp, mw := newRelyingParty(t, idp)
+
+	b := browser{}
+	w := b.do(rp.LoginHandler(), "/login?max_age=300")
+	target, _ := url.Parse(w.Header().Get("Location"))
+	if target.Query().Get("max_age") != "300" {
+		t.Errorf("max_age was not passed to the provider: %s", target)
+	}
+
+	cases := []struct {
+		name     string
+		authTime any
+		ok       bool
+	}{
+		{"recent", time.Now().Add(-time.Minute).Unix(), true},
+		{"too old", time.Now().Add(-time.Hour).Unix(), false},
+		{"missing", nil, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := browser{}
+			w := login(t, idp, rp, b, "/login?max_age=300", jwtlib.MapClaims{"auth_time": c.authTime})
+			if c.ok != (w.Code == http.StatusSeeOther) {
+				t.Errorf("unexpected status %d", w.Code)
+			}
+			if _, err := b.session(t, mw); c.ok != (err == nil) {
+				t.Errorf("unexpected session error %v", err)
+			}
+		})
+	}
+}
+
+func TestUserFromClaims(t *testing.T) {
+	rp := &RelyingParty{identityClaim: "email", groupsClaim: "roles"}
+	cases := []struct {
+		name   string
+		claims map[string]any
+		groups []string
+		err    bool
+	}{
+		{"list", map[string]any{"email": "a@example.com", "roles": []any{"x", "y", 3}}, []string{"x", "y"}, false},
+		{"single", map[string]any{"email": "a@example.com", "roles": "x"}, []string{"x"}, false},
+		{"none", map[string]any{"email": "a@example.com", "groups": []any{"ignored"}}, nil, false},
+		{"no identity", map[string]any{"sub": "alice"}, nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			u, err := rp.userFromClaims(c.claims)
+			if c.err {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Identity != "a@example.com" || u.AuthedBy != "oidc" {
+				t.Errorf("unexpected user %+v", u)
+			}
+			if len(u.Groups) != len(c.groups) {
+				t.Errorf("expected groups %v, got %v", c.groups, u.Groups)
+			}
+			for _, g := range c.groups {
+				if _, ok := u.Groups[g]; !ok {
+					t.Errorf("missing group %q", g)
+				}
+			}
+		})
+	}
+}
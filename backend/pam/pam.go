@@ -13,18 +13,40 @@ import (
 	"github.com/the-maldridge/authware"
 )
 
+// Config contains the settings for the PAM backend.
+type Config struct {
+	// Service is the name of the PAM stack to authenticate
+	// against.
+	Service string `mapstructure:"service"`
+}
+
 type pamBackend struct {
 	svc string
 }
 
 func init() {
-	authware.RegisterFactory("pam", New)
+	authware.RegisterFactory("pam", func() (authware.Authenticator, error) {
+		return New(ConfigFromEnv())
+	})
+	authware.RegisterConfigFactory("pam", func(decode func(any) error) (authware.Authenticator, error) {
+		var cfg Config
+		if err := decode(&cfg); err != nil {
+			return nil, err
+		}
+		return New(cfg)
+	})
+}
+
+// ConfigFromEnv obtains the backend configuration from
+// AUTHWARE_PAM_SERVICE.
+func ConfigFromEnv() Config {
+	return Config{Service: os.Getenv("AUTHWARE_PAM_SERVICE")}
 }
 
 // New can be used to get a new instance of this backend.
-func New() (authware.Authenticator, error) {
+func New(cfg Config) (authware.Authenticator, error) {
 	p := new(pamBackend)
-	p.svc = os.Getenv("AUTHWARE_PAM_SERVICE")
+	p.svc = cfg.Service
 	if p.svc == "" {
 		// If the service wasn't set, go for passwd.  This one
 		// usually only requires pam_unix.so, and is generally
@@ -0,0 +1,197 @@
+package token
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/the-maldridge/authware"
+)
+
+// Config contains the settings for the token backend.
+type Config struct {
+	// File is the path to the token file.
+	File string `mapstructure:"file"`
+}
+
+type entry struct {
+	hash     []byte
+	identity string
+	groups   map[string]struct{}
+}
+
+type tokenBackend struct {
+	file string
+
+	mu      sync.RWMutex
+	entries []entry
+}
+
+func init() {
+	authware.RegisterFactory("token", func() (authware.Authenticator, error) {
+		return New(ConfigFromEnv())
+	})
+	authware.RegisterConfigFactory("token", func(decode func(any) error) (authware.Authenticator, error) {
+		var cfg Config
+		if err := decode(&cfg); err != nil {
+			return nil, err
+		}
+		return New(cfg)
+	})
+}
+
+// ConfigFromEnv obtains the backend configuration from
+// AUTHWARE_TOKEN_FILE.
+func ConfigFromEnv() Config {
+	return Config{File: os.Getenv("AUTHWARE_TOKEN_FILE")}
+}
+
+// New can be used to get a new instance of this backend.  The file
+// defaults to .tokens in the current directory.  The returned value
+// implements both authware.Authenticator and
+// authware.TokenAuthenticator.
+func New(cfg Config) (authware.Authenticator, error) {
+	if cfg.File == "" {
+		cfg.File = ".tokens"
+	}
+
+	x := &tokenBackend{file: cfg.File}
+	if err := x.reload(); err != nil {
+		return nil, err
+	}
+
+	rChan := make(chan os.Signal, 1)
+	signal.Notify(rChan, syscall.SIGHUP)
+
+	go func() {
+		for {
+			<-rChan
+			if err := x.reload(); err != nil {
+				slog.Warn("Error reloading tokens", "error", err)
+				continue
+			}
+			slog.Info("Reloaded tokens")
+		}
+	}()
+
+	slog.Info("Initialized", "tokens", cfg.File)
+	return x, nil
+}
+
+// Generate returns a new random token, and the hash of it that should
+// be placed in the token file.
+func Generate() (string, string) {
+	token := rand.Text() + rand.Text()
+	return token, Hash(token)
+}
+
+// Hash returns the hex encoded hash of a token in the form used by
+// the token file.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *tokenBackend) AuthToken(ctx context.Context, token string) (authware.User, error) {
+	sum := sha256.Sum256([]byte(token))
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, e := range t.entries {
+		if subtle.ConstantTimeCompare(sum[:], e.hash) == 1 {
+			groups := make(map[string]struct{}, len(e.groups))
+			for g := range e.groups {
+				groups[g] = struct{}{}
+			}
+			return authware.User{Identity: e.identity, Groups: groups}, nil
+		}
+	}
+	slog.Debug("Token not recognized")
+	return authware.User{}, new(authware.ErrUnauthenticated)
+}
+
+// AuthUserPassword allows clients that can only speak basic auth to
+// present a token as the password.  The username must match the
+// identity the token belongs to.
+func (t *tokenBackend) AuthUserPassword(ctx context.Context, user, pass string) error {
+	u, err := t.AuthToken(ctx, pass)
+	if err != nil || u.Identity != user {
+		slog.Debug("User unauthenticated", "user", user)
+		return new(authware.ErrUnauthenticated)
+	}
+	return nil
+}
+
+func (t *tokenBackend) UserGroups(ctx context.Context, user string) (map[string]struct{}, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	out := make(map[string]struct{})
+	for _, e := range t.entries {
+		if e.identity != user {
+			continue
+		}
+		for g := range e.groups {
+			out[g] = struct{}{}
+		}
+	}
+	return out, nil
+}
+
+func (t *tokenBackend) Name() string {
+	return "token"
+}
+
+func (t *tokenBackend) reload() error {
+	f, err := os.Open(t.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var entries []entry
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 || fields[1] == "" {
+			return fmt.Errorf("%s:%d: expected hash:identity[:groups]", t.file, n)
+		}
+		hash, err := hex.DecodeString(fields[0])
+		if err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("%s:%d: hash must be a hex encoded sha256", t.file, n)
+		}
+
+		e := entry{hash: hash, identity: fields[1], groups: make(map[string]struct{})}
+		if len(fields) == 3 {
+			for _, g := range strings.Split(fields[2], ",") {
+				if g = strings.TrimSpace(g); g != "" {
+					e.groups[g] = struct{}{}
+				}
+			}
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.entries = entries
+	t.mu.Unlock()
+	return nil
+}
@@ -6,23 +6,27 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
-	"os"
-	"strings"
-
-	"github.com/meehow/securebytes"
+	"slices"
 )
 
-// NewAuth returns a basic auth middleware.
-func NewAuth() (*BasicMiddleware, error) {
-	x := new(BasicMiddleware)
+// NewAuth returns a basic auth middleware.  If no options are
+// provided, the middleware is configured from the environment as
+// though FromEnv had been passed.
+func NewAuth(opts ...Option) (*BasicMiddleware, error) {
+	if len(opts) == 0 {
+		opts = []Option{FromEnv()}
+	}
 
-	ai, ok := os.LookupEnv("AUTHWARE_BASIC_MECHS")
-	authsList := strings.Split(ai, ":")
-	if len(authsList) == 0 || !ok {
-		authsList = []string{"htpasswd"}
-		slog.Warn("No auth mechanisms specified, defaulting to built in list", "list", authsList)
+	o := defaultOptions()
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
 	}
-	for _, mech := range authsList {
+
+	x := new(BasicMiddleware)
+	x.a = slices.Clone(o.authenticators)
+	for _, mech := range o.mechs {
 		a, err := Initialize(mech)
 		if err != nil {
 			slog.Error("Could not initialize auth", "mechanism", mech, "error", err)
@@ -30,16 +34,61 @@ func NewAuth() (*BasicMiddleware, error) {
 		}
 		x.a = append(x.a, a)
 	}
+	x.t = slices.Clone(o.tokens)
+	for _, mech := range o.tokenMechs {
+		a, err := Initialize(mech)
+		if err != nil {
+			slog.Error("Could not initialize token auth", "mechanism", mech, "error", err)
+			return nil, err
+		}
+		t, ok := a.(TokenAuthenticator)
+		if !ok {
+			slog.Error("Mechanism cannot authenticate tokens", "mechanism", mech)
+			return nil, ErrDoesNotExist{}
+		}
+		x.t = append(x.t, t)
+	}
 
-	sk := os.Getenv("AUTHWARE_SESSION_KEY")
-	if sk == "" {
-		sk = rand.Text()
+	if o.cache != nil {
+		x.cache = newResultCache(*o.cache)
 	}
 
-	x.sb = securebytes.New(
-		[]byte(os.Getenv(sk)),
-		securebytes.JSONSerializer{},
-	)
+	x.keys = o.keyring
+	if x.keys == nil {
+		slog.Warn("No session key configured, sessions will not survive a restart")
+		x.keys = NewKeyring([]byte(rand.Text() + rand.Text()))
+	}
+	x.store = o.store
+	x.sessionLifetime = o.sessionLifetime
+	x.idleTimeout = o.idleTimeout
+	x.cookie = o.cookie
+	x.redirect = o.redirect
+	x.loginCSRF = o.loginCSRF
+	x.limits = o.limits
+	x.limits.setDefaults()
+	x.header = o.header
+	x.header.setDefaults()
+	if o.clientCert != nil {
+		c := *o.clientCert
+		c.setDefaults()
+		x.clientCert = &c
+	}
+	if o.totp != nil {
+		t := *o.totp
+		t.setDefaults()
+		x.totp = &t
+		x.factors = append(x.factors, totpFactor{x.totp})
+	}
+	if o.recovery != nil {
+		rc := *o.recovery
+		rc.setDefaults()
+		x.recovery = &rc
+	}
+	x.mfa = o.mfa
+	x.refreshThreshold = o.refreshThreshold
+	if x.refreshThreshold <= 0 {
+		x.refreshThreshold = x.idleTimeout / 2
+	}
 
 	return x, nil
 }
@@ -56,34 +105,76 @@ func (b *BasicMiddleware) BasicHandler(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := b.authByUsernamePassword(r.Context(), u, p)
+		user, err := b.authRateLimited(r, u, p, false)
+		if rl, ok := err.(ErrRateLimited); ok {
+			writeRateLimited(w, rl)
+			return
+		}
 		if err != nil {
 			slog.Debug("Denying request after no auth method matched")
 			w.WriteHeader(http.StatusUnauthorized)
 			fmt.Fprintln(w, "Access Denied")
 			return
 		}
-		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), UserKey{}, user)))
+		next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
 	})
 }
 
 func (b *BasicMiddleware) authByUsernamePassword(ctx context.Context, user, pass string) (User, error) {
+	var hash []byte
+	if b.cache != nil {
+		var err error
+		if hash, err = b.cache.hash(user, pass); err != nil {
+			return User{}, err
+		}
+		if entry, ok := b.cache.cred(user, hash); ok {
+			slog.Debug("Using cached verification", "mech", entry.by, "user", user, "ok", entry.ok)
+			if !entry.ok {
+				return User{}, ErrUnauthenticated{}
+			}
+			for _, a := range b.a {
+				if a.Name() == entry.by {
+					return b.userFrom(ctx, a, user), nil
+				}
+			}
+		}
+	}
+
 	for _, a := range b.a {
 		slog.Debug("Attempting authentication", "mech", a.Name())
 		if a.AuthUserPassword(ctx, user, pass) == nil {
-			groups, err := a.UserGroups(ctx, user)
-			if err != nil {
-				slog.Warn("Error while retriving user groups", "error", err)
-				groups = make(map[string]struct{})
-			}
-
-			usr := User{
-				AuthedBy: a.Name(),
-				Identity: user,
-				Groups:   groups,
+			if b.cache != nil {
+				b.cache.putCred(user, hash, a.Name(), true)
 			}
-			return usr, nil
+			return b.userFrom(ctx, a, user), nil
 		}
 	}
+	if b.cache != nil {
+		b.cache.putCred(user, hash, "", false)
+	}
 	return User{}, ErrUnauthenticated{}
 }
+
+// userFrom builds the User that a accepted.
+func (b *BasicMiddleware) userFrom(ctx context.Context, a Authenticator, user string) User {
+	groups, err := b.userGroups(ctx, a, user)
+	if err != nil {
+		slog.Warn("Error while retriving user groups", "error", err)
+		groups = make(map[string]struct{})
+	}
+
+	return User{
+		AuthedBy: a.Name(),
+		Identity: user,
+		Groups:   groups,
+	}
+}
+
+// userGroups asks a for the user's groups, through the cache if one
+// is configured.
+func (b *BasicMiddleware) userGroups(ctx context.Context, a Authenticator, user string) (map[string]struct{}, error) {
+	if b.cache != nil {
+		return b.cache.userGroups(ctx, a, user)
+	}
+	return a.UserGroups(ctx, user)
+}
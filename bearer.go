@@ -0,0 +1,64 @@
+package authware
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// BearerHandler authenticates requests that carry a token in an
+// "Authorization: Bearer" header using the configured token
+// authenticators.
+func (b *BasicMiddleware) BearerHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			slog.Debug("Received request with no bearer token", "url", r.URL.String())
+			w.Header().Set("WWW-Authenticate", `Bearer realm="restricted"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Bearer Token Required")
+			return
+		}
+
+		user, err := b.rateLimited(r, []limitKey{b.ipLimitKey(r)}, nil, func() (User, error) {
+			return b.authByToken(r.Context(), token)
+		})
+		if rl, ok := err.(ErrRateLimited); ok {
+			writeRateLimited(w, rl)
+			return
+		}
+		if err != nil {
+			slog.Debug("Denying request after no token authenticator matched")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="restricted", error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Access Denied")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+	})
+}
+
+func (b *BasicMiddleware) authByToken(ctx context.Context, token string) (User, error) {
+	for _, t := range b.t {
+		slog.Debug("Attempting token authentication", "mech", t.Name())
+		user, err := t.AuthToken(ctx, token)
+		if err == nil {
+			user.AuthedBy = t.Name()
+			return user, nil
+		}
+	}
+	return User{}, ErrUnauthenticated{}
+}
+
+// bearerToken extracts the token from an Authorization header using
+// the Bearer scheme.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
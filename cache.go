@@ -0,0 +1,241 @@
+package authware
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// CacheOptions controls how long a CachingAuthenticator remembers
+// the results it obtains from the authenticator it wraps.
+type CacheOptions struct {
+	// TTL is how long a successful verification is remembered.
+	// Defaults to 5 minutes.
+	TTL time.Duration
+
+	// GroupTTL is how long group memberships are remembered.
+	// Defaults to TTL.
+	GroupTTL time.Duration
+
+	// NegativeTTL is how long a failed verification is
+	// remembered.  Negative caching is disabled unless this is
+	// set, since it would delay a user whose password was just
+	// changed from logging in.
+	NegativeTTL time.Duration
+}
+
+// CachingAuthenticator wraps another Authenticator and remembers the
+// results of recent verifications and group lookups, reducing the
+// load on backends that are expensive to query.  Passwords are never
+// held in the cache; only a salted PBKDF2 hash is retained to compare
+// against later attempts.
+type CachingAuthenticator struct {
+	a Authenticator
+	c *resultCache
+}
+
+// NewCachingAuthenticator wraps a with a cache.
+func NewCachingAuthenticator(a Authenticator, opts CacheOptions) *CachingAuthenticator {
+	return &CachingAuthenticator{a: a, c: newResultCache(opts)}
+}
+
+// AuthUserPassword consults the cache before the wrapped
+// authenticator.
+func (c *CachingAuthenticator) AuthUserPassword(ctx context.Context, user, pass string) error {
+	hash, err := c.c.hash(user, pass)
+	if err != nil {
+		return err
+	}
+	if entry, ok := c.c.cred(user, hash); ok {
+		slog.Debug("Using cached verification", "mech", c.a.Name(), "user", user, "ok", entry.ok)
+		if entry.ok {
+			return nil
+		}
+		return new(ErrUnauthenticated)
+	}
+
+	err = c.a.AuthUserPassword(ctx, user, pass)
+	c.c.putCred(user, hash, c.a.Name(), err == nil)
+	return err
+}
+
+// UserGroups consults the cache before the wrapped authenticator.
+// Errors are never cached.
+func (c *CachingAuthenticator) UserGroups(ctx context.Context, user string) (map[string]struct{}, error) {
+	return c.c.userGroups(ctx, c.a, user)
+}
+
+// Name returns the name of the wrapped authenticator, so that users
+// are reported as authenticated by the real backend.
+func (c *CachingAuthenticator) Name() string {
+	return c.a.Name()
+}
+
+// Invalidate forgets everything cached about a user.
+func (c *CachingAuthenticator) Invalidate(user string) {
+	c.c.invalidate(user)
+}
+
+// InvalidateAll empties the cache.
+func (c *CachingAuthenticator) InvalidateAll() {
+	c.c.invalidateAll()
+}
+
+// resultCache holds the results remembered by a CachingAuthenticator,
+// or by the middleware for its whole authenticator chain.  The latter
+// records which backend accepted each user, so that a cached login
+// does not consult the backends earlier in the chain that do not
+// know them.
+type resultCache struct {
+	opts CacheOptions
+	salt []byte
+
+	mu     sync.Mutex
+	creds  map[string]cachedCred
+	groups map[groupKey]cachedGroups
+}
+
+type cachedCred struct {
+	hash    []byte
+	by      string
+	ok      bool
+	expires time.Time
+}
+
+type groupKey struct {
+	backend string
+	user    string
+}
+
+type cachedGroups struct {
+	groups  map[string]struct{}
+	expires time.Time
+}
+
+func newResultCache(opts CacheOptions) *resultCache {
+	if opts.TTL <= 0 {
+		opts.TTL = 5 * time.Minute
+	}
+	if opts.GroupTTL <= 0 {
+		opts.GroupTTL = opts.TTL
+	}
+
+	salt := make([]byte, 16)
+	rand.Read(salt)
+
+	return &resultCache{
+		opts:   opts,
+		salt:   salt,
+		creds:  make(map[string]cachedCred),
+		groups: make(map[groupKey]cachedGroups),
+	}
+}
+
+// hash returns the value that a password is remembered by.
+func (c *resultCache) hash(user, pass string) ([]byte, error) {
+	salt := append(slices.Clip(c.salt), user...)
+	return pbkdf2.Key(sha256.New, pass, salt, 10000, 32)
+}
+
+// cred returns the result remembered for the user, if there is one
+// and it was for the same password.
+func (c *resultCache) cred(user string, hash []byte) (cachedCred, bool) {
+	c.mu.Lock()
+	entry, ok := c.creds[user]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) && subtle.ConstantTimeCompare(hash, entry.hash) == 1 {
+		return entry, true
+	}
+	return cachedCred{}, false
+}
+
+// putCred remembers that the backend named by accepted the password,
+// or that no backend did.  Failures are only remembered if negative
+// caching is enabled.
+func (c *resultCache) putCred(user string, hash []byte, by string, ok bool) {
+	ttl := c.opts.TTL
+	if !ok {
+		if c.opts.NegativeTTL <= 0 {
+			return
+		}
+		ttl = c.opts.NegativeTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Expired entries are dropped as new ones are added so that
+	// the cache does not grow without bound.
+	now := time.Now()
+	for u, e := range c.creds {
+		if now.After(e.expires) {
+			delete(c.creds, u)
+		}
+	}
+	for k, e := range c.groups {
+		if now.After(e.expires) {
+			delete(c.groups, k)
+		}
+	}
+	c.creds[user] = cachedCred{hash: hash, by: by, ok: ok, expires: now.Add(ttl)}
+}
+
+// userGroups returns the groups that a reports for the user,
+// consulting the cache first.  Errors are never cached.
+func (c *resultCache) userGroups(ctx context.Context, a Authenticator, user string) (map[string]struct{}, error) {
+	k := groupKey{backend: a.Name(), user: user}
+	c.mu.Lock()
+	entry, ok := c.groups[k]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return maps.Clone(entry.groups), nil
+	}
+
+	groups, err := a.UserGroups(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.groups[k] = cachedGroups{groups: maps.Clone(groups), expires: time.Now().Add(c.opts.GroupTTL)}
+	c.mu.Unlock()
+	return groups, nil
+}
+
+func (c *resultCache) invalidate(user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.creds, user)
+	for k := range c.groups {
+		if k.user == user {
+			delete(c.groups, k)
+		}
+	}
+}
+
+func (c *resultCache) invalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.creds)
+	clear(c.groups)
+}
+
+// InvalidateCache forgets everything cached about a user, both by
+// the middleware and by any CachingAuthenticator in the chain.
+func (b *BasicMiddleware) InvalidateCache(user string) {
+	if b.cache != nil {
+		b.cache.invalidate(user)
+	}
+	for _, a := range b.a {
+		if c, ok := a.(*CachingAuthenticator); ok {
+			c.Invalidate(user)
+		}
+	}
+}
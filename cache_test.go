@@ -0,0 +1,191 @@
+package authware
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingBackend accepts the passwords it is given and counts how
+// often it is asked.
+type countingBackend struct {
+	name      string
+	passwords map[string]string
+
+	mu     sync.Mutex
+	auths  int
+	groups int
+}
+
+func (c *countingBackend) AuthUserPassword(ctx context.Context, user, pass string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.auths++
+	if p, ok := c.passwords[user]; !ok || p != pass {
+		return ErrUnauthenticated{}
+	}
+	return nil
+}
+
+func (c *countingBackend) UserGroups(ctx context.Context, user string) (map[string]struct{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.groups++
+	return map[string]struct{}{c.name: {}}, nil
+}
+
+func (c *countingBackend) Name() string { return c.name }
+
+func (c *countingBackend) calls() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.auths, c.groups
+}
+
+func TestCachedChain(t *testing.T) {
+	first := &countingBackend{name: "first", passwords: map[string]string{}}
+	second := &countingBackend{name: "second", passwords: map[string]string{"alice": "secret"}}
+	b, err := NewAuth(WithAuthenticators(first, second), WithCache(CacheOptions{TTL: time.Minute}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		u, err := b.authByUsernamePassword(ctx, "alice", "secret")
+		if err != nil {
+			t.Fatalf("login %d: %v", i, err)
+		}
+		if _, ok := u.Groups["second"]; u.AuthedBy != "second" || !ok {
+			t.Fatalf("login %d returned %+v", i, u)
+		}
+	}
+	if auths, _ := first.calls(); auths != 1 {
+		t.Errorf("backend before the one that knows the user was asked %d times", auths)
+	}
+	if auths, groups := second.calls(); auths != 1 || groups != 1 {
+		t.Errorf("backend was asked to verify %d times and for groups %d times", auths, groups)
+	}
+
+	// A different password is not answered from the cache.
+	if _, err := b.authByUsernamePassword(ctx, "alice", "wrong"); err == nil {
+		t.Error("wrong password was accepted")
+	}
+	if auths, _ := second.calls(); auths != 2 {
+		t.Errorf("wrong password was not checked with the backend")
+	}
+
+	b.InvalidateCache("alice")
+	b.authByUsernamePassword(ctx, "alice", "secret")
+	if auths, _ := first.calls(); auths != 3 {
+		t.Errorf("chain was not consulted after the cache was invalidated")
+	}
+}
+
+func TestCachingAuthenticator(t *testing.T) {
+	backend := &countingBackend{name: "backend", passwords: map[string]string{"alice": "secret", "bob": "hunter2"}}
+	c := NewCachingAuthenticator(backend, CacheOptions{TTL: time.Minute})
+	ctx := context.Background()
+
+	login := func(user, pass string) error {
+		t.Helper()
+		return c.AuthUserPassword(ctx, user, pass)
+	}
+	expectCalls := func(what string, want int) {
+		t.Helper()
+		if auths, _ := backend.calls(); auths != want {
+			t.Errorf("%s: backend was asked %d times, want %d", what, auths, want)
+		}
+	}
+
+	if err := login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls("cache hit", 1)
+	if c.Name() != "backend" {
+		t.Errorf("Name() = %q", c.Name())
+	}
+
+	// A wrong password never matches the cached entry, and
+	// failures are not remembered by default.
+	for i := 0; i < 2; i++ {
+		if err := login("alice", "wrong"); err == nil {
+			t.Fatal("wrong password was accepted")
+		}
+	}
+	expectCalls("wrong password", 3)
+	if err := login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	expectCalls("after a wrong password", 3)
+
+	login("bob", "hunter2")
+	c.Invalidate("alice")
+	login("alice", "secret")
+	login("bob", "hunter2")
+	expectCalls("Invalidate", 5)
+
+	c.InvalidateAll()
+	login("alice", "secret")
+	login("bob", "hunter2")
+	expectCalls("InvalidateAll", 7)
+}
+
+func TestCachingAuthenticatorExpiry(t *testing.T) {
+	backend := &countingBackend{name: "backend", passwords: map[string]string{"alice": "secret"}}
+	c := NewCachingAuthenticator(backend, CacheOptions{TTL: 100 * time.Millisecond})
+	ctx := context.Background()
+
+	c.AuthUserPassword(ctx, "alice", "secret")
+	time.Sleep(150 * time.Millisecond)
+	if err := c.AuthUserPassword(ctx, "alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if auths, _ := backend.calls(); auths != 2 {
+		t.Errorf("backend was asked %d times, want 2 after the entry expired", auths)
+	}
+}
+
+func TestCachingAuthenticatorGroups(t *testing.T) {
+	backend := &countingBackend{name: "backend"}
+	c := NewCachingAuthenticator(backend, CacheOptions{TTL: time.Minute, GroupTTL: 50 * time.Millisecond})
+	ctx := context.Background()
+
+	groups, _ := c.UserGroups(ctx, "alice")
+	delete(groups, "backend")
+	if groups, _ := c.UserGroups(ctx, "alice"); len(groups) != 1 {
+		t.Error("changing the returned groups changed the cache")
+	}
+	if _, n := backend.calls(); n != 1 {
+		t.Errorf("groups were looked up %d times", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	c.UserGroups(ctx, "alice")
+	if _, n := backend.calls(); n != 2 {
+		t.Errorf("expired groups were not looked up again")
+	}
+}
+
+func TestCachingAuthenticatorNegative(t *testing.T) {
+	backend := &countingBackend{name: "backend", passwords: map[string]string{"alice": "secret"}}
+	c := NewCachingAuthenticator(backend, CacheOptions{NegativeTTL: time.Minute})
+	ctx := context.Background()
+
+	c.AuthUserPassword(ctx, "alice", "wrong")
+	if err := c.AuthUserPassword(ctx, "alice", "wrong"); err == nil {
+		t.Error("cached failure was accepted")
+	}
+	if auths, _ := backend.calls(); auths != 1 {
+		t.Errorf("backend was asked %d times for a remembered failure", auths)
+	}
+
+	// A remembered failure does not stop the right password.
+	if err := c.AuthUserPassword(ctx, "alice", "secret"); err != nil {
+		t.Error(err)
+	}
+}
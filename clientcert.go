@@ -0,0 +1,205 @@
+package authware
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// The places that a client certificate identity may be taken from.
+const (
+	// CertIdentityCN uses the common name of the subject.
+	CertIdentityCN = "cn"
+
+	// CertIdentityEmail uses the first email address in the
+	// subject alternative names.
+	CertIdentityEmail = "email"
+
+	// CertIdentityURI uses the first URI in the subject
+	// alternative names, such as a SPIFFE ID.
+	CertIdentityURI = "uri"
+)
+
+// ClientCertOptions controls authentication with X.509 client
+// certificates.  Certificates presented directly are read from the
+// verified chains of the TLS connection, so the server's tls.Config
+// must set ClientCAs and a ClientAuth mode that verifies
+// certificates.
+type ClientCertOptions struct {
+	// Identity is one of CertIdentityCN, CertIdentityEmail, or
+	// CertIdentityURI.  It defaults to CertIdentityCN.
+	Identity string
+
+	// URIPrefix restricts CertIdentityURI to URIs that begin with
+	// the prefix, for example "spiffe://example.org/".
+	URIPrefix string
+
+	// Groups maps a certificate to the groups of its user.  If it
+	// is nil, the organizational units of the subject are used.
+	Groups func(*x509.Certificate) []string
+
+	// Name is recorded as the AuthedBy of users authenticated by
+	// certificate.  It defaults to "x509".
+	Name string
+
+	// ForwardedHeader is a header in which a TLS terminating
+	// proxy passes on the client's certificate, either as URL
+	// escaped PEM or as base64 DER.  It is only read on requests
+	// that arrive from one of the ForwardedProxies.
+	ForwardedHeader  string
+	ForwardedProxies []netip.Prefix
+
+	// ForwardedRoots verifies forwarded certificates.  If it is
+	// nil, the proxy is trusted to have verified the certificate
+	// and only its validity period is checked.
+	ForwardedRoots *x509.CertPool
+}
+
+// LoadCertPool reads a file of PEM encoded CA certificates.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no certificates found", file)
+	}
+	return pool, nil
+}
+
+func (c *ClientCertOptions) setDefaults() {
+	if c.Identity == "" {
+		c.Identity = CertIdentityCN
+	}
+	if c.Groups == nil {
+		c.Groups = func(cert *x509.Certificate) []string {
+			return cert.Subject.OrganizationalUnit
+		}
+	}
+	if c.Name == "" {
+		c.Name = "x509"
+	}
+}
+
+// ClientCertHandler authenticates requests using a client
+// certificate, either presented on the TLS connection or forwarded by
+// a trusted proxy.  Requests without an acceptable certificate are
+// rejected.
+func (b *BasicMiddleware) ClientCertHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := b.clientCertUser(r)
+		if !ok {
+			slog.Debug("Received request with no usable client certificate", "remote", r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Client Certificate Required")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+	})
+}
+
+// clientCertUser builds a User from the client certificate of the
+// request, if there is one and it carries an identity.
+func (b *BasicMiddleware) clientCertUser(r *http.Request) (User, bool) {
+	opts := b.clientCert
+	if opts == nil {
+		opts = new(ClientCertOptions)
+		opts.setDefaults()
+	}
+
+	var cert *x509.Certificate
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cert = r.TLS.VerifiedChains[0][0]
+	} else if v := r.Header.Get(opts.ForwardedHeader); opts.ForwardedHeader != "" && v != "" {
+		if !remoteIn(r, opts.ForwardedProxies) {
+			slog.Warn("Ignoring forwarded certificate from untrusted address", "remote", r.RemoteAddr, "header", opts.ForwardedHeader)
+			return User{}, false
+		}
+		c, err := opts.forwardedCert(v)
+		if err != nil {
+			slog.Debug("Rejecting forwarded certificate", "error", err)
+			return User{}, false
+		}
+		cert = c
+	}
+	if cert == nil {
+		return User{}, false
+	}
+
+	identity := opts.identity(cert)
+	if identity == "" {
+		slog.Debug("Client certificate has no usable identity", "subject", cert.Subject.String(), "source", opts.Identity)
+		return User{}, false
+	}
+	user := User{
+		Identity: identity,
+		Groups:   make(map[string]struct{}),
+		AuthedBy: opts.Name,
+	}
+	for _, g := range opts.Groups(cert) {
+		user.Groups[g] = struct{}{}
+	}
+	return user, true
+}
+
+func (c *ClientCertOptions) identity(cert *x509.Certificate) string {
+	switch c.Identity {
+	case CertIdentityEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case CertIdentityURI:
+		for _, u := range cert.URIs {
+			if s := u.String(); strings.HasPrefix(s, c.URIPrefix) {
+				return s
+			}
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+	return ""
+}
+
+// forwardedCert parses and checks a certificate passed on by a proxy.
+func (c *ClientCertOptions) forwardedCert(v string) (*x509.Certificate, error) {
+	if unescaped, err := url.PathUnescape(v); err == nil {
+		v = unescaped
+	}
+
+	var der []byte
+	if block, _ := pem.Decode([]byte(v)); block != nil {
+		der = block.Bytes
+	} else {
+		d, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, errors.New("certificate is neither PEM nor base64 DER")
+		}
+		der = d
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.ForwardedRoots != nil {
+		_, err := cert.Verify(x509.VerifyOptions{
+			Roots:     c.ForwardedRoots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		return cert, err
+	}
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, errors.New("certificate is not valid at this time")
+	}
+	return cert, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/the-maldridge/authware"
+	"github.com/the-maldridge/authware/config"
+)
+
+const defaultLoginTemplate = `<!DOCTYPE html>
+<html>
+<head><title>Log In</title></head>
+<body>
+<form method="post">
+{{ .CSRF }}
+<label>Username <input type="text" name="{{ .UserField }}" autocomplete="username" autofocus /></label><br />
+<label>Password <input type="password" name="{{ .PassField }}" autocomplete="current-password" /></label><br />
+<input type="submit" value="Log In" />
+</form>
+</body>
+</html>
+`
+
+var totpTemplate = template.Must(template.New("totp").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Log In</title></head>
+<body>
+<form method="post">
+{{ .CSRF }}
+<label>Code <input type="text" name="{{ .CodeField }}" inputmode="numeric" autocomplete="one-time-code" autofocus /></label><br />
+<input type="submit" value="Continue" />
+</form>
+{{ with .RecoveryPath }}<p><a href="{{ . }}">Use a recovery code</a></p>{{ end }}
+</body>
+</html>
+`))
+
+var recoveryTemplate = template.Must(template.New("recovery").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Log In</title></head>
+<body>
+<form method="post">
+{{ .CSRF }}
+<label>Recovery code <input type="text" name="{{ .CodeField }}" autocomplete="off" autofocus /></label><br />
+<input type="submit" value="Continue" />
+</form>
+</body>
+</html>
+`))
+
+var enrollTemplate = template.Must(template.New("enroll").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Enroll</title></head>
+<body>
+<p>Add this key to your authenticator app, then enter the code it shows.</p>
+<p><a href="{{ .URI }}">{{ .Secret }}</a></p>
+<form method="post">
+{{ .CSRF }}
+<label>Code <input type="text" name="{{ .CodeField }}" inputmode="numeric" autocomplete="one-time-code" autofocus /></label><br />
+<input type="submit" value="Enroll" />
+</form>
+{{ with .Continue }}<p>Once enrolled, <a href="{{ . }}">continue to log in</a>.</p>{{ end }}
+</body>
+</html>
+`))
+
+var logoutTemplate = template.Must(template.New("logout").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Log Out</title></head>
+<body>
+<form method="post">
+{{ .CSRF }}
+<input type="submit" value="Log Out" />
+</form>
+</body>
+</html>
+`))
+
+type daemon struct {
+	cfg   *config.Config
+	mw    *authware.BasicMiddleware
+	login atomic.Pointer[template.Template]
+}
+
+func newDaemon(cfg *config.Config, mw *authware.BasicMiddleware) (*daemon, error) {
+	d := &daemon{cfg: cfg, mw: mw}
+	if err := d.reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// reload parses the login template again and swaps it in if it is
+// valid.
+func (d *daemon) reload() error {
+	text := defaultLoginTemplate
+	if d.cfg.Server.LoginTemplate != "" {
+		b, err := os.ReadFile(d.cfg.Server.LoginTemplate)
+		if err != nil {
+			return err
+		}
+		text = string(b)
+	}
+
+	t, err := template.New("login").Parse(text)
+	if err != nil {
+		return err
+	}
+	d.login.Store(t)
+	return nil
+}
+
+func (d *daemon) routes() http.Handler {
+	l := d.cfg.Login
+	s := d.cfg.Server
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+l.Path, d.loginPage)
+	mux.HandleFunc("POST "+l.Path, d.mw.LoginFormHandler(l.UserField, l.PassField, l.DefaultNext))
+	// Logging out is a POST with the CSRF token, so that another
+	// site cannot log users out.  The GET serves a form for it.
+	mux.HandleFunc("GET "+l.LogoutPath, d.logoutPage)
+	mux.Handle("POST "+l.LogoutPath, d.mw.CSRFHandler()(http.HandlerFunc(d.mw.LogoutHandler(l.Path))))
+	mux.Handle(s.ForwardAuthPath, d.mw.ForwardAuthHandler(s.ForwardAuthLogin))
+
+	// Replacing a second factor or its recovery codes needs a
+	// recent login, so users that logged in too long ago are sent
+	// to log in again first.
+	login := d.mw.LoginHandler(l.Path)
+	recent := d.mw.RequireRecentAuth(l.Path, authware.RecentAuthAge)
+	if t := d.cfg.TOTP; t.Enabled {
+		mux.HandleFunc("GET "+t.Path, d.totpPage)
+		mux.HandleFunc("POST "+t.Path, d.mw.TOTPFormHandler(t.CodeField))
+		enroll := d.mw.EnrollmentHandler(func(next http.Handler) http.Handler {
+			return login(recent(next))
+		})
+		mux.Handle("GET "+t.EnrollPath, enroll(http.HandlerFunc(d.enrollPage)))
+		mux.Handle("POST "+t.EnrollPath, enroll(d.mw.TOTPEnrollHandler(t.CodeField)))
+	}
+	if rc := d.cfg.Recovery; rc.Enabled {
+		mux.HandleFunc("GET "+rc.Path, d.recoveryPage)
+		mux.HandleFunc("POST "+rc.Path, d.mw.RecoveryFormHandler(rc.CodeField))
+		mux.Handle(rc.ManagePath, login(recent(d.mw.RecoveryCodesHandler())))
+	}
+	mux.HandleFunc(s.HealthPath, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	if s.Upstream != "" {
+		upstream, _ := url.Parse(s.Upstream)
+		mux.Handle("/", d.authenticate(d.proxy(upstream)))
+	} else {
+		mux.Handle("/", d.authenticate(http.HandlerFunc(d.landing)))
+	}
+	return mux
+}
+
+// authenticate checks the credentials of any client that sent proxy
+// headers, a client certificate, or an Authorization header, and
+// sends everyone else to the login page.
+func (d *daemon) authenticate(next http.Handler) http.Handler {
+	return d.mw.MultiAuthOrLoginHandler(d.cfg.Login.Path)(next)
+}
+
+// proxy passes authenticated requests to the upstream, identifying
+// the user with the same headers that the forward auth endpoint
+// returns.  Any copies of those headers sent by the client are
+// removed first, as are the client's credentials so that the
+// upstream cannot replay them.
+func (d *daemon) proxy(upstream *url.URL) http.Handler {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(upstream)
+			pr.SetXForwarded()
+			d.mw.StripCredentials(pr.Out)
+
+			user := authware.MustUser(pr.In.Context())
+			groups := make([]string, 0, len(user.Groups))
+			for g := range user.Groups {
+				groups = append(groups, g)
+			}
+			slices.Sort(groups)
+
+			pr.Out.Header.Set("X-Auth-User", user.Identity)
+			pr.Out.Header.Set("X-Auth-Groups", strings.Join(groups, ","))
+			pr.Out.Header.Set("X-Auth-Backend", user.AuthedBy)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("Error proxying request", "url", r.URL.String(), "error", err)
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintln(w, "Bad Gateway")
+		},
+	}
+}
+
+func (d *daemon) loginPage(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{
+		"CSRF":      d.mw.CSRFField(w, r),
+		"UserField": d.cfg.Login.UserField,
+		"PassField": d.cfg.Login.PassField,
+	}
+	if err := d.login.Load().Execute(w, data); err != nil {
+		slog.Warn("Error rendering login page", "error", err)
+	}
+}
+
+func (d *daemon) logoutPage(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{"CSRF": d.mw.CSRFField(w, r)}
+	if err := logoutTemplate.Execute(w, data); err != nil {
+		slog.Warn("Error rendering logout page", "error", err)
+	}
+}
+
+func (d *daemon) totpPage(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{
+		"CSRF":      d.mw.CSRFField(w, r),
+		"CodeField": d.cfg.TOTP.CodeField,
+	}
+	if d.cfg.Recovery.Enabled {
+		data["RecoveryPath"] = d.cfg.Recovery.Path
+	}
+	if err := totpTemplate.Execute(w, data); err != nil {
+		slog.Warn("Error rendering TOTP page", "error", err)
+	}
+}
+
+func (d *daemon) recoveryPage(w http.ResponseWriter, r *http.Request) {
+	data := map[string]any{
+		"CSRF":      d.mw.CSRFField(w, r),
+		"CodeField": d.cfg.Recovery.CodeField,
+	}
+	if err := recoveryTemplate.Execute(w, data); err != nil {
+		slog.Warn("Error rendering recovery page", "error", err)
+	}
+}
+
+func (d *daemon) enrollPage(w http.ResponseWriter, r *http.Request) {
+	secret, uri, err := d.mw.BeginTOTPEnrollment(w, authware.MustUser(r.Context()))
+	if err != nil {
+		slog.Error("Error starting TOTP enrollment", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, "Internal Server Error")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	data := map[string]any{
+		"CSRF":      d.mw.CSRFField(w, r),
+		"CodeField": d.cfg.TOTP.CodeField,
+		"Secret":    secret,
+		"URI":       template.URL(uri),
+	}
+	if _, err := d.mw.PendingUser(r); err == nil {
+		data["Continue"] = d.cfg.TOTP.Path
+	}
+	if err := enrollTemplate.Execute(w, data); err != nil {
+		slog.Warn("Error rendering enrollment page", "error", err)
+	}
+}
+
+func (d *daemon) landing(w http.ResponseWriter, r *http.Request) {
+	user := authware.MustUser(r.Context())
+	fmt.Fprintf(w, "You are logged in as '%s' by '%s'\n", user.Identity, user.AuthedBy)
+}
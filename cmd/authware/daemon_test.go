@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"html"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/the-maldridge/authware/config"
+)
+
+// newTestDaemon returns the routes of a daemon that knows alice by
+// password, with the config adjusted by setup before it is validated.
+func newTestDaemon(t *testing.T, setup func(*config.Config)) http.Handler {
+	t.Helper()
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte("secret"))
+	passwd := filepath.Join(dir, "htpasswd")
+	group := filepath.Join(dir, "htgroup")
+	if err := os.WriteFile(passwd, []byte("alice:{SHA}"+base64.StdEncoding.EncodeToString(sum[:])+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(group, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Mechanisms: []string{"htpasswd"},
+		Backends: map[string]map[string]any{
+			"htpasswd": {"passwd_file": passwd, "group_file": group},
+		},
+	}
+	if setup != nil {
+		setup(cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	mw, err := cfg.Middleware()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDaemon(cfg, mw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.routes()
+}
+
+// expectLanding checks that the request reached the landing page as
+// the given user.
+func expectLanding(t *testing.T, h http.Handler, r *http.Request, identity, backend string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	want := "logged in as '" + identity + "' by '" + backend + "'"
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+		t.Errorf("expected %q, got %d %q", want, w.Code, w.Body.String())
+	}
+}
+
+// expectLogin checks that the request was sent to the login page.
+func expectLogin(t *testing.T, h http.Handler, r *http.Request) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), "/login?") {
+		t.Errorf("expected a redirect to the login page, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestAuthenticateAnonymous(t *testing.T) {
+	h := newTestDaemon(t, nil)
+	expectLogin(t, h, httptest.NewRequest(http.MethodGet, "/private", nil))
+}
+
+func TestAuthenticateBasic(t *testing.T) {
+	h := newTestDaemon(t, nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/private", nil)
+	r.SetBasicAuth("alice", "secret")
+	expectLanding(t, h, r, "alice", "htpasswd")
+
+	r = httptest.NewRequest(http.MethodGet, "/private", nil)
+	r.SetBasicAuth("alice", "wrong")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a bad password, got %d", w.Code)
+	}
+}
+
+func TestAuthenticateProxyHeaders(t *testing.T) {
+	h := newTestDaemon(t, func(c *config.Config) {
+		c.Header.TrustedProxies = []string{"192.0.2.1"}
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/private", nil)
+	r.RemoteAddr = "192.0.2.1:4321"
+	r.Header.Set("X-Remote-User", "bob")
+	expectLanding(t, h, r, "bob", "proxy")
+
+	r = httptest.NewRequest(http.MethodGet, "/private", nil)
+	r.RemoteAddr = "198.51.100.7:4321"
+	r.Header.Set("X-Remote-User", "bob")
+	expectLogin(t, h, r)
+}
+
+// newClientCert returns a self-signed client certificate for the
+// common name.
+func newClientCert(t *testing.T, cn string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestAuthenticateClientCert(t *testing.T) {
+	cert := newClientCert(t, "carol")
+	h := newTestDaemon(t, func(c *config.Config) {
+		c.ClientCert.Identity = "cn"
+		c.ClientCert.Header = "X-Client-Cert"
+		c.ClientCert.TrustedProxies = []string{"192.0.2.1"}
+	})
+
+	t.Run("direct", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/private", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		expectLanding(t, h, r, "carol", "x509")
+	})
+
+	t.Run("forwarded", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/private", nil)
+		r.RemoteAddr = "192.0.2.1:4321"
+		r.Header.Set("X-Client-Cert", base64.StdEncoding.EncodeToString(cert.Raw))
+		expectLanding(t, h, r, "carol", "x509")
+	})
+
+	t.Run("forwarded by an untrusted address", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/private", nil)
+		r.RemoteAddr = "198.51.100.7:4321"
+		r.Header.Set("X-Client-Cert", base64.StdEncoding.EncodeToString(cert.Raw))
+		expectLogin(t, h, r)
+	})
+}
+
+func TestAuthenticateClientCertUnconfigured(t *testing.T) {
+	h := newTestDaemon(t, nil)
+
+	// A certificate that the server verified but that client_cert
+	// does not accept must not keep the browser from logging in.
+	r := httptest.NewRequest(http.MethodGet, "/private", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{newClientCert(t, "carol")}}}
+	expectLogin(t, h, r)
+}
+
+func TestProxyStripsCredentials(t *testing.T) {
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	t.Cleanup(upstream.Close)
+
+	h := newTestDaemon(t, func(c *config.Config) {
+		c.Server.Upstream = upstream.URL
+	})
+	r := httptest.NewRequest(http.MethodGet, "/private", nil)
+	r.SetBasicAuth("alice", "secret")
+	r.Header.Set("X-Auth-User", "mallory")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "s"})
+	r.AddCookie(&http.Cookie{Name: "session_csrf", Value: "c"})
+	r.AddCookie(&http.Cookie{Name: "session_mfa", Value: "f"})
+	r.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("proxy returned %d", w.Code)
+	}
+
+	if v := got.Get("Authorization"); v != "" {
+		t.Errorf("Authorization reached the upstream: %q", v)
+	}
+	if v := got.Get("Cookie"); v != "theme=dark" {
+		t.Errorf("upstream received cookies %q", v)
+	}
+	if v := got.Get("X-Auth-User"); v != "alice" {
+		t.Errorf("upstream received X-Auth-User %q", v)
+	}
+}
+
+var csrfInput = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// formToken returns the CSRF token from the form served at target,
+// keeping any cookies that came with it.
+func formToken(t *testing.T, h http.Handler, jar map[string]*http.Cookie, target string) string {
+	t.Helper()
+	w := do(h, jar, http.MethodGet, target, nil)
+	m := csrfInput.FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatalf("%s returned %d with no CSRF token", target, w.Code)
+	}
+	return html.UnescapeString(m[1])
+}
+
+// do serves a request with the cookies in jar, and updates jar from
+// the response.
+func do(h http.Handler, jar map[string]*http.Cookie, method, target string, form url.Values) *httptest.ResponseRecorder {
+	var r *http.Request
+	if form != nil {
+		r = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r = httptest.NewRequest(method, target, nil)
+	}
+	for _, c := range jar {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(jar, c.Name)
+		} else {
+			jar[c.Name] = c
+		}
+	}
+	return w
+}
+
+func TestLogout(t *testing.T) {
+	h := newTestDaemon(t, nil)
+	jar := make(map[string]*http.Cookie)
+	token := formToken(t, h, jar, "/login")
+	form := url.Values{"username": {"alice"}, "password": {"secret"}, "csrf_token": {token}}
+	if w := do(h, jar, http.MethodPost, "/login", form); w.Code != http.StatusSeeOther {
+		t.Fatalf("login returned %d", w.Code)
+	}
+	loggedIn := func() bool {
+		return do(h, jar, http.MethodGet, "/private", nil).Code == http.StatusOK
+	}
+	if !loggedIn() {
+		t.Fatal("login did not issue a session")
+	}
+
+	// A cross-site GET or a POST without the token does not log
+	// the user out.
+	token = formToken(t, h, jar, "/logout")
+	if w := do(h, jar, http.MethodPost, "/logout", url.Values{}); w.Code != http.StatusForbidden {
+		t.Errorf("logout without a CSRF token returned %d", w.Code)
+	}
+	if !loggedIn() {
+		t.Fatal("session ended without a CSRF token")
+	}
+
+	w := do(h, jar, http.MethodPost, "/logout", url.Values{"csrf_token": {token}})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+		t.Errorf("logout returned %d %q", w.Code, w.Header().Get("Location"))
+	}
+	if loggedIn() {
+		t.Error("session survived logging out")
+	}
+}
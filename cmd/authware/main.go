@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/the-maldridge/authware"
+	"github.com/the-maldridge/authware/config"
+
+	_ "github.com/the-maldridge/authware/backend/htpasswd"
+	_ "github.com/the-maldridge/authware/backend/ldap"
+	_ "github.com/the-maldridge/authware/backend/netauth"
+	_ "github.com/the-maldridge/authware/backend/pam"
+	_ "github.com/the-maldridge/authware/backend/token"
+)
+
+func main() {
+	configFile := flag.String("config", "", "Config file to load, defaults to $AUTHWARE_CONFIG_FILE")
+	logLevel := flag.String("log-level", "info", "One of debug, info, warn, or error")
+	flag.Parse()
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		slog.Error("Invalid log level", "level", *logLevel)
+		os.Exit(1)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		slog.Error("Could not load config", "error", err)
+		os.Exit(1)
+	}
+
+	mw, err := cfg.Middleware()
+	if err != nil {
+		slog.Error("Could not initialize middleware", "error", err)
+		os.Exit(1)
+	}
+
+	d, err := newDaemon(cfg, mw)
+	if err != nil {
+		slog.Error("Could not initialize server", "error", err)
+		os.Exit(1)
+	}
+
+	s := &http.Server{
+		Addr:              cfg.Server.Listen,
+		Handler:           d.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if cfg.Server.ClientCAFile != "" {
+		pool, err := authware.LoadCertPool(cfg.Server.ClientCAFile)
+		if err != nil {
+			slog.Error("Could not load client CA file", "error", err)
+			os.Exit(1)
+		}
+		s.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		}
+	}
+
+	go func() {
+		var err error
+		if cfg.Server.TLSCertFile != "" {
+			err = s.ListenAndServeTLS(cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile)
+		} else {
+			err = s.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error serving", "error", err)
+			os.Exit(2)
+		}
+	}()
+	slog.Info("Serving", "address", cfg.Server.Listen)
+
+	// Backends and keyrings that read files reload themselves on
+	// SIGHUP, so only the parts owned by the daemon need to be
+	// handled here.
+	rChan := make(chan os.Signal, 1)
+	signal.Notify(rChan, syscall.SIGHUP)
+
+	go func() {
+		for {
+			<-rChan
+			if err := d.reload(); err != nil {
+				slog.Warn("Error reloading login template, keeping previous template", "error", err)
+				continue
+			}
+			slog.Info("Reloaded login template")
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	slog.Info("Shutting down...")
+
+	timeout, _ := time.ParseDuration(cfg.Server.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		slog.Error("Error during shutdown", "error", err)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,677 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/spf13/viper"
+
+	"github.com/the-maldridge/authware"
+	"github.com/the-maldridge/authware/store/bolt"
+	"github.com/the-maldridge/authware/store/memory"
+	"github.com/the-maldridge/authware/store/redis"
+)
+
+// Config describes the entire middleware stack.  It is usually
+// obtained by calling Load on a file.
+type Config struct {
+	// Mechanisms is the ordered list of backends that will be
+	// tried when authenticating a user.
+	Mechanisms []string `mapstructure:"mechanisms"`
+
+	// BearerMechanisms is the ordered list of backends that will
+	// be tried when authenticating a bearer token.  Backends
+	// listed here must support tokens.
+	BearerMechanisms []string `mapstructure:"bearer_mechanisms"`
+
+	// Backends holds the settings for each backend, keyed by
+	// mechanism name.  The contents of each entry are decoded
+	// into the backend's own config structure.
+	Backends map[string]map[string]any `mapstructure:"backends"`
+
+	Session    Session    `mapstructure:"session"`
+	Cookie     Cookie     `mapstructure:"cookie"`
+	Login      Login      `mapstructure:"login"`
+	RateLimit  RateLimit  `mapstructure:"ratelimit"`
+	Cache      Cache      `mapstructure:"cache"`
+	Header     Header     `mapstructure:"header"`
+	ClientCert ClientCert `mapstructure:"client_cert"`
+	TOTP       TOTP       `mapstructure:"totp"`
+	Recovery   Recovery   `mapstructure:"recovery"`
+	MFA        MFA        `mapstructure:"mfa"`
+	Server     Server     `mapstructure:"server"`
+}
+
+// Header enables trusting the identity asserted by an authenticating
+// proxy.  It is disabled unless TrustedProxies is set.
+type Header struct {
+	// TrustedProxies lists the CIDR prefixes or addresses that
+	// proxies connect from.
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+
+	UserHeader     string `mapstructure:"user_header"`
+	GroupsHeader   string `mapstructure:"groups_header"`
+	GroupSeparator string `mapstructure:"group_separator"`
+	Name           string `mapstructure:"name"`
+}
+
+// ClientCert enables authentication by X.509 client certificate.  It
+// is disabled unless Identity is set.
+type ClientCert struct {
+	// Identity is one of "cn", "email", or "uri".
+	Identity  string `mapstructure:"identity"`
+	URIPrefix string `mapstructure:"uri_prefix"`
+	Name      string `mapstructure:"name"`
+
+	// Header, TrustedProxies, and CAFile accept certificates
+	// forwarded by a TLS terminating proxy.
+	Header         string   `mapstructure:"header"`
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	CAFile         string   `mapstructure:"ca_file"`
+}
+
+// TOTP enables one time codes as a second factor on the login form.
+// Secrets are kept in the session store, which must be bolt or redis.
+type TOTP struct {
+	Enabled bool `mapstructure:"enabled"`
+
+	// Issuer is shown in authenticator apps.
+	Issuer string `mapstructure:"issuer"`
+
+	// Path is where the code form is served.  It defaults to
+	// "/login/totp".
+	Path string `mapstructure:"path"`
+
+	// EnrollPath is where logged in users enroll.  It defaults
+	// to "/login/totp/enroll".
+	EnrollPath string `mapstructure:"enroll_path"`
+
+	// CodeField is the form field that carries the code.  It
+	// defaults to "code".
+	CodeField string `mapstructure:"code_field"`
+
+	Skew     int    `mapstructure:"skew"`
+	Lifetime string `mapstructure:"lifetime"`
+}
+
+// Recovery enables single use recovery codes, which users may enter
+// in place of their second factor.  Codes are kept in the session
+// store, which must be bolt or redis.
+type Recovery struct {
+	Enabled bool `mapstructure:"enabled"`
+
+	// Path is where the recovery code form is served.  It
+	// defaults to "/login/recovery".
+	Path string `mapstructure:"path"`
+
+	// ManagePath is where logged in users view and regenerate
+	// their codes.  It defaults to "/login/recovery/codes".
+	ManagePath string `mapstructure:"manage_path"`
+
+	// CodeField is the form field that carries the code.  It
+	// defaults to "code".
+	CodeField string `mapstructure:"code_field"`
+
+	// Count is the number of codes issued at a time.
+	Count int `mapstructure:"count"`
+}
+
+// MFA decides which users must use a second factor.  Users in Groups
+// that have not enrolled are sent to enroll in TOTP if it is enabled,
+// and are refused otherwise.
+type MFA struct {
+	// Groups lists the groups that must use a second factor.
+	// The group "*" includes every user.
+	Groups []string `mapstructure:"groups"`
+
+	// ExemptGroups lists groups that never need to, even if they
+	// are also in Groups.
+	ExemptGroups []string `mapstructure:"exempt_groups"`
+}
+
+// Server contains the settings for the standalone daemon in
+// cmd/authware.  Like Login, these are not consumed by the middleware
+// directly.
+type Server struct {
+	// Listen is the address to serve on.  It defaults to ":8080".
+	Listen string `mapstructure:"listen"`
+
+	// TLSCertFile and TLSKeyFile enable HTTPS when both are set.
+	TLSCertFile string `mapstructure:"tls_cert_file"`
+	TLSKeyFile  string `mapstructure:"tls_key_file"`
+
+	// ClientCAFile requests client certificates signed by these
+	// CAs when serving HTTPS, for use with ClientCert.
+	ClientCAFile string `mapstructure:"client_ca_file"`
+
+	// ForwardAuthPath is where the forward auth endpoint is
+	// served.  It defaults to "/auth".
+	ForwardAuthPath string `mapstructure:"forward_auth_path"`
+
+	// ForwardAuthLogin is the absolute URL of the login page that
+	// the forward auth endpoint redirects unauthenticated clients
+	// to.  If it is empty, a 401 is returned instead.
+	ForwardAuthLogin string `mapstructure:"forward_auth_login"`
+
+	// HealthPath is where the health check is served.  It
+	// defaults to "/healthz".
+	HealthPath string `mapstructure:"health_path"`
+
+	// Upstream is a URL that authenticated requests are proxied
+	// to.  If it is empty, nothing is proxied.
+	Upstream string `mapstructure:"upstream"`
+
+	// LoginTemplate is an html/template file that replaces the
+	// built in login page.
+	LoginTemplate string `mapstructure:"login_template"`
+
+	// ShutdownTimeout is how long in flight requests are given to
+	// finish when shutting down.  It defaults to "10s".
+	ShutdownTimeout string `mapstructure:"shutdown_timeout"`
+}
+
+// Cache enables caching of backend results.  Caching is disabled
+// unless TTL is set.
+type Cache struct {
+	TTL         string `mapstructure:"ttl"`
+	GroupTTL    string `mapstructure:"group_ttl"`
+	NegativeTTL string `mapstructure:"negative_ttl"`
+}
+
+// RateLimit controls how repeated authentication failures are slowed
+// down.  Unset values take the defaults from authware.
+type RateLimit struct {
+	// Shared keeps the counters in the session store so that they
+	// are shared between processes.  It requires the redis store.
+	Shared bool `mapstructure:"shared"`
+
+	Disabled          bool   `mapstructure:"disabled"`
+	IdentityThreshold int    `mapstructure:"identity_threshold"`
+	IPThreshold       int    `mapstructure:"ip_threshold"`
+	BaseDelay         string `mapstructure:"base_delay"`
+	MaxDelay          string `mapstructure:"max_delay"`
+	Window            string `mapstructure:"window"`
+}
+
+// Cookie contains the attributes of the session cookie.
+type Cookie struct {
+	Name        string `mapstructure:"name"`
+	Domain      string `mapstructure:"domain"`
+	Path        string `mapstructure:"path"`
+	Secure      bool   `mapstructure:"secure"`
+	SameSite    string `mapstructure:"same_site"`
+	Partitioned bool   `mapstructure:"partitioned"`
+}
+
+// Session contains the settings that control issued sessions.
+type Session struct {
+	// Lifetime is a duration string such as "8h".
+	Lifetime string `mapstructure:"lifetime"`
+
+	// IdleTimeout enables sliding sessions that expire after
+	// going unused for this long, but never outlive Lifetime.
+	IdleTimeout string `mapstructure:"idle_timeout"`
+
+	// RefreshThreshold is how close to expiry a sliding session
+	// must be before its cookie is re-issued.
+	RefreshThreshold string `mapstructure:"refresh_threshold"`
+
+	// Key is used to encrypt session cookies.
+	Key string `mapstructure:"key"`
+
+	// KeyFile names a file of session keys, one per line, with
+	// the active key first.  It takes precedence over Key.
+	KeyFile string `mapstructure:"key_file"`
+
+	Store Store `mapstructure:"store"`
+}
+
+// Store selects where sessions are kept.  If Type is empty, sessions
+// are kept entirely within the cookie.
+type Store struct {
+	// Type is one of memory, bolt, or redis.
+	Type string `mapstructure:"type"`
+
+	// Path is the database file used by the bolt store.
+	Path string `mapstructure:"path"`
+
+	Redis redis.Config `mapstructure:"redis"`
+}
+
+// Login contains the paths and form fields used by the login flow.
+// These are not consumed by the middleware directly, but are passed
+// to the login handlers by whatever is setting up the routes.
+type Login struct {
+	Path        string `mapstructure:"path"`
+	LogoutPath  string `mapstructure:"logout_path"`
+	UserField   string `mapstructure:"user_field"`
+	PassField   string `mapstructure:"pass_field"`
+	DefaultNext string `mapstructure:"default_next"`
+
+	// AllowedRedirectHosts lists external hosts that may be
+	// redirected to after login.  Local paths are always allowed.
+	AllowedRedirectHosts []string `mapstructure:"allowed_redirect_hosts"`
+
+	// DisableCSRF turns off the CSRF check on the login form.
+	DisableCSRF bool `mapstructure:"disable_csrf"`
+}
+
+// Load reads and validates the named file, which may be in any
+// format understood by viper.  If file is empty, the value of
+// AUTHWARE_CONFIG_FILE is used instead.
+func Load(file string) (*Config, error) {
+	if file == "" {
+		file = os.Getenv("AUTHWARE_CONFIG_FILE")
+	}
+	if file == "" {
+		slog.Error("Missing required config value", "key", "AUTHWARE_CONFIG_FILE")
+		return nil, ErrInvalid{Key: "AUTHWARE_CONFIG_FILE", Reason: "must specify a config file"}
+	}
+
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	c := new(Config)
+	if err := v.UnmarshalExact(c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks the config for values that cannot be used and
+// fills in defaults for values that were left unset.
+func (c *Config) Validate() error {
+	if len(c.Mechanisms) == 0 {
+		return ErrInvalid{Key: "mechanisms", Reason: "at least one mechanism must be listed"}
+	}
+	seen := make(map[string]struct{})
+	for i, m := range c.Mechanisms {
+		if _, dup := seen[m]; dup {
+			return ErrInvalid{Key: fmt.Sprintf("mechanisms[%d]", i), Reason: fmt.Sprintf("%q is listed more than once", m)}
+		}
+		seen[m] = struct{}{}
+	}
+	bearer := make(map[string]struct{})
+	for i, m := range c.BearerMechanisms {
+		if _, dup := bearer[m]; dup {
+			return ErrInvalid{Key: fmt.Sprintf("bearer_mechanisms[%d]", i), Reason: fmt.Sprintf("%q is listed more than once", m)}
+		}
+		bearer[m] = struct{}{}
+	}
+	for name := range c.Backends {
+		_, basic := seen[name]
+		_, token := bearer[name]
+		if !basic && !token {
+			return ErrInvalid{Key: "backends." + name, Reason: "backend is configured but not listed in mechanisms"}
+		}
+	}
+
+	if c.Session.Lifetime == "" {
+		c.Session.Lifetime = "1h"
+	}
+	if d, err := time.ParseDuration(c.Session.Lifetime); err != nil || d <= 0 {
+		return ErrInvalid{Key: "session.lifetime", Reason: fmt.Sprintf("%q is not a positive duration", c.Session.Lifetime)}
+	}
+	if err := optionalDuration("session.idle_timeout", c.Session.IdleTimeout); err != nil {
+		return err
+	}
+	if err := optionalDuration("session.refresh_threshold", c.Session.RefreshThreshold); err != nil {
+		return err
+	}
+
+	switch c.Session.Store.Type {
+	case "", "memory", "redis":
+	case "bolt":
+		if c.Session.Store.Path == "" {
+			return ErrInvalid{Key: "session.store.path", Reason: "must be set for the bolt store"}
+		}
+	default:
+		return ErrInvalid{Key: "session.store.type", Reason: fmt.Sprintf("%q is not one of memory, bolt, or redis", c.Session.Store.Type)}
+	}
+
+	if c.Cookie.SameSite != "" {
+		if _, err := authware.ParseSameSite(c.Cookie.SameSite); err != nil {
+			return ErrInvalid{Key: "cookie.same_site", Reason: err.Error()}
+		}
+	}
+	if strings.EqualFold(c.Cookie.SameSite, "none") && !c.Cookie.Secure {
+		return ErrInvalid{Key: "cookie.secure", Reason: "must be set when same_site is none"}
+	}
+	if c.Cookie.Partitioned && !c.Cookie.Secure {
+		return ErrInvalid{Key: "cookie.secure", Reason: "must be set when partitioned is set"}
+	}
+
+	if c.RateLimit.Shared && c.Session.Store.Type != "redis" {
+		return ErrInvalid{Key: "ratelimit.shared", Reason: "requires the redis session store"}
+	}
+	if err := optionalDuration("ratelimit.base_delay", c.RateLimit.BaseDelay); err != nil {
+		return err
+	}
+	if err := optionalDuration("ratelimit.max_delay", c.RateLimit.MaxDelay); err != nil {
+		return err
+	}
+	if err := optionalDuration("ratelimit.window", c.RateLimit.Window); err != nil {
+		return err
+	}
+
+	if err := optionalDuration("cache.ttl", c.Cache.TTL); err != nil {
+		return err
+	}
+	if err := optionalDuration("cache.group_ttl", c.Cache.GroupTTL); err != nil {
+		return err
+	}
+	if err := optionalDuration("cache.negative_ttl", c.Cache.NegativeTTL); err != nil {
+		return err
+	}
+
+	if _, err := authware.ParseTrustedProxies(c.Header.TrustedProxies...); err != nil {
+		return ErrInvalid{Key: "header.trusted_proxies", Reason: err.Error()}
+	}
+
+	switch c.ClientCert.Identity {
+	case "", authware.CertIdentityCN, authware.CertIdentityEmail, authware.CertIdentityURI:
+	default:
+		return ErrInvalid{Key: "client_cert.identity", Reason: fmt.Sprintf("%q is not one of cn, email, or uri", c.ClientCert.Identity)}
+	}
+	if _, err := authware.ParseTrustedProxies(c.ClientCert.TrustedProxies...); err != nil {
+		return ErrInvalid{Key: "client_cert.trusted_proxies", Reason: err.Error()}
+	}
+
+	if c.Login.Path == "" {
+		c.Login.Path = "/login"
+	}
+	if c.Login.LogoutPath == "" {
+		c.Login.LogoutPath = "/logout"
+	}
+	if c.Login.UserField == "" {
+		c.Login.UserField = "username"
+	}
+	if c.Login.PassField == "" {
+		c.Login.PassField = "password"
+	}
+	if c.Login.DefaultNext == "" {
+		c.Login.DefaultNext = "/"
+	}
+
+	if c.TOTP.Enabled {
+		if c.Session.Store.Type != "bolt" && c.Session.Store.Type != "redis" {
+			return ErrInvalid{Key: "totp.enabled", Reason: "requires the bolt or redis session store"}
+		}
+		if err := optionalDuration("totp.lifetime", c.TOTP.Lifetime); err != nil {
+			return err
+		}
+		if c.TOTP.Path == "" {
+			c.TOTP.Path = "/login/totp"
+		}
+		if c.TOTP.EnrollPath == "" {
+			c.TOTP.EnrollPath = "/login/totp/enroll"
+		}
+		if c.TOTP.CodeField == "" {
+			c.TOTP.CodeField = "code"
+		}
+	}
+
+	if c.Recovery.Enabled {
+		if c.Session.Store.Type != "bolt" && c.Session.Store.Type != "redis" {
+			return ErrInvalid{Key: "recovery.enabled", Reason: "requires the bolt or redis session store"}
+		}
+		if c.Recovery.Path == "" {
+			c.Recovery.Path = "/login/recovery"
+		}
+		if c.Recovery.ManagePath == "" {
+			c.Recovery.ManagePath = "/login/recovery/codes"
+		}
+		if c.Recovery.CodeField == "" {
+			c.Recovery.CodeField = "code"
+		}
+	}
+
+	if c.Server.Listen == "" {
+		c.Server.Listen = ":8080"
+	}
+	if (c.Server.TLSCertFile == "") != (c.Server.TLSKeyFile == "") {
+		return ErrInvalid{Key: "server.tls_key_file", Reason: "tls_cert_file and tls_key_file must be set together"}
+	}
+	if c.Server.ForwardAuthPath == "" {
+		c.Server.ForwardAuthPath = "/auth"
+	}
+	if c.Server.HealthPath == "" {
+		c.Server.HealthPath = "/healthz"
+	}
+	if c.Server.Upstream != "" {
+		u, err := url.Parse(c.Server.Upstream)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return ErrInvalid{Key: "server.upstream", Reason: fmt.Sprintf("%q is not an absolute http or https URL", c.Server.Upstream)}
+		}
+	}
+	if c.Server.ShutdownTimeout == "" {
+		c.Server.ShutdownTimeout = "10s"
+	}
+	if err := optionalDuration("server.shutdown_timeout", c.Server.ShutdownTimeout); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Options converts the config into options for authware.NewAuth,
+// initializing each of the configured backends along the way.
+func (c *Config) Options() ([]authware.Option, error) {
+	// Backends listed in both chains are only initialized once.
+	initialized := make(map[string]authware.Authenticator)
+	initialize := func(list string, i int, mech string) (authware.Authenticator, error) {
+		if a, ok := initialized[mech]; ok {
+			return a, nil
+		}
+		a, err := authware.InitializeWithConfig(mech, c.decoderFor(mech))
+		if err != nil {
+			key := "backends." + mech
+			if _, ok := err.(*authware.ErrDoesNotExist); ok {
+				key = fmt.Sprintf("%s[%d]", list, i)
+			}
+			return nil, ErrInvalid{Key: key, Reason: err.Error()}
+		}
+		initialized[mech] = a
+		return a, nil
+	}
+
+	var chain []authware.Authenticator
+	for i, mech := range c.Mechanisms {
+		a, err := initialize("mechanisms", i, mech)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, a)
+	}
+
+	var tokens []authware.TokenAuthenticator
+	for i, mech := range c.BearerMechanisms {
+		a, err := initialize("bearer_mechanisms", i, mech)
+		if err != nil {
+			return nil, err
+		}
+		t, ok := a.(authware.TokenAuthenticator)
+		if !ok {
+			return nil, ErrInvalid{Key: fmt.Sprintf("bearer_mechanisms[%d]", i), Reason: fmt.Sprintf("%q does not support tokens", mech)}
+		}
+		tokens = append(tokens, t)
+	}
+
+	lifetime, _ := time.ParseDuration(c.Session.Lifetime)
+	opts := []authware.Option{
+		authware.WithAuthenticators(chain...),
+		authware.WithTokenAuthenticators(tokens...),
+		authware.WithSessionLifetime(lifetime),
+	}
+	if c.Session.IdleTimeout != "" {
+		d, _ := time.ParseDuration(c.Session.IdleTimeout)
+		opts = append(opts, authware.WithIdleTimeout(d))
+	}
+	if c.Session.RefreshThreshold != "" {
+		d, _ := time.ParseDuration(c.Session.RefreshThreshold)
+		opts = append(opts, authware.WithRefreshThreshold(d))
+	}
+
+	switch {
+	case c.Session.KeyFile != "":
+		k, err := authware.LoadKeyring(c.Session.KeyFile)
+		if err != nil {
+			return nil, ErrInvalid{Key: "session.key_file", Reason: err.Error()}
+		}
+		opts = append(opts, authware.WithKeyring(k))
+	case c.Session.Key != "":
+		opts = append(opts, authware.WithSessionKey([]byte(c.Session.Key)))
+	}
+
+	limits := authware.RateLimitOptions{
+		Disabled:          c.RateLimit.Disabled,
+		IdentityThreshold: c.RateLimit.IdentityThreshold,
+		IPThreshold:       c.RateLimit.IPThreshold,
+	}
+	limits.BaseDelay, _ = time.ParseDuration(c.RateLimit.BaseDelay)
+	limits.MaxDelay, _ = time.ParseDuration(c.RateLimit.MaxDelay)
+	limits.Window, _ = time.ParseDuration(c.RateLimit.Window)
+
+	totp := authware.TOTPOptions{
+		Issuer: c.TOTP.Issuer,
+		Path:   c.TOTP.Path,
+		Skew:   c.TOTP.Skew,
+	}
+	totp.Lifetime, _ = time.ParseDuration(c.TOTP.Lifetime)
+	recovery := authware.RecoveryOptions{Count: c.Recovery.Count}
+
+	switch c.Session.Store.Type {
+	case "memory":
+		opts = append(opts, authware.WithSessionStore(memory.New()))
+	case "bolt":
+		s, err := bolt.New(c.Session.Store.Path)
+		if err != nil {
+			return nil, ErrInvalid{Key: "session.store.path", Reason: err.Error()}
+		}
+		opts = append(opts, authware.WithSessionStore(s))
+		totp.Store = s.TOTP()
+		recovery.Store = s.RecoveryCodes()
+	case "redis":
+		s, err := redis.New(c.Session.Store.Redis)
+		if err != nil {
+			return nil, ErrInvalid{Key: "session.store.redis", Reason: err.Error()}
+		}
+		opts = append(opts, authware.WithSessionStore(s))
+		if c.RateLimit.Shared {
+			limits.Store = s.Counters()
+		}
+		totp.Store = s.TOTP()
+		recovery.Store = s.RecoveryCodes()
+	}
+	if c.TOTP.Enabled {
+		opts = append(opts, authware.WithTOTP(totp))
+	}
+	if c.Recovery.Enabled {
+		opts = append(opts, authware.WithRecoveryCodes(recovery))
+	}
+
+	mfa := authware.MFAPolicy{Groups: c.MFA.Groups, Exempt: c.MFA.ExemptGroups}
+	if c.TOTP.Enabled {
+		mfa.EnrollPath = c.TOTP.EnrollPath
+	}
+	opts = append(opts, authware.WithMFAPolicy(mfa))
+
+	cookie := authware.CookieOptions{
+		Name:        c.Cookie.Name,
+		Domain:      c.Cookie.Domain,
+		Path:        c.Cookie.Path,
+		Secure:      c.Cookie.Secure,
+		Partitioned: c.Cookie.Partitioned,
+	}
+	if c.Cookie.SameSite != "" {
+		cookie.SameSite, _ = authware.ParseSameSite(c.Cookie.SameSite)
+	}
+	opts = append(opts, authware.WithCookieOptions(cookie))
+	opts = append(opts, authware.WithRedirectOptions(authware.RedirectOptions{AllowedHosts: c.Login.AllowedRedirectHosts}))
+	opts = append(opts, authware.WithLoginCSRF(!c.Login.DisableCSRF))
+	opts = append(opts, authware.WithRateLimit(limits))
+
+	if c.Cache.TTL != "" {
+		var cache authware.CacheOptions
+		cache.TTL, _ = time.ParseDuration(c.Cache.TTL)
+		cache.GroupTTL, _ = time.ParseDuration(c.Cache.GroupTTL)
+		cache.NegativeTTL, _ = time.ParseDuration(c.Cache.NegativeTTL)
+		opts = append(opts, authware.WithCache(cache))
+	}
+
+	if len(c.Header.TrustedProxies) > 0 {
+		proxies, _ := authware.ParseTrustedProxies(c.Header.TrustedProxies...)
+		opts = append(opts, authware.WithHeaderAuth(authware.HeaderOptions{
+			TrustedProxies: proxies,
+			UserHeader:     c.Header.UserHeader,
+			GroupsHeader:   c.Header.GroupsHeader,
+			GroupSeparator: c.Header.GroupSeparator,
+			Name:           c.Header.Name,
+		}))
+	}
+
+	if c.ClientCert.Identity != "" {
+		proxies, _ := authware.ParseTrustedProxies(c.ClientCert.TrustedProxies...)
+		cc := authware.ClientCertOptions{
+			Identity:         c.ClientCert.Identity,
+			URIPrefix:        c.ClientCert.URIPrefix,
+			Name:             c.ClientCert.Name,
+			ForwardedHeader:  c.ClientCert.Header,
+			ForwardedProxies: proxies,
+		}
+		if c.ClientCert.CAFile != "" {
+			pool, err := authware.LoadCertPool(c.ClientCert.CAFile)
+			if err != nil {
+				return nil, ErrInvalid{Key: "client_cert.ca_file", Reason: err.Error()}
+			}
+			cc.ForwardedRoots = pool
+		}
+		opts = append(opts, authware.WithClientCertAuth(cc))
+	}
+	return opts, nil
+}
+
+// Middleware returns a ready to use middleware built from the
+// config.
+func (c *Config) Middleware() (*authware.BasicMiddleware, error) {
+	opts, err := c.Options()
+	if err != nil {
+		return nil, err
+	}
+	return authware.NewAuth(opts...)
+}
+
+func (c *Config) decoderFor(mech string) func(any) error {
+	return func(out any) error {
+		d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			ErrorUnused:      true,
+			WeaklyTypedInput: true,
+			DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+			Result:           out,
+		})
+		if err != nil {
+			return err
+		}
+		return d.Decode(c.Backends[mech])
+	}
+}
+
+func optionalDuration(key, value string) error {
+	if value == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+		return ErrInvalid{Key: key, Reason: fmt.Sprintf("%q is not a positive duration", value)}
+	}
+	return nil
+}
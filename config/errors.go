@@ -0,0 +1,15 @@
+package config
+
+import (
+	"fmt"
+)
+
+// ErrInvalid is returned when a config value cannot be used.  Key
+// names the offending value using the same dotted path that appears
+// in the config file.
+type ErrInvalid struct {
+	Key    string
+	Reason string
+}
+
+func (e ErrInvalid) Error() string { return fmt.Sprintf("%s: %s", e.Key, e.Reason) }
@@ -0,0 +1,79 @@
+package authware
+
+import (
+	"context"
+)
+
+// WithUser returns a copy of the context that carries the given
+// user.  This is what the authenticating handlers use internally, and
+// it is exposed so that tests and custom handlers can construct
+// requests that look authenticated.
+func WithUser(ctx context.Context, u User) context.Context {
+	return context.WithValue(ctx, UserKey{}, u)
+}
+
+// UserFromContext retrieves the user that was placed into the
+// context by one of the authenticating handlers.  If no user is
+// present, the returned bool will be false.
+func UserFromContext(ctx context.Context) (User, bool) {
+	u, ok := ctx.Value(UserKey{}).(User)
+	return u, ok
+}
+
+// sessionKey is the context key for the session that authenticated a
+// request.
+type sessionKey struct{}
+
+// withSession returns a copy of the context that carries both the
+// session and its user.
+func withSession(ctx context.Context, s Session) context.Context {
+	return WithUser(context.WithValue(ctx, sessionKey{}, s), s.User)
+}
+
+// SessionFromContext retrieves the session that LoginHandler or
+// SessionHandler found on the request, which records when and how the
+// user logged in.  Requests that were authenticated by other means
+// have no session, and the returned bool will be false.
+func SessionFromContext(ctx context.Context) (Session, bool) {
+	s, ok := ctx.Value(sessionKey{}).(Session)
+	return s, ok
+}
+
+// MustUser retrieves the user from the context, and panics if there
+// isn't one.  It should only be used in handlers that are guaranteed
+// to sit behind a middleware that rejects unauthenticated requests.
+func MustUser(ctx context.Context) User {
+	u, ok := UserFromContext(ctx)
+	if !ok {
+		panic("authware: no user in context")
+	}
+	return u
+}
+
+// HasGroup returns true if the user is a member of the named group.
+func (u User) HasGroup(group string) bool {
+	_, ok := u.Groups[group]
+	return ok
+}
+
+// InAnyGroup returns true if the user is a member of at least one of
+// the named groups.
+func (u User) InAnyGroup(groups ...string) bool {
+	for _, g := range groups {
+		if u.HasGroup(g) {
+			return true
+		}
+	}
+	return false
+}
+
+// InAllGroups returns true if the user is a member of every one of
+// the named groups.
+func (u User) InAllGroups(groups ...string) bool {
+	for _, g := range groups {
+		if !u.HasGroup(g) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package authware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CookieOptions controls the attributes of the session cookie.  The
+// same options are used when setting, reading, and clearing the
+// cookie so that all three always refer to the same cookie.
+type CookieOptions struct {
+	// Name of the cookie, which defaults to "session".  Set this
+	// to something unique if other applications on the same host
+	// also use a cookie named "session".
+	Name string
+
+	// Domain and Path scope the cookie.  Path defaults to "/".
+	Domain string
+	Path   string
+
+	// Secure restricts the cookie to HTTPS connections.  This
+	// should be set for any deployment that is served over TLS.
+	Secure bool
+
+	// SameSite defaults to http.SameSiteLaxMode.
+	SameSite http.SameSite
+
+	// Partitioned opts the cookie in to partitioned storage
+	// (CHIPS), which is required for cookies to be usable in
+	// some cross-site embedded contexts.  It requires Secure.
+	Partitioned bool
+}
+
+// ParseSameSite converts one of "lax", "strict", or "none" into the
+// corresponding http.SameSite mode.
+func ParseSameSite(s string) (http.SameSite, error) {
+	switch strings.ToLower(s) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("unknown SameSite mode %q", s)
+}
+
+func defaultCookieOptions() CookieOptions {
+	return CookieOptions{
+		Name:     "session",
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (c CookieOptions) validate() error {
+	if c.Name == "" {
+		return errors.New("cookie name must not be empty")
+	}
+	if c.SameSite == http.SameSiteNoneMode && !c.Secure {
+		return errors.New("cookies with SameSite=None must be Secure")
+	}
+	if c.Partitioned && !c.Secure {
+		return errors.New("partitioned cookies must be Secure")
+	}
+	return nil
+}
+
+// cookie returns a session cookie carrying the given value.
+func (c CookieOptions) cookie(value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:        c.Name,
+		Value:       value,
+		Domain:      c.Domain,
+		Path:        c.Path,
+		Expires:     expires,
+		Secure:      c.Secure,
+		HttpOnly:    true,
+		SameSite:    c.SameSite,
+		Partitioned: c.Partitioned,
+	}
+}
+
+// expired returns a cookie that instructs the client to discard the
+// session cookie.  The attributes must match the cookie that was set
+// or the client will treat it as a different cookie.
+func (c CookieOptions) expired() *http.Cookie {
+	ck := c.cookie("", time.Unix(0, 0))
+	ck.MaxAge = -1
+	return ck
+}
+
+// owns returns true if the named cookie is the session cookie or one
+// of the CSRF and flow state cookies named after it.
+func (c CookieOptions) owns(name string) bool {
+	return name == c.Name || strings.HasPrefix(name, c.Name+"_")
+}
+
+// StripCredentials removes the Authorization header and every cookie
+// set by the middleware from a request, so that it can be passed on
+// to a service that should not be able to reuse the user's
+// credentials.  Other cookies are left in place.
+func (b *BasicMiddleware) StripCredentials(r *http.Request) {
+	r.Header.Del("Authorization")
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if !b.cookie.owns(c.Name) {
+			r.AddCookie(c)
+		}
+	}
+}
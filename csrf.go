@@ -0,0 +1,127 @@
+package authware
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// CSRFFieldName is the form field that carries the CSRF
+	// token.
+	CSRFFieldName = "csrf_token"
+
+	// CSRFHeaderName is the header that carries the CSRF token
+	// for requests that do not submit a form.
+	CSRFHeaderName = "X-CSRF-Token"
+)
+
+// CSRFToken returns the token that must accompany unsafe requests
+// made on behalf of the current session.  If the request does not
+// have a session, such as when rendering the login form, a random
+// token is bound to the client with a separate cookie instead, and w
+// will have that cookie set on it if it is not already present.
+func (b *BasicMiddleware) CSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if session, err := b.loadSession(r); err == nil && session.CSRFToken != "" {
+		return session.CSRFToken
+	}
+
+	if token, err := b.loginCSRFToken(r); err == nil {
+		return token
+	}
+
+	token := rand.Text()
+	b64, err := b.keys.EncryptToBase64(token)
+	if err != nil {
+		slog.Error("Error creating CSRF cookie", "error", err)
+		return ""
+	}
+	http.SetCookie(w, b.cookie.csrf(b64))
+	return token
+}
+
+// CSRFField returns a hidden form input carrying the CSRF token,
+// suitable for inclusion in an html/template.
+func (b *BasicMiddleware) CSRFField(w http.ResponseWriter, r *http.Request) template.HTML {
+	return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s" />`,
+		CSRFFieldName, template.HTMLEscapeString(b.CSRFToken(w, r))))
+}
+
+// CSRFHandler rejects requests with unsafe methods that do not carry
+// a valid CSRF token in either the CSRFHeaderName header or the
+// CSRFFieldName form field.  Requests that carry credentials in the
+// Authorization header and no session cookie are not subject to CSRF
+// and are passed through.
+func (b *BasicMiddleware) CSRFHandler() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !b.checkCSRF(r) {
+				slog.Debug("Denying request with missing or invalid CSRF token", "url", r.URL.String())
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintln(w, "Invalid CSRF Token")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// checkCSRF returns true if the request is safe or carries a token
+// matching either its session or its login CSRF cookie.
+func (b *BasicMiddleware) checkCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	_, cookieErr := r.Cookie(b.cookie.Name)
+	if cookieErr != nil && r.Header.Get("Authorization") != "" {
+		return true
+	}
+
+	presented := r.Header.Get(CSRFHeaderName)
+	if presented == "" {
+		presented = r.PostFormValue(CSRFFieldName)
+	}
+	if presented == "" {
+		return false
+	}
+
+	expected := ""
+	if session, err := b.loadSession(r); err == nil {
+		expected = session.CSRFToken
+	} else if token, err := b.loginCSRFToken(r); err == nil {
+		expected = token
+	}
+	return expected != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(expected)) == 1
+}
+
+// loginCSRFToken retrieves the token bound to a client that does not
+// yet have a session.
+func (b *BasicMiddleware) loginCSRFToken(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(b.cookie.csrfName())
+	if err != nil {
+		return "", err
+	}
+	var token string
+	if err := b.keys.DecryptBase64(cookie.Value, &token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (c CookieOptions) csrfName() string {
+	return c.Name + "_csrf"
+}
+
+// csrf returns the cookie that binds a login CSRF token to a client.
+// It expires when the browser is closed.
+func (c CookieOptions) csrf(value string) *http.Cookie {
+	ck := c.cookie(value, time.Time{})
+	ck.Name = c.csrfName()
+	return ck
+}
@@ -0,0 +1,126 @@
+package authware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newCSRFMiddleware(t *testing.T) (*BasicMiddleware, http.Handler) {
+	t.Helper()
+	b, err := NewAuth(WithAuthenticators())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return b, b.CSRFHandler()(ok)
+}
+
+func TestCSRFSession(t *testing.T) {
+	b, h := newCSRFMiddleware(t)
+	tb := testBrowser{}
+	tb.login(t, b, "alice", time.Now())
+	session, err := b.CurrentSession(tb.request(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := b.CSRFToken(httptest.NewRecorder(), tb.request(http.MethodGet, "/", nil))
+	if token == "" || token != session.CSRFToken {
+		t.Fatalf("CSRFToken returned %q, want the session's token", token)
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		form   url.Values
+		header string
+		want   int
+	}{
+		{"get", http.MethodGet, nil, "", http.StatusNoContent},
+		{"head", http.MethodHead, nil, "", http.StatusNoContent},
+		{"options", http.MethodOptions, nil, "", http.StatusNoContent},
+		{"missing", http.MethodPost, url.Values{}, "", http.StatusForbidden},
+		{"mismatched", http.MethodPost, url.Values{CSRFFieldName: {"not-the-token"}}, "", http.StatusForbidden},
+		{"mismatched header", http.MethodDelete, nil, "not-the-token", http.StatusForbidden},
+		{"form", http.MethodPost, url.Values{CSRFFieldName: {token}}, "", http.StatusNoContent},
+		{"header", http.MethodPut, nil, token, http.StatusNoContent},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := tb.request(c.method, "/", c.form)
+			if c.header != "" {
+				r.Header.Set(CSRFHeaderName, c.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != c.want {
+				t.Errorf("expected %d, got %d", c.want, w.Code)
+			}
+		})
+	}
+
+	// Another session's token is not accepted.
+	other := testBrowser{}
+	other.login(t, b, "mallory", time.Now())
+	if w := other.do(h, http.MethodPost, "/", url.Values{CSRFFieldName: {token}}); w.Code != http.StatusForbidden {
+		t.Errorf("token of another session returned %d", w.Code)
+	}
+}
+
+func TestCSRFLoginCookie(t *testing.T) {
+	b, h := newCSRFMiddleware(t)
+
+	// Rendering the login form binds a token to the client with
+	// a cookie, and the same token is returned until it changes.
+	tb := testBrowser{}
+	w := httptest.NewRecorder()
+	token := b.CSRFToken(w, tb.request(http.MethodGet, "/login", nil))
+	tb.keep(w)
+	if _, ok := tb[b.cookie.csrfName()]; !ok || token == "" {
+		t.Fatalf("no CSRF cookie was set for token %q", token)
+	}
+	if again := b.CSRFToken(httptest.NewRecorder(), tb.request(http.MethodGet, "/login", nil)); again != token {
+		t.Errorf("CSRFToken returned %q, then %q", token, again)
+	}
+
+	if w := tb.do(h, http.MethodPost, "/login", url.Values{CSRFFieldName: {token}}); w.Code != http.StatusNoContent {
+		t.Errorf("form with the cookie's token returned %d", w.Code)
+	}
+	if w := tb.do(h, http.MethodPost, "/login", url.Values{}); w.Code != http.StatusForbidden {
+		t.Errorf("form without a token returned %d", w.Code)
+	}
+
+	// The token is useless without the cookie it is bound to.
+	if w := (testBrowser{}).do(h, http.MethodPost, "/login", url.Values{CSRFFieldName: {token}}); w.Code != http.StatusForbidden {
+		t.Errorf("token without its cookie returned %d", w.Code)
+	}
+}
+
+func TestCSRFAuthorizationHeader(t *testing.T) {
+	b, h := newCSRFMiddleware(t)
+
+	// Clients that send credentials themselves cannot be the
+	// victim of a forged request.
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.SetBasicAuth("alice", "secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("request with an Authorization header returned %d", w.Code)
+	}
+
+	// Unless they also have a session cookie.
+	tb := testBrowser{}
+	tb.login(t, b, "alice", time.Now())
+	r = tb.request(http.MethodPost, "/", nil)
+	r.SetBasicAuth("alice", "secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("request with a session and an Authorization header returned %d", w.Code)
+	}
+}
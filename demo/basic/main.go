@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"html/template"
 	"log/slog"
 	"net/http"
 	"os"
@@ -16,6 +17,7 @@ import (
 	_ "github.com/the-maldridge/authware/backend/ldap"
 	_ "github.com/the-maldridge/authware/backend/netauth"
 	_ "github.com/the-maldridge/authware/backend/pam"
+	_ "github.com/the-maldridge/authware/backend/token"
 )
 
 func main() {
@@ -39,7 +41,7 @@ func main() {
 		r.Use(basic.BasicHandler)
 		r.Get("/", secureLanding)
 	})
-	r.Get("/login", loginPage)
+	r.Get("/login", loginPage(basic))
 	r.Post("/login", basic.LoginFormHandler("username", "password", "/logged-in/"))
 	r.Route("/logged-in/", func(r chi.Router) {
 		r.Use(basic.LoginHandler("/login"))
@@ -49,6 +51,8 @@ func main() {
 	r.Route("/multi", func(r chi.Router) {
 		r.Use(basic.MultiAuthHandler())
 		r.Get("/", secureLanding)
+		r.With(authware.RequireAnyGroup("group1")).Get("/group1/", secureLanding)
+		r.With(authware.RequireAnyGroup("group3")).Get("/group3/", secureLanding)
 	})
 
 	// Start up the webserver and wait forever.
@@ -61,6 +65,7 @@ func main() {
 	slog.Info("Try loading http://localhost:8000/basic/ for basic auth")
 	slog.Info("Try loading http://localhost:8000/logged-in/ for login auth")
 	slog.Info("Try loading http://localhost:8000/multi/ for multi-auth matching")
+	slog.Info("Try loading http://localhost:8000/multi/group1/ and /multi/group3/ for group checks")
 	slog.Info("htpassword credentials", "username", "user", "password", "password")
 
 	// Cleanly shut down the webserver on C-c.
@@ -78,25 +83,32 @@ func rootLanding(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "You've reached the webserver")
 }
 
-func loginPage(w http.ResponseWriter, r *http.Request) {
-	html := `
+func loginPage(basic *authware.BasicMiddleware) http.HandlerFunc {
+	tmpl := template.Must(template.New("login").Parse(`
 <html>
 <body>
 <form method="post">
+{{ .CSRF }}
 Username: <input type="text" name="username" /><br />
 Password: <input type="password" name="password" /><br />
 <input type="submit" />
 </form>
 </body>
 </html>
-`
-	w.Write([]byte(html))
+`))
+	return func(w http.ResponseWriter, r *http.Request) {
+		tmpl.Execute(w, map[string]any{"CSRF": basic.CSRFField(w, r)})
+	}
 }
 
 func secureLanding(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "You're on a secure prefix, this prefix is authenticated")
 
-	user := r.Context().Value(authware.UserKey{}).(authware.User)
+	user, ok := authware.UserFromContext(r.Context())
+	if !ok {
+		fmt.Fprintln(w, "You are not authenticated")
+		return
+	}
 	fmt.Fprintf(w, "You are authenticated as '%s' by '%s'\n", user.Identity, user.AuthedBy)
 	if len(user.Groups) > 0 {
 		fmt.Fprintln(w, "You have membership in the following groups")
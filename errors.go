@@ -1,5 +1,9 @@
 package authware
 
+import (
+	"time"
+)
+
 // ErrDoesNotExist returns when a request is made that does not match
 // a configured resource.
 type ErrDoesNotExist struct{}
@@ -16,3 +20,32 @@ func (e ErrUnauthenticated) Error() string { return "authentication failed" }
 type ErrBackendInternal struct{}
 
 func (e ErrBackendInternal) Error() string { return "backend internal error" }
+
+// ErrSessionExpired is returned when a session was presented that
+// is no longer valid.
+type ErrSessionExpired struct{}
+
+func (e ErrSessionExpired) Error() string { return "session expired" }
+
+// ErrNoSessionStore is returned when an operation requires a
+// SessionStore, but none was configured.
+type ErrNoSessionStore struct{}
+
+func (e ErrNoSessionStore) Error() string { return "no session store configured" }
+
+// ErrRateLimited is returned when authentication was not attempted
+// because there have been too many recent failures.
+type ErrRateLimited struct {
+	RetryAfter time.Duration
+}
+
+func (e ErrRateLimited) Error() string {
+	return "too many failed attempts, retry after " + e.RetryAfter.String()
+}
+
+// ErrSecondFactorRequired is returned when a user's password was
+// accepted, but the MFAPolicy requires them to also present a second
+// factor that they have not enrolled in or cannot present.
+type ErrSecondFactorRequired struct{}
+
+func (e ErrSecondFactorRequired) Error() string { return "second factor required" }
@@ -0,0 +1,131 @@
+package authware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// flowState is the envelope that SetFlowState encrypts.  The name is
+// carried inside so that the value of one flow cannot be replayed as
+// the value of another.
+type flowState struct {
+	Name    string
+	Expires time.Time
+	Value   json.RawMessage
+}
+
+// StartSession issues a session for a user that was authenticated by
+// some means other than the configured Authenticators, such as an
+// external identity provider.  It sets the same cookie that
+// LoginFormHandler does, and so the session is accepted everywhere a
+// session from the login form would be.  The methods the user
+// authenticated with may be given as amr, and are recorded in the
+// session.
+func (b *BasicMiddleware) StartSession(w http.ResponseWriter, r *http.Request, user User, amr ...string) error {
+	return b.issueSession(w, r, user, time.Now(), amr)
+}
+
+// StartSessionAt is like StartSession, but records that the user
+// authenticated at authTime rather than now.  Identity providers that
+// keep their own sessions may have authenticated the user long before
+// the login completes here, and RequireRecentAuth must not mistake
+// that for a recent login.  A zero authTime means that it is unknown,
+// and such sessions never satisfy RequireRecentAuth.
+func (b *BasicMiddleware) StartSessionAt(w http.ResponseWriter, r *http.Request, user User, authTime time.Time, amr ...string) error {
+	return b.issueSession(w, r, user, authTime, amr)
+}
+
+// LookupUser builds the User for an identity that has proven who it
+// is without a password, such as with a passkey, by asking the named
+// backend for its groups.  AuthedBy is set to the backend, and
+// callers may replace it.  Whether an identity that the backend no
+// longer knows is reported as an error depends on the backend.
+func (b *BasicMiddleware) LookupUser(ctx context.Context, identity, backend string) (User, error) {
+	for _, a := range b.a {
+		if a.Name() != backend {
+			continue
+		}
+		groups, err := b.userGroups(ctx, a, identity)
+		if err != nil {
+			return User{}, err
+		}
+		return User{Identity: identity, Groups: groups, AuthedBy: backend}, nil
+	}
+	return User{}, ErrDoesNotExist{}
+}
+
+// SafeNext returns next if it is a permitted redirect target under
+// the configured RedirectOptions, and fallback otherwise.
+func (b *BasicMiddleware) SafeNext(next, fallback string) string {
+	return b.safeNext(next, fallback)
+}
+
+// SetFlowState stores v in a short lived encrypted cookie so that a
+// login flow which leaves the site, such as a redirect to an identity
+// provider, can pick up where it left off when the client returns.
+// The value must be serializable as JSON.
+func (b *BasicMiddleware) SetFlowState(w http.ResponseWriter, name string, v any, ttl time.Duration) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(ttl)
+	b64, err := b.keys.EncryptToBase64(flowState{Name: name, Expires: expires, Value: value})
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, b.cookie.flow(name, b64, expires))
+	return nil
+}
+
+// TakeFlowState retrieves the value stored by SetFlowState into v and
+// clears the cookie so that it cannot be used twice.
+func (b *BasicMiddleware) TakeFlowState(w http.ResponseWriter, r *http.Request, name string, v any) error {
+	if _, err := r.Cookie(b.cookie.flowName(name)); err != nil {
+		return ErrDoesNotExist{}
+	}
+	expired := b.cookie.flow(name, "", time.Unix(0, 0))
+	expired.MaxAge = -1
+	http.SetCookie(w, expired)
+	return b.peekFlowState(r, name, v)
+}
+
+// peekFlowState retrieves the value stored by SetFlowState without
+// clearing it.
+func (b *BasicMiddleware) peekFlowState(r *http.Request, name string, v any) error {
+	cookie, err := r.Cookie(b.cookie.flowName(name))
+	if err != nil {
+		return ErrDoesNotExist{}
+	}
+
+	var fs flowState
+	if err := b.keys.DecryptBase64(cookie.Value, &fs); err != nil {
+		return err
+	}
+	if fs.Name != name {
+		return ErrDoesNotExist{}
+	}
+	if time.Now().After(fs.Expires) {
+		return ErrSessionExpired{}
+	}
+	return json.Unmarshal(fs.Value, v)
+}
+
+func (c CookieOptions) flowName(name string) string {
+	return c.Name + "_" + name
+}
+
+// flow returns a cookie carrying login flow state.  The client
+// returns to the site by way of a top level cross-site navigation,
+// which a strict cookie would not be sent with, and so the cookie is
+// never stricter than Lax.
+func (c CookieOptions) flow(name, value string, expires time.Time) *http.Cookie {
+	ck := c.cookie(value, expires)
+	ck.Name = c.flowName(name)
+	if ck.SameSite == http.SameSiteStrictMode {
+		ck.SameSite = http.SameSiteLaxMode
+	}
+	return ck
+}
@@ -0,0 +1,108 @@
+package authware
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// ForwardAuthHandler implements the subrequest contract used by nginx
+// auth_request, Traefik ForwardAuth, and Caddy forward_auth, which
+// allows services that are not written in Go to be protected by
+// authware.  The proxy sends a copy of each request's headers, and
+// the handler checks the Basic, bearer, or session credentials it
+// carries.
+//
+// On success a 200 is returned with the user in the X-Auth-User,
+// X-Auth-Groups (comma separated), and X-Auth-Backend headers for the
+// proxy to copy onto the upstream request.  If the request carried no
+// credentials and loginURL is not empty, the client is redirected to
+// loginURL with a next parameter built from the X-Forwarded-Proto,
+// X-Forwarded-Host, and X-Forwarded-Uri headers.  Otherwise a 401 is
+// returned.  Note that nginx treats any response other than 2xx, 401,
+// or 403 as an error, so nginx deployments should leave loginURL
+// empty and redirect with error_page instead.
+//
+// If an idle timeout is configured, sessions are extended here as
+// they are by LoginHandler, and the new cookie is set on the 200.
+// Proxies discard that response by default, so they must be told to
+// pass the Set-Cookie header back to the client, or the session will
+// expire at the end of the idle timeout however active the user is.
+func (b *BasicMiddleware) ForwardAuthHandler(loginURL string) http.Handler {
+	authed := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := MustUser(r.Context())
+		groups := make([]string, 0, len(user.Groups))
+		for g := range user.Groups {
+			groups = append(groups, g)
+		}
+		slices.Sort(groups)
+
+		w.Header().Set("X-Auth-User", user.Identity)
+		w.Header().Set("X-Auth-Groups", strings.Join(groups, ","))
+		w.Header().Set("X-Auth-Backend", user.AuthedBy)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := bearerToken(r); ok {
+			b.BearerHandler(authed).ServeHTTP(w, r)
+			return
+		}
+		if _, _, ok := r.BasicAuth(); ok {
+			b.BasicHandler(authed).ServeHTTP(w, r)
+			return
+		}
+		if session, err := b.loadSession(r); err == nil {
+			b.refreshSession(w, r, session)
+			authed.ServeHTTP(w, r.WithContext(WithUser(r.Context(), session.User)))
+			return
+		}
+
+		if loginURL == "" {
+			slog.Debug("Received forward auth request with no credentials", "uri", r.Header.Get("X-Forwarded-Uri"))
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Authentication Required")
+			return
+		}
+
+		target, err := url.Parse(loginURL)
+		if err != nil {
+			slog.Error("Forward auth login URL is invalid", "url", loginURL, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if next := b.forwardedNext(r); next != "" {
+			q := target.Query()
+			q.Set("next", next)
+			target.RawQuery = q.Encode()
+		}
+		http.Redirect(w, r, target.String(), http.StatusFound)
+	})
+}
+
+// forwardedNext reconstructs the URL that the client originally
+// requested from the headers set by the proxy.  The absolute URL is
+// only used if its host is a permitted redirect target, since the
+// login page is usually on a different host than the service being
+// protected.  Otherwise only the path is used.
+func (b *BasicMiddleware) forwardedNext(r *http.Request) string {
+	uri := r.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		return ""
+	}
+
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+		proto := r.Header.Get("X-Forwarded-Proto")
+		if proto == "" {
+			proto = "https"
+		}
+		abs := proto + "://" + host + uri
+		if u, err := url.Parse(abs); err == nil && b.redirect.allowed(u) {
+			return abs
+		}
+	}
+	return b.safeNext(uri, "")
+}
@@ -0,0 +1,30 @@
+package authware
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestForwardAuthRefreshesSession(t *testing.T) {
+	b, err := NewAuth(WithAuthenticators(), WithIdleTimeout(10*time.Minute), WithRefreshThreshold(20*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := testBrowser{}
+	tb.login(t, b, "alice", time.Now())
+	before, _ := b.CurrentSession(tb.request(http.MethodGet, "/", nil))
+
+	time.Sleep(10 * time.Millisecond)
+	w := tb.do(b.ForwardAuthHandler(""), http.MethodGet, "/auth", nil)
+	if w.Code != http.StatusOK || w.Header().Get("X-Auth-User") != "alice" {
+		t.Fatalf("forward auth returned %d for %q", w.Code, w.Header().Get("X-Auth-User"))
+	}
+	if w.Header().Get("Set-Cookie") == "" {
+		t.Fatal("refreshed session cookie was not set on the response")
+	}
+	after, err := b.CurrentSession(tb.request(http.MethodGet, "/", nil))
+	if err != nil || !after.Expires.After(before.Expires) {
+		t.Errorf("session was not extended: %s, then %s", before.Expires, after.Expires)
+	}
+}
@@ -0,0 +1,132 @@
+package authware
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// HeaderOptions controls authentication by headers that are set by
+// an authenticating proxy in front of the application.  Headers are
+// only trusted on requests that arrive directly from one of the
+// TrustedProxies, and header authentication is disabled entirely if
+// none are listed.
+type HeaderOptions struct {
+	// TrustedProxies lists the networks that authenticating
+	// proxies connect from.  The proxy must remove any copies of
+	// the headers sent by clients.
+	TrustedProxies []netip.Prefix
+
+	// UserHeader carries the identity of the user.  It defaults
+	// to X-Remote-User.
+	UserHeader string
+
+	// GroupsHeader carries the groups of the user.  It defaults
+	// to X-Remote-Groups.
+	GroupsHeader string
+
+	// GroupSeparator splits GroupsHeader into individual groups.
+	// It defaults to ",".
+	GroupSeparator string
+
+	// Name is recorded as the AuthedBy of users authenticated by
+	// the proxy.  It defaults to "proxy".
+	Name string
+}
+
+// ParseTrustedProxies parses a list of CIDR prefixes or bare
+// addresses for use in HeaderOptions.
+func ParseTrustedProxies(list ...string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+func (h *HeaderOptions) setDefaults() {
+	if h.UserHeader == "" {
+		h.UserHeader = "X-Remote-User"
+	}
+	if h.GroupsHeader == "" {
+		h.GroupsHeader = "X-Remote-Groups"
+	}
+	if h.GroupSeparator == "" {
+		h.GroupSeparator = ","
+	}
+	if h.Name == "" {
+		h.Name = "proxy"
+	}
+}
+
+// HeaderHandler authenticates requests using the headers set by a
+// trusted authenticating proxy.  Requests that do not come from a
+// trusted proxy, or that do not carry a user, are rejected.
+func (b *BasicMiddleware) HeaderHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := b.headerUser(r)
+		if !ok {
+			slog.Debug("Received request with no trusted user header", "remote", r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Authentication Required")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+	})
+}
+
+// headerUser builds a User from the proxy headers if the request
+// came from a trusted proxy and names a user.
+func (b *BasicMiddleware) headerUser(r *http.Request) (User, bool) {
+	identity := r.Header.Get(b.header.UserHeader)
+	if identity == "" || len(b.header.TrustedProxies) == 0 {
+		return User{}, false
+	}
+	if !remoteIn(r, b.header.TrustedProxies) {
+		slog.Warn("Ignoring user header from untrusted address", "remote", r.RemoteAddr, "header", b.header.UserHeader)
+		return User{}, false
+	}
+
+	user := User{
+		Identity: identity,
+		Groups:   make(map[string]struct{}),
+		AuthedBy: b.header.Name,
+	}
+	for _, g := range strings.Split(r.Header.Get(b.header.GroupsHeader), b.header.GroupSeparator) {
+		if g = strings.TrimSpace(g); g != "" {
+			user.Groups[g] = struct{}{}
+		}
+	}
+	return user, true
+}
+
+// remoteIn returns true if the request arrived directly from an
+// address within one of the prefixes.
+func remoteIn(r *http.Request, prefixes []netip.Prefix) bool {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := ap.Addr().Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,307 @@
+package idp
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	jwtlib "github.com/golang-jwt/jwt/v5"
+
+	"github.com/the-maldridge/authware"
+	"github.com/the-maldridge/authware/jwt"
+)
+
+// idClaims are the claims of an ID token.
+type idClaims struct {
+	Nonce             string              `json:"nonce,omitempty"`
+	PreferredUsername string              `json:"preferred_username,omitempty"`
+	AuthTime          *jwtlib.NumericDate `json:"auth_time,omitempty"`
+	AMR               []string            `json:"amr,omitempty"`
+	jwt.Claims
+}
+
+// Handler serves every endpoint of the provider beneath the path of
+// the issuer URL.  Requests to the authorize endpoint are passed
+// through login first, which should be the middleware returned by
+// BasicMiddleware.LoginHandler so that users without a session are
+// sent to log in with the configured Authenticators and then returned
+// to complete the authorization.
+func (p *Provider) Handler(login authware.Middleware) http.Handler {
+	prefix := ""
+	if u, err := url.Parse(p.issuer); err == nil {
+		prefix = u.Path
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(prefix+"/.well-known/openid-configuration", p.DiscoveryHandler())
+	mux.Handle(prefix+"/.well-known/jwks.json", p.signer.JWKSHandler())
+	mux.Handle(prefix+"/authorize", login(p.AuthorizeHandler()))
+	mux.Handle(prefix+"/token", p.TokenHandler())
+	mux.Handle(prefix+"/userinfo", p.UserinfoHandler())
+	return mux
+}
+
+// DiscoveryHandler serves the OpenID Connect discovery document.
+func (p *Provider) DiscoveryHandler() http.Handler {
+	doc := map[string]any{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"userinfo_endpoint":                     p.issuer + "/userinfo",
+		"jwks_uri":                              p.issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{p.signer.Algorithm()},
+		"scopes_supported":                      []string{"openid", "profile", "groups"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "amr", "nonce", "preferred_username", "groups"},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(doc)
+	})
+}
+
+// JWKSHandler serves the public keys that tokens are signed with.
+func (p *Provider) JWKSHandler() http.Handler {
+	return p.signer.JWKSHandler()
+}
+
+// AuthorizeHandler issues an authorization code to the client for
+// the user in the request context.  It must be placed behind a
+// middleware that authenticates the user, as Handler does.
+func (p *Provider) AuthorizeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "Invalid Request")
+			return
+		}
+
+		// Until the client and redirect URI are known to be
+		// good, errors must not be sent to the redirect URI.
+		redirectURI := r.Form.Get("redirect_uri")
+		client, ok := p.client(r.Form.Get("client_id"))
+		if !ok || !client.allowsRedirect(redirectURI) {
+			slog.Debug("Rejecting authorization for unknown client or redirect", "client", r.Form.Get("client_id"), "redirect_uri", redirectURI)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "Unknown Client or Redirect URI")
+			return
+		}
+
+		user, ok := authware.UserFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Authentication Required")
+			return
+		}
+
+		state := r.Form.Get("state")
+		scopes := strings.Fields(r.Form.Get("scope"))
+		challenge := r.Form.Get("code_challenge")
+		switch {
+		case r.Form.Get("response_type") != "code":
+			redirectError(w, r, redirectURI, state, "unsupported_response_type", "only the code response type is supported")
+			return
+		case !slices.Contains(scopes, "openid"):
+			redirectError(w, r, redirectURI, state, "invalid_scope", "the openid scope is required")
+			return
+		case challenge != "" && r.Form.Get("code_challenge_method") != "S256":
+			redirectError(w, r, redirectURI, state, "invalid_request", "only the S256 code challenge method is supported")
+			return
+		case challenge == "" && client.Secret == "":
+			redirectError(w, r, redirectURI, state, "invalid_request", "public clients must use PKCE")
+			return
+		}
+
+		g := grant{
+			ClientID:    client.ID,
+			RedirectURI: redirectURI,
+			Scopes:      scopes,
+			Nonce:       r.Form.Get("nonce"),
+			Challenge:   challenge,
+			User:        user,
+		}
+		if session, ok := authware.SessionFromContext(r.Context()); ok {
+			g.AuthTime = session.AuthTime
+			g.AMR = session.AMR
+		}
+		code := p.issueCode(g)
+		slog.Debug("Issued authorization code", "user", user.Identity, "client", client.ID)
+		redirectWith(w, r, redirectURI, url.Values{"code": {code}, "state": {state}})
+	})
+}
+
+// TokenHandler redeems authorization codes for an ID token and an
+// access token.  Clients with a secret may authenticate with either
+// HTTP basic auth or form parameters.
+func (p *Provider) TokenHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			tokenError(w, http.StatusBadRequest, "invalid_request", "could not parse form")
+			return
+		}
+
+		clientID, secret, basic := r.BasicAuth()
+		if !basic {
+			clientID = r.PostForm.Get("client_id")
+			secret = r.PostForm.Get("client_secret")
+		}
+		client, ok := p.client(clientID)
+		if !ok || !client.authenticate(secret) {
+			slog.Debug("Rejecting token request with bad client credentials", "client", clientID)
+			if basic {
+				w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+			}
+			tokenError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+			return
+		}
+
+		if r.PostForm.Get("grant_type") != "authorization_code" {
+			tokenError(w, http.StatusBadRequest, "unsupported_grant_type", "only the authorization_code grant is supported")
+			return
+		}
+
+		g, ok := p.redeemCode(r.PostForm.Get("code"))
+		if !ok || g.ClientID != client.ID || g.RedirectURI != r.PostForm.Get("redirect_uri") {
+			tokenError(w, http.StatusBadRequest, "invalid_grant", "the code is invalid or has expired")
+			return
+		}
+		if g.Challenge != "" && !verifyChallenge(g.Challenge, r.PostForm.Get("code_verifier")) {
+			tokenError(w, http.StatusBadRequest, "invalid_grant", "the code verifier does not match")
+			return
+		}
+
+		access, _, err := p.signer.Mint(g.User)
+		if err != nil {
+			slog.Error("Error minting access token", "user", g.User.Identity, "error", err)
+			tokenError(w, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+		id, err := p.signer.Sign(p.idClaims(g))
+		if err != nil {
+			slog.Error("Error minting ID token", "user", g.User.Identity, "error", err)
+			tokenError(w, http.StatusInternalServerError, "server_error", "")
+			return
+		}
+
+		slog.Info("Issued tokens", "user", g.User.Identity, "client", client.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			AccessToken string `json:"access_token"`
+			TokenType   string `json:"token_type"`
+			ExpiresIn   int    `json:"expires_in"`
+			IDToken     string `json:"id_token"`
+			Scope       string `json:"scope"`
+		}{access, "Bearer", int(p.tokenLifetime.Seconds()), id, strings.Join(g.Scopes, " ")})
+	})
+}
+
+// UserinfoHandler returns the claims of the user that an access token
+// was issued to.
+func (p *Provider) UserinfoHandler() http.Handler {
+	return p.signer.JWTHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := authware.MustUser(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			Subject           string   `json:"sub"`
+			PreferredUsername string   `json:"preferred_username"`
+			Groups            []string `json:"groups"`
+		}{user.Identity, user.Identity, sortedGroups(user)})
+	}))
+}
+
+func (p *Provider) idClaims(g grant) idClaims {
+	now := time.Now()
+	var authTime *jwtlib.NumericDate
+	if !g.AuthTime.IsZero() {
+		authTime = jwtlib.NewNumericDate(g.AuthTime)
+	}
+	return idClaims{
+		Nonce:             g.Nonce,
+		PreferredUsername: g.User.Identity,
+		AuthTime:          authTime,
+		AMR:               g.AMR,
+		Claims: jwt.Claims{
+			Groups:   sortedGroups(g.User),
+			AuthedBy: g.User.AuthedBy,
+			RegisteredClaims: jwtlib.RegisteredClaims{
+				Issuer:    p.issuer,
+				Subject:   g.User.Identity,
+				Audience:  jwtlib.ClaimStrings{g.ClientID},
+				ExpiresAt: jwtlib.NewNumericDate(now.Add(p.tokenLifetime)),
+				IssuedAt:  jwtlib.NewNumericDate(now),
+			},
+		},
+	}
+}
+
+func sortedGroups(u authware.User) []string {
+	groups := make([]string, 0, len(u.Groups))
+	for g := range u.Groups {
+		groups = append(groups, g)
+	}
+	slices.Sort(groups)
+	return groups
+}
+
+func verifyChallenge(challenge, verifier string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// redirectWith sends the client back to the redirect URI with the
+// given parameters added to any query it already has.
+func redirectWith(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "Invalid Redirect URI")
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		if v[0] != "" {
+			q[k] = v
+		}
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func redirectError(w http.ResponseWriter, r *http.Request, redirectURI, state, code, description string) {
+	slog.Debug("Rejecting authorization request", "error", code, "description", description)
+	redirectWith(w, r, redirectURI, url.Values{
+		"error":             {code},
+		"error_description": {description},
+		"state":             {state},
+	})
+}
+
+func tokenError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description,omitempty"`
+	}{code, description})
+}
@@ -0,0 +1,270 @@
+package idp
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/the-maldridge/authware"
+	"github.com/the-maldridge/authware/jwt"
+)
+
+// Client is an application that is permitted to log users in through
+// the provider.
+type Client struct {
+	ID string `mapstructure:"id"`
+
+	// Secret authenticates the client at the token endpoint.
+	// Clients without a secret are public clients, such as single
+	// page or native applications, and must use PKCE.
+	Secret string `mapstructure:"secret"`
+
+	// RedirectURIs lists the exact URIs that users may be returned
+	// to after logging in.
+	RedirectURIs []string `mapstructure:"redirect_uris"`
+}
+
+// Config contains the settings for the provider.
+type Config struct {
+	// Issuer is the externally visible URL at which the provider
+	// is served, for example https://auth.example.com.  The
+	// discovery document is expected to be reachable at
+	// <Issuer>/.well-known/openid-configuration.
+	Issuer string `mapstructure:"issuer"`
+
+	// Clients lists the applications that may use the provider.
+	Clients []Client `mapstructure:"clients"`
+
+	// ClientsFile is a file in any format understood by viper
+	// that holds a list of clients under the key "clients".  It
+	// is reloaded when the process receives SIGHUP.
+	ClientsFile string `mapstructure:"clients_file"`
+
+	// KeyFile is a PEM file holding the RSA or Ed25519 key used
+	// to sign tokens.
+	KeyFile string `mapstructure:"key_file"`
+
+	// VerifyKeyFiles lists PEM files holding keys that are still
+	// published in the JWKS document but no longer used to sign.
+	VerifyKeyFiles []string `mapstructure:"verify_key_files"`
+
+	// Keys may be set instead of KeyFile by programs that
+	// construct their keys directly.  The first key is used to
+	// sign.
+	Keys []*jwt.Key `mapstructure:"-"`
+
+	// TokenLifetime is how long ID and access tokens remain
+	// valid.  It defaults to 1 hour.
+	TokenLifetime time.Duration `mapstructure:"token_lifetime"`
+
+	// CodeLifetime is how long an authorization code may wait to
+	// be redeemed.  It defaults to 1 minute.
+	CodeLifetime time.Duration `mapstructure:"code_lifetime"`
+}
+
+// Provider is a minimal OpenID Provider.  It supports the
+// authorization code flow, with PKCE, for users that have logged in
+// through a BasicMiddleware.
+type Provider struct {
+	issuer        string
+	tokenLifetime time.Duration
+	codeLifetime  time.Duration
+	signer        *jwt.Issuer
+	clientsFile   string
+
+	mu      sync.Mutex
+	clients map[string]Client
+	codes   map[string]grant
+}
+
+// grant is what an authorization code stands for until it is
+// redeemed.  AuthTime and AMR come from the user's session, and are
+// empty if the user was authenticated some other way.
+type grant struct {
+	ClientID    string
+	RedirectURI string
+	Scopes      []string
+	Nonce       string
+	Challenge   string
+	User        authware.User
+	AuthTime    time.Time
+	AMR         []string
+	Expires     time.Time
+}
+
+// ConfigFromEnv obtains the provider configuration from
+// AUTHWARE_IDP_ISSUER, AUTHWARE_IDP_CLIENTS_FILE, and
+// AUTHWARE_IDP_KEY_FILE.
+func ConfigFromEnv() Config {
+	return Config{
+		Issuer:      os.Getenv("AUTHWARE_IDP_ISSUER"),
+		ClientsFile: os.Getenv("AUTHWARE_IDP_CLIENTS_FILE"),
+		KeyFile:     os.Getenv("AUTHWARE_IDP_KEY_FILE"),
+	}
+}
+
+// New returns a provider for the given config.
+func New(cfg Config) (*Provider, error) {
+	if cfg.Issuer == "" {
+		slog.Error("Missing required config value", "key", "Issuer")
+		return nil, errors.New("must specify an issuer URL")
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	if cfg.TokenLifetime == 0 {
+		cfg.TokenLifetime = time.Hour
+	}
+	if cfg.CodeLifetime == 0 {
+		cfg.CodeLifetime = time.Minute
+	}
+
+	signer, err := jwt.New(jwt.Config{
+		Issuer:         cfg.Issuer,
+		Audience:       []string{cfg.Issuer},
+		Lifetime:       cfg.TokenLifetime,
+		KeyFile:        cfg.KeyFile,
+		VerifyKeyFiles: cfg.VerifyKeyFiles,
+		Keys:           cfg.Keys,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if signer.Algorithm() == "HS256" {
+		return nil, errors.New("the provider requires an RSA or Ed25519 signing key")
+	}
+
+	x := &Provider{
+		issuer:        cfg.Issuer,
+		tokenLifetime: cfg.TokenLifetime,
+		codeLifetime:  cfg.CodeLifetime,
+		signer:        signer,
+		clientsFile:   cfg.ClientsFile,
+		codes:         make(map[string]grant),
+	}
+	if err := x.setClients(cfg.Clients); err != nil {
+		return nil, err
+	}
+
+	if x.clientsFile != "" {
+		if err := x.Reload(); err != nil {
+			return nil, err
+		}
+
+		rChan := make(chan os.Signal, 1)
+		signal.Notify(rChan, syscall.SIGHUP)
+
+		go func() {
+			for {
+				<-rChan
+				if err := x.Reload(); err != nil {
+					slog.Warn("Error reloading clients, keeping previous clients", "error", err)
+					continue
+				}
+				slog.Info("Reloaded clients", "file", x.clientsFile)
+			}
+		}()
+	}
+
+	slog.Info("Initialized", "idp", x.issuer)
+	return x, nil
+}
+
+// Reload reads the clients file again.  Clients listed directly in
+// the Config are replaced by those in the file.
+func (p *Provider) Reload() error {
+	v := viper.New()
+	v.SetConfigFile(p.clientsFile)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+
+	var f struct {
+		Clients []Client `mapstructure:"clients"`
+	}
+	if err := v.UnmarshalExact(&f); err != nil {
+		return err
+	}
+	return p.setClients(f.Clients)
+}
+
+func (p *Provider) setClients(list []Client) error {
+	clients := make(map[string]Client, len(list))
+	for i, c := range list {
+		if c.ID == "" {
+			return fmt.Errorf("clients[%d].id: must not be empty", i)
+		}
+		if len(c.RedirectURIs) == 0 {
+			return fmt.Errorf("clients[%d].redirect_uris: must not be empty", i)
+		}
+		if _, dup := clients[c.ID]; dup {
+			return fmt.Errorf("clients[%d].id: %q is listed more than once", i, c.ID)
+		}
+		clients[c.ID] = c
+	}
+
+	p.mu.Lock()
+	p.clients = clients
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Provider) client(id string) (Client, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.clients[id]
+	return c, ok
+}
+
+// authenticate checks the secret presented by a client.  Public
+// clients have no secret and must not present one.
+func (c Client) authenticate(secret string) bool {
+	if c.Secret == "" {
+		return secret == ""
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(c.Secret)) == 1
+}
+
+func (c Client) allowsRedirect(uri string) bool {
+	return slices.Contains(c.RedirectURIs, uri)
+}
+
+// issueCode stores a grant and returns the code that redeems it.
+// Expired codes are swept out at the same time.
+func (p *Provider) issueCode(g grant) string {
+	code := rand.Text()
+	now := time.Now()
+	g.Expires = now.Add(p.codeLifetime)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, v := range p.codes {
+		if now.After(v.Expires) {
+			delete(p.codes, k)
+		}
+	}
+	p.codes[code] = g
+	return code
+}
+
+// redeemCode returns the grant for a code and removes it so that the
+// code cannot be used twice.
+func (p *Provider) redeemCode(code string) (grant, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	g, ok := p.codes[code]
+	delete(p.codes, code)
+	if !ok || time.Now().After(g.Expires) {
+		return grant{}, false
+	}
+	return g, true
+}
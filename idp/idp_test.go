@@ -0,0 +1,259 @@
+package idp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	jwtlib "github.com/golang-jwt/jwt/v5"
+
+	"github.com/the-maldridge/authware"
+	"github.com/the-maldridge/authware/jwt"
+)
+
+const (
+	testIssuer   = "https://auth.example.com"
+	wikiCallback = "https://wiki.example.com/callback"
+	spaCallback  = "https://spa.example.com/callback"
+)
+
+type fixture struct {
+	p       *Provider
+	h       http.Handler
+	pub     ed25519.PublicKey
+	cookies []*http.Cookie
+	login   time.Time
+}
+
+// newFixture returns a provider with a confidential client, wiki, and
+// a public client, spa, along with the session cookie of a user that
+// logged in with a password and a one time code.
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(Config{
+		Issuer: testIssuer,
+		Keys:   []*jwt.Key{jwt.NewEd25519Key("", priv)},
+		Clients: []Client{
+			{ID: "wiki", Secret: "wiki-secret", RedirectURIs: []string{wikiCallback}},
+			{ID: "spa", RedirectURIs: []string{spaCallback}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mw, err := authware.NewAuth(authware.WithAuthenticators())
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := time.Now().Add(-time.Minute).Truncate(time.Second)
+	w := httptest.NewRecorder()
+	alice := authware.User{Identity: "alice", Groups: map[string]struct{}{"staff": {}}}
+	if err := mw.StartSessionAt(w, httptest.NewRequest(http.MethodGet, "/", nil), alice, login, authware.AMRPassword, authware.AMROneTimeCode); err != nil {
+		t.Fatal(err)
+	}
+	return &fixture{p: p, h: p.Handler(mw.LoginHandler("/login")), pub: pub, cookies: w.Result().Cookies(), login: login}
+}
+
+// authorize makes an authorization request as the logged in user and
+// returns the query of the redirect.
+func (f *fixture) authorize(t *testing.T, params url.Values) (int, url.Values) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, testIssuer+"/authorize?"+params.Encode(), nil)
+	for _, c := range f.cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	f.h.ServeHTTP(w, r)
+	if w.Code != http.StatusFound {
+		return w.Code, nil
+	}
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, u.Query()
+}
+
+// token redeems a code and returns the status and decoded response.
+func (f *fixture) token(t *testing.T, form url.Values) (int, map[string]any) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, testIssuer+"/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	f.h.ServeHTTP(w, r)
+	var body map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, body
+}
+
+func wikiAuthorize() url.Values {
+	return url.Values{
+		"client_id":     {"wiki"},
+		"redirect_uri":  {wikiCallback},
+		"response_type": {"code"},
+		"scope":         {"openid groups"},
+		"state":         {"xyz"},
+		"nonce":         {"n-0S6"},
+	}
+}
+
+func wikiToken(code string) url.Values {
+	return url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {wikiCallback},
+		"client_id":     {"wiki"},
+		"client_secret": {"wiki-secret"},
+	}
+}
+
+func challengeOf(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestCodeFlow(t *testing.T) {
+	f := newFixture(t)
+	status, q := f.authorize(t, wikiAuthorize())
+	if status != http.StatusFound || q.Get("code") == "" || q.Get("state") != "xyz" {
+		t.Fatalf("authorize returned %d, %v", status, q)
+	}
+
+	status, body := f.token(t, wikiToken(q.Get("code")))
+	if status != http.StatusOK {
+		t.Fatalf("token returned %d, %v", status, body)
+	}
+	raw, _ := body["id_token"].(string)
+	var c idClaims
+	if _, err := jwtlib.ParseWithClaims(raw, &c, func(*jwtlib.Token) (any, error) { return f.pub, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if c.Subject != "alice" || c.Nonce != "n-0S6" || !slices.Equal(c.Audience, jwtlib.ClaimStrings{"wiki"}) {
+		t.Errorf("unexpected claims %+v", c)
+	}
+	if c.AuthTime == nil || !c.AuthTime.Time.Equal(f.login) {
+		t.Errorf("auth_time is %v, want %s", c.AuthTime, f.login)
+	}
+	if !slices.Equal(c.AMR, []string{authware.AMRPassword, authware.AMROneTimeCode}) {
+		t.Errorf("amr is %v", c.AMR)
+	}
+}
+
+func TestCodeReuse(t *testing.T) {
+	f := newFixture(t)
+	_, q := f.authorize(t, wikiAuthorize())
+	if status, _ := f.token(t, wikiToken(q.Get("code"))); status != http.StatusOK {
+		t.Fatalf("first redemption returned %d", status)
+	}
+	status, body := f.token(t, wikiToken(q.Get("code")))
+	if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("second redemption returned %d, %v", status, body)
+	}
+}
+
+func TestRedirectURIMismatch(t *testing.T) {
+	f := newFixture(t)
+
+	// An unregistered redirect URI is refused without
+	// redirecting to it.
+	params := wikiAuthorize()
+	params.Set("redirect_uri", "https://evil.example.com/callback")
+	if status, _ := f.authorize(t, params); status != http.StatusBadRequest {
+		t.Errorf("authorize with an unregistered redirect URI returned %d", status)
+	}
+
+	// The token request must name the same redirect URI as the
+	// authorization request.
+	_, q := f.authorize(t, wikiAuthorize())
+	form := wikiToken(q.Get("code"))
+	form.Set("redirect_uri", wikiCallback+"/other")
+	if status, body := f.token(t, form); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("token with a different redirect URI returned %d, %v", status, body)
+	}
+}
+
+func TestPKCE(t *testing.T) {
+	f := newFixture(t)
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	authorize := func() string {
+		t.Helper()
+		status, q := f.authorize(t, url.Values{
+			"client_id":             {"spa"},
+			"redirect_uri":          {spaCallback},
+			"response_type":         {"code"},
+			"scope":                 {"openid"},
+			"code_challenge":        {challengeOf(verifier)},
+			"code_challenge_method": {"S256"},
+		})
+		if status != http.StatusFound || q.Get("code") == "" {
+			t.Fatalf("authorize returned %d, %v", status, q)
+		}
+		return q.Get("code")
+	}
+	token := func(code, verifier string) (int, map[string]any) {
+		t.Helper()
+		return f.token(t, url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {spaCallback},
+			"client_id":     {"spa"},
+			"code_verifier": {verifier},
+		})
+	}
+
+	if status, body := token(authorize(), "wrong-verifier"); status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("wrong verifier returned %d, %v", status, body)
+	}
+	if status, body := token(authorize(), ""); status != http.StatusBadRequest {
+		t.Errorf("missing verifier returned %d, %v", status, body)
+	}
+	if status, body := token(authorize(), verifier); status != http.StatusOK {
+		t.Errorf("correct verifier returned %d, %v", status, body)
+	}
+}
+
+func TestPublicClientRequiresPKCE(t *testing.T) {
+	f := newFixture(t)
+	status, q := f.authorize(t, url.Values{
+		"client_id":     {"spa"},
+		"redirect_uri":  {spaCallback},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+		"state":         {"abc"},
+	})
+	if status != http.StatusFound || q.Get("error") != "invalid_request" || q.Get("code") != "" || q.Get("state") != "abc" {
+		t.Errorf("authorize without a challenge returned %d, %v", status, q)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	f := newFixture(t)
+	w := httptest.NewRecorder()
+	f.h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, testIssuer+"/.well-known/openid-configuration", nil))
+	var doc struct {
+		Issuer string   `json:"issuer"`
+		Claims []string `json:"claims_supported"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Issuer != testIssuer || !slices.Contains(doc.Claims, "auth_time") || !slices.Contains(doc.Claims, "amr") {
+		t.Errorf("unexpected discovery document %+v", doc)
+	}
+}
@@ -0,0 +1,103 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+)
+
+// JWK is the JSON representation of a single public key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// Ed25519 keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set as served by JWKSHandler.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public half of the key.  HMAC keys have no public
+// half, and so the returned bool will be false for them.
+func (k *Key) JWK() (JWK, bool) {
+	switch p := k.verify.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: k.Algorithm(),
+			Kid: k.ID,
+			N:   b64(p.N.Bytes()),
+			E:   b64(big.NewInt(int64(p.E)).Bytes()),
+		}, true
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Use: "sig",
+			Alg: k.Algorithm(),
+			Kid: k.ID,
+			Crv: "Ed25519",
+			X:   b64(p),
+		}, true
+	}
+	return JWK{}, false
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of the key.
+func (j JWK) Thumbprint() string {
+	var canonical string
+	switch j.Kty {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, j.E, j.N)
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, j.Crv, j.X)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return b64(sum[:])
+}
+
+// JWKS returns the public halves of every asymmetric key known to the
+// issuer, including those that are only used for verification so
+// that tokens signed before a rotation remain verifiable downstream.
+func (i *Issuer) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, k := range i.keys {
+		if jwk, ok := k.JWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+// JWKSHandler serves the JWKS document so that downstream services
+// can verify tokens without sharing any secrets.  It is
+// conventionally mounted at /.well-known/jwks.json.
+func (i *Issuer) JWKSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		if err := json.NewEncoder(w).Encode(i.JWKS()); err != nil {
+			slog.Warn("Error writing JWKS", "error", err)
+		}
+	})
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
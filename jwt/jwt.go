@@ -0,0 +1,337 @@
+package jwt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	jwtlib "github.com/golang-jwt/jwt/v5"
+
+	"github.com/the-maldridge/authware"
+)
+
+// Config contains the settings for an Issuer.
+type Config struct {
+	// Issuer is placed in the "iss" claim of minted tokens, and
+	// when set, tokens with any other issuer are rejected.
+	Issuer string `mapstructure:"issuer"`
+
+	// Audience is placed in the "aud" claim of minted tokens, and
+	// when set, tokens must name at least one of the audiences to
+	// be accepted.
+	Audience []string `mapstructure:"audience"`
+
+	// Lifetime is how long minted tokens remain valid.  It
+	// defaults to 1 hour.
+	Lifetime time.Duration `mapstructure:"lifetime"`
+
+	// Leeway is the clock skew tolerated when checking exp and
+	// nbf.
+	Leeway time.Duration `mapstructure:"leeway"`
+
+	// KeyFile is a PEM file holding the signing key.  If it holds
+	// only a public key, the issuer can verify but not mint.
+	KeyFile string `mapstructure:"key_file"`
+
+	// Secret is an HS256 secret that is used when KeyFile is not
+	// set.
+	Secret string `mapstructure:"secret"`
+
+	// VerifyKeyFiles lists PEM files holding keys that are still
+	// accepted but no longer used to sign, such as the previous
+	// key after a rotation.
+	VerifyKeyFiles []string `mapstructure:"verify_key_files"`
+
+	// Keys may be set by programs that construct their keys
+	// directly, in which case the file and secret settings are
+	// ignored.  The first key is used to sign.
+	Keys []*Key `mapstructure:"-"`
+}
+
+// Claims are the claims carried by the tokens that an Issuer mints.
+// The subject holds the user's Identity.
+type Claims struct {
+	Groups   []string `json:"groups,omitempty"`
+	AuthedBy string   `json:"authed_by,omitempty"`
+	jwtlib.RegisteredClaims
+}
+
+// Issuer mints and validates tokens.
+type Issuer struct {
+	issuer   string
+	audience []string
+	lifetime time.Duration
+
+	keys   []*Key
+	parser *jwtlib.Parser
+}
+
+// ConfigFromEnv obtains the issuer configuration from
+// AUTHWARE_JWT_ISSUER, AUTHWARE_JWT_AUDIENCE (comma separated),
+// AUTHWARE_JWT_LIFETIME, AUTHWARE_JWT_LEEWAY, AUTHWARE_JWT_KEY_FILE,
+// AUTHWARE_JWT_SECRET, and AUTHWARE_JWT_VERIFY_KEY_FILES (colon
+// separated).
+func ConfigFromEnv() Config {
+	cfg := Config{
+		Issuer:  os.Getenv("AUTHWARE_JWT_ISSUER"),
+		KeyFile: os.Getenv("AUTHWARE_JWT_KEY_FILE"),
+		Secret:  os.Getenv("AUTHWARE_JWT_SECRET"),
+	}
+	if aud := os.Getenv("AUTHWARE_JWT_AUDIENCE"); aud != "" {
+		cfg.Audience = strings.Split(aud, ",")
+	}
+	if files := os.Getenv("AUTHWARE_JWT_VERIFY_KEY_FILES"); files != "" {
+		cfg.VerifyKeyFiles = strings.Split(files, ":")
+	}
+	for key, d := range map[string]*time.Duration{
+		"AUTHWARE_JWT_LIFETIME": &cfg.Lifetime,
+		"AUTHWARE_JWT_LEEWAY":   &cfg.Leeway,
+	} {
+		v := os.Getenv(key)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			slog.Warn("Ignoring unparseable duration", "key", key, "error", err)
+			continue
+		}
+		*d = parsed
+	}
+	return cfg
+}
+
+// New returns an issuer for the given config.  The returned value
+// implements authware.TokenAuthenticator, and so may also be passed
+// to authware.WithTokenAuthenticators to accept minted tokens in
+// BearerHandler and MultiAuthHandler.
+func New(cfg Config) (*Issuer, error) {
+	if cfg.Lifetime == 0 {
+		cfg.Lifetime = time.Hour
+	}
+
+	keys := cfg.Keys
+	if len(keys) == 0 {
+		switch {
+		case cfg.KeyFile != "":
+			k, err := LoadKey("", cfg.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, k)
+		case cfg.Secret != "":
+			k, err := NewHMACKey("", []byte(cfg.Secret))
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, k)
+		default:
+			slog.Error("Missing required config value", "key", "KeyFile")
+			return nil, errors.New("must specify a JWT key file or secret")
+		}
+		for _, f := range cfg.VerifyKeyFiles {
+			k, err := LoadKey("", f)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, k)
+		}
+	}
+
+	var methods []string
+	for _, k := range keys {
+		if !slices.Contains(methods, k.Algorithm()) {
+			methods = append(methods, k.Algorithm())
+		}
+	}
+
+	popts := []jwtlib.ParserOption{
+		jwtlib.WithValidMethods(methods),
+		jwtlib.WithExpirationRequired(),
+		jwtlib.WithLeeway(cfg.Leeway),
+	}
+	if cfg.Issuer != "" {
+		popts = append(popts, jwtlib.WithIssuer(cfg.Issuer))
+	}
+	if len(cfg.Audience) > 0 {
+		popts = append(popts, jwtlib.WithAudience(cfg.Audience...))
+	}
+
+	x := &Issuer{
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+		lifetime: cfg.Lifetime,
+		keys:     keys,
+		parser:   jwtlib.NewParser(popts...),
+	}
+	slog.Info("Initialized", "jwt", cfg.Issuer, "alg", keys[0].Algorithm(), "kid", keys[0].ID)
+	return x, nil
+}
+
+// Mint returns a token for the user, and the time at which it
+// expires.
+func (i *Issuer) Mint(u authware.User) (string, time.Time, error) {
+	now := time.Now()
+	exp := now.Add(i.lifetime)
+
+	groups := make([]string, 0, len(u.Groups))
+	for g := range u.Groups {
+		groups = append(groups, g)
+	}
+	slices.Sort(groups)
+
+	c := Claims{
+		Groups:   groups,
+		AuthedBy: u.AuthedBy,
+		RegisteredClaims: jwtlib.RegisteredClaims{
+			Issuer:    i.issuer,
+			Subject:   u.Identity,
+			Audience:  i.audience,
+			ExpiresAt: jwtlib.NewNumericDate(exp),
+			NotBefore: jwtlib.NewNumericDate(now),
+			IssuedAt:  jwtlib.NewNumericDate(now),
+			ID:        rand.Text(),
+		},
+	}
+	token, err := i.Sign(c)
+	return token, exp, err
+}
+
+// Algorithm returns the JWS algorithm used to sign tokens.
+func (i *Issuer) Algorithm() string {
+	return i.keys[0].Algorithm()
+}
+
+// Sign signs an arbitrary set of claims with the issuer's signing
+// key.  Most callers want Mint instead.
+func (i *Issuer) Sign(c jwtlib.Claims) (string, error) {
+	k := i.keys[0]
+	if !k.CanSign() {
+		return "", errors.New("the JWT signing key has no private part")
+	}
+	t := jwtlib.NewWithClaims(k.method, c)
+	if k.ID != "" {
+		t.Header["kid"] = k.ID
+	}
+	return t.SignedString(k.sign)
+}
+
+// Validate checks the signature, exp, nbf, iss, and aud of a token
+// and returns the user it was minted for.
+func (i *Issuer) Validate(token string) (authware.User, error) {
+	var c Claims
+	if _, err := i.parser.ParseWithClaims(token, &c, i.keyFunc); err != nil {
+		slog.Debug("Rejecting JWT", "error", err)
+		return authware.User{}, new(authware.ErrUnauthenticated)
+	}
+	if c.Subject == "" {
+		slog.Debug("Rejecting JWT with no subject")
+		return authware.User{}, new(authware.ErrUnauthenticated)
+	}
+
+	u := authware.User{
+		Identity: c.Subject,
+		Groups:   make(map[string]struct{}, len(c.Groups)),
+		AuthedBy: c.AuthedBy,
+	}
+	for _, g := range c.Groups {
+		u.Groups[g] = struct{}{}
+	}
+	return u, nil
+}
+
+// AuthToken satisfies authware.TokenAuthenticator.  Note that the
+// BearerHandler records "jwt" as the backend rather than the one
+// named in the token.
+func (i *Issuer) AuthToken(_ context.Context, token string) (authware.User, error) {
+	return i.Validate(token)
+}
+
+// Name satisfies authware.TokenAuthenticator.
+func (i *Issuer) Name() string { return "jwt" }
+
+// JWTHandler authenticates requests that carry a token minted by the
+// issuer in an "Authorization: Bearer" header.  Unlike when the
+// issuer is used through BasicMiddleware.BearerHandler, the AuthedBy
+// field of the User is the backend that originally authenticated the
+// user.
+func (i *Issuer) JWTHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			slog.Debug("Received request with no bearer token", "url", r.URL.String())
+			w.Header().Set("WWW-Authenticate", `Bearer realm="restricted"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Bearer Token Required")
+			return
+		}
+
+		user, err := i.Validate(strings.TrimSpace(token))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="restricted", error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Access Denied")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(authware.WithUser(r.Context(), user)))
+	})
+}
+
+// IssueHandler mints a token for the user in the request context and
+// returns it as JSON in the same shape as an OAuth 2.0 token
+// response.  It must be placed behind one of the authenticating
+// handlers, for example MultiAuthHandler.
+func (i *Issuer) IssueHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := authware.UserFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Authentication Required")
+			return
+		}
+
+		token, _, err := i.Mint(user)
+		if err != nil {
+			slog.Error("Error minting JWT", "user", user.Identity, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "Internal Server Error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			AccessToken string `json:"access_token"`
+			TokenType   string `json:"token_type"`
+			ExpiresIn   int    `json:"expires_in"`
+		}{token, "Bearer", int(i.lifetime.Seconds())})
+	})
+}
+
+// keyFunc offers every key that uses the token's algorithm and, if
+// the token names a key, has a matching ID.
+func (i *Issuer) keyFunc(t *jwtlib.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	var set jwtlib.VerificationKeySet
+	for _, k := range i.keys {
+		if k.Algorithm() != t.Method.Alg() {
+			continue
+		}
+		if kid != "" && k.ID != "" && k.ID != kid {
+			continue
+		}
+		set.Keys = append(set.Keys, k.verify)
+	}
+	if len(set.Keys) == 0 {
+		return nil, fmt.Errorf("no key found for kid %q", kid)
+	}
+	return set, nil
+}
@@ -0,0 +1,266 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwtlib "github.com/golang-jwt/jwt/v5"
+
+	"github.com/the-maldridge/authware"
+)
+
+var alice = authware.User{Identity: "alice", Groups: map[string]struct{}{"staff": {}}, AuthedBy: "htpasswd"}
+
+func newEd25519(t *testing.T, id string) *Key {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewEd25519Key(id, priv)
+}
+
+func newIssuer(t *testing.T, cfg Config) *Issuer {
+	t.Helper()
+	if cfg.Issuer == "" {
+		cfg.Issuer = "https://auth.example.com"
+	}
+	if cfg.Audience == nil {
+		cfg.Audience = []string{"app"}
+	}
+	i, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func claimsFor(i *Issuer, exp time.Time) Claims {
+	return Claims{
+		RegisteredClaims: jwtlib.RegisteredClaims{
+			Issuer:    i.issuer,
+			Subject:   "alice",
+			Audience:  i.audience,
+			ExpiresAt: jwtlib.NewNumericDate(exp),
+		},
+	}
+}
+
+func TestMintValidate(t *testing.T) {
+	i := newIssuer(t, Config{Keys: []*Key{newEd25519(t, "")}})
+	token, exp, err := i.Mint(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(exp) <= 0 || time.Until(exp) > time.Hour {
+		t.Errorf("token expires at %s", exp)
+	}
+	u, err := i.Validate(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Identity != "alice" || !u.HasGroup("staff") || u.AuthedBy != "htpasswd" {
+		t.Errorf("unexpected user %+v", u)
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	key := newEd25519(t, "")
+	i := newIssuer(t, Config{Keys: []*Key{key}})
+	hour := time.Now().Add(time.Hour)
+
+	sign := func(t *testing.T, cfg Config, c jwtlib.Claims) string {
+		t.Helper()
+		cfg.Keys = []*Key{key}
+		token, err := newIssuer(t, cfg).Sign(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	none := func(t *testing.T) string {
+		t.Helper()
+		token, err := jwtlib.NewWithClaims(jwtlib.SigningMethodNone, claimsFor(i, hour)).SignedString(jwtlib.UnsafeAllowNoneSignatureType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	other := newIssuer(t, Config{Issuer: "https://evil.example.com", Audience: []string{"other"}, Keys: []*Key{key}})
+	cases := []struct {
+		name  string
+		token func(t *testing.T) string
+	}{
+		{"none", none},
+		{"wrong issuer", func(t *testing.T) string {
+			c := claimsFor(other, hour)
+			c.Audience = i.audience
+			return sign(t, Config{}, c)
+		}},
+		{"wrong audience", func(t *testing.T) string {
+			c := claimsFor(other, hour)
+			c.Issuer = i.issuer
+			return sign(t, Config{}, c)
+		}},
+		{"expired", func(t *testing.T) string {
+			return sign(t, Config{}, claimsFor(i, time.Now().Add(-time.Minute)))
+		}},
+		{"no expiry", func(t *testing.T) string {
+			c := claimsFor(i, hour)
+			c.ExpiresAt = nil
+			return sign(t, Config{}, c)
+		}},
+		{"not yet valid", func(t *testing.T) string {
+			c := claimsFor(i, hour)
+			c.NotBefore = jwtlib.NewNumericDate(time.Now().Add(time.Minute))
+			return sign(t, Config{}, c)
+		}},
+		{"no subject", func(t *testing.T) string {
+			c := claimsFor(i, hour)
+			c.Subject = ""
+			return sign(t, Config{}, c)
+		}},
+		{"other key", func(t *testing.T) string {
+			token, err := newIssuer(t, Config{Keys: []*Key{newEd25519(t, key.ID)}}).Sign(claimsFor(i, hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return token
+		}},
+		{"tampered", func(t *testing.T) string {
+			token := sign(t, Config{}, claimsFor(i, hour))
+			return token[:len(token)-4] + "AAAA"
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := i.Validate(c.token(t)); err == nil {
+				t.Error("token was accepted")
+			}
+		})
+	}
+}
+
+func TestValidateAlgorithmMismatch(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewRSAKey("", priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := newIssuer(t, Config{Keys: []*Key{key}})
+	c := claimsFor(i, time.Now().Add(time.Hour))
+
+	// A token signed with HS256 using the public key as the
+	// secret must not be verified as though it were HMAC.
+	pub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: must(x509.MarshalPKIXPublicKey(&priv.PublicKey))})
+	for _, secret := range [][]byte{pub, priv.PublicKey.N.Bytes()} {
+		hs := jwtlib.NewWithClaims(jwtlib.SigningMethodHS256, c)
+		hs.Header["kid"] = key.ID
+		token, err := hs.SignedString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := i.Validate(token); err == nil {
+			t.Error("HS256 token was accepted by an RS256 issuer")
+		}
+	}
+
+	// Nor may a token be signed with a different asymmetric
+	// algorithm.
+	ed := newEd25519(t, key.ID)
+	token, err := jwtlib.NewWithClaims(jwtlib.SigningMethodEdDSA, c).SignedString(ed.sign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Validate(token); err == nil {
+		t.Error("EdDSA token was accepted by an RS256 issuer")
+	}
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func TestKeySelection(t *testing.T) {
+	current := newEd25519(t, "current")
+	previous := newEd25519(t, "previous")
+	pub, err := NewPublicKey("previous", previous.verify)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := newIssuer(t, Config{Keys: []*Key{current, pub}})
+	old := newIssuer(t, Config{Keys: []*Key{previous}})
+
+	// Tokens from before the rotation are still accepted, and
+	// new ones are signed with the current key.
+	token, _, err := old.Mint(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Validate(token); err != nil {
+		t.Errorf("token signed with the previous key was rejected: %v", err)
+	}
+	token, _, err = i.Mint(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, err := jwtlib.NewParser().ParseUnverified(token, &Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header["kid"] != "current" {
+		t.Errorf("token was signed with %v", parsed.Header["kid"])
+	}
+
+	// A kid selects the key, so a token naming one key but
+	// signed with another is rejected, as is an unknown kid.
+	for _, kid := range []string{"previous", "unknown"} {
+		k := *current
+		k.ID = kid
+		token, err := newIssuer(t, Config{Keys: []*Key{&k}}).Sign(claimsFor(i, time.Now().Add(time.Hour)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := i.Validate(token); err == nil {
+			t.Errorf("token signed with the current key but naming %q was accepted", kid)
+		}
+	}
+
+	// Both keys are published.
+	w := httptest.NewRecorder()
+	i.JWKSHandler().ServeHTTP(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	var set JWKS
+	if err := json.NewDecoder(w.Body).Decode(&set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 2 || set.Keys[0].Kid != "current" || set.Keys[1].Kid != "previous" {
+		t.Errorf("unexpected JWKS %+v", set)
+	}
+}
+
+func TestHMACKeyNotPublished(t *testing.T) {
+	k, err := NewHMACKey("", []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := k.JWK(); ok {
+		t.Error("HMAC key has a public half")
+	}
+	if _, err := NewHMACKey("", []byte("short")); err == nil {
+		t.Error("short HMAC secret was accepted")
+	}
+}
@@ -0,0 +1,134 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	jwtlib "github.com/golang-jwt/jwt/v5"
+)
+
+// Key is a key that can verify, and if it holds private material,
+// sign tokens.  HMAC keys use HS256, RSA keys use RS256, and Ed25519
+// keys use EdDSA.
+type Key struct {
+	// ID is sent as the "kid" header of tokens signed by the key
+	// and published in the JWKS document.  Asymmetric keys that
+	// are created without an ID use their RFC 7638 thumbprint.
+	ID string
+
+	method jwtlib.SigningMethod
+	sign   any
+	verify any
+}
+
+// NewHMACKey returns a key that signs with HS256.  Every service that
+// verifies the tokens must hold the same secret, and the key is never
+// published in the JWKS document.
+func NewHMACKey(id string, secret []byte) (*Key, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("HMAC secrets must be at least 32 bytes")
+	}
+	return &Key{ID: id, method: jwtlib.SigningMethodHS256, sign: secret, verify: secret}, nil
+}
+
+// NewRSAKey returns a key that signs with RS256.
+func NewRSAKey(id string, k *rsa.PrivateKey) (*Key, error) {
+	if k.N.BitLen() < 2048 {
+		return nil, errors.New("RSA keys must be at least 2048 bits")
+	}
+	x := &Key{ID: id, method: jwtlib.SigningMethodRS256, sign: k, verify: &k.PublicKey}
+	x.defaultID()
+	return x, nil
+}
+
+// NewEd25519Key returns a key that signs with EdDSA.
+func NewEd25519Key(id string, k ed25519.PrivateKey) *Key {
+	x := &Key{ID: id, method: jwtlib.SigningMethodEdDSA, sign: k, verify: k.Public()}
+	x.defaultID()
+	return x
+}
+
+// NewPublicKey returns a key that can only verify tokens.  This is
+// how a downstream service would hold the keys of the service that
+// issues its tokens.
+func NewPublicKey(id string, pub crypto.PublicKey) (*Key, error) {
+	var x *Key
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		x = &Key{ID: id, method: jwtlib.SigningMethodRS256, verify: p}
+	case ed25519.PublicKey:
+		x = &Key{ID: id, method: jwtlib.SigningMethodEdDSA, verify: p}
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+	x.defaultID()
+	return x, nil
+}
+
+// LoadKey reads a PEM encoded key from the named file.  The file may
+// contain an RSA or Ed25519 private key in PKCS #8 form, an RSA
+// private key in PKCS #1 form, or a public key in PKIX form.
+func LoadKey(id, file string) (*Key, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", file)
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		return NewPublicKey(id, pub)
+	case "RSA PRIVATE KEY":
+		k, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		return NewRSAKey(id, k)
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		switch k := k.(type) {
+		case *rsa.PrivateKey:
+			return NewRSAKey(id, k)
+		case ed25519.PrivateKey:
+			return NewEd25519Key(id, k), nil
+		}
+		return nil, fmt.Errorf("%s: unsupported private key type %T", file, k)
+	}
+	return nil, fmt.Errorf("%s: unsupported PEM block %q", file, block.Type)
+}
+
+// Algorithm returns the JWS algorithm used by the key.
+func (k *Key) Algorithm() string {
+	return k.method.Alg()
+}
+
+// CanSign reports whether the key holds the material needed to sign
+// tokens.
+func (k *Key) CanSign() bool {
+	return k.sign != nil
+}
+
+func (k *Key) defaultID() {
+	if k.ID != "" {
+		return
+	}
+	if jwk, ok := k.JWK(); ok {
+		k.ID = jwk.Thumbprint()
+	}
+}
@@ -0,0 +1,150 @@
+package authware
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/meehow/securebytes"
+)
+
+// Keyring holds the keys that protect session cookies.  New cookies
+// are always encrypted with the active key, but cookies encrypted
+// with any key on the ring are accepted.  This allows keys to be
+// rotated without invalidating every session that is in flight.
+type Keyring struct {
+	file string
+
+	mu       sync.RWMutex
+	active   *securebytes.SecureBytes
+	previous []*securebytes.SecureBytes
+}
+
+// NewKeyring returns a keyring that encrypts with the active key and
+// additionally accepts any of the previous keys for decryption.
+func NewKeyring(active []byte, previous ...[]byte) *Keyring {
+	k := new(Keyring)
+	k.set(active, previous)
+	return k
+}
+
+// LoadKeyring reads keys from the named file, one per line.  The
+// first key in the file is the active key, and all keys after it are
+// accepted for decryption only.  Blank lines and lines starting with
+// # are ignored.  The file is reloaded when the process receives
+// SIGHUP, so a key can be rotated by adding a new key to the top of
+// the file and signaling the process.
+func LoadKeyring(file string) (*Keyring, error) {
+	k := &Keyring{file: file}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+
+	rChan := make(chan os.Signal, 1)
+	signal.Notify(rChan, syscall.SIGHUP)
+
+	go func() {
+		for {
+			<-rChan
+			if err := k.Reload(); err != nil {
+				slog.Warn("Error reloading session keys, keeping previous keys", "error", err)
+				continue
+			}
+			slog.Info("Reloaded session keys", "file", k.file)
+		}
+	}()
+
+	slog.Info("Initialized", "keyring", file)
+	return k, nil
+}
+
+// Reload re-reads the keyring from its file.  Keyrings that were not
+// loaded from a file cannot be reloaded.
+func (k *Keyring) Reload() error {
+	if k.file == "" {
+		return errors.New("keyring was not loaded from a file")
+	}
+
+	f, err := os.Open(k.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var keys [][]byte
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		keys = append(keys, bytes.Clone(line))
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("keyring file contains no keys")
+	}
+
+	k.set(keys[0], keys[1:])
+	return nil
+}
+
+// Rotate makes key the new active key.  The previously active key is
+// retained for decryption so that existing sessions remain valid.
+func (k *Keyring) Rotate(key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.active != nil {
+		k.previous = append([]*securebytes.SecureBytes{k.active}, k.previous...)
+	}
+	k.active = newSecureBytes(key)
+}
+
+// EncryptToBase64 encrypts and encodes v with the active key.
+func (k *Keyring) EncryptToBase64(v any) (string, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active.EncryptToBase64(v)
+}
+
+// DecryptBase64 decodes and decrypts s into v, trying each key on the
+// ring in turn, starting with the active key.
+func (k *Keyring) DecryptBase64(s string, v any) error {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	err := k.active.DecryptBase64(s, v)
+	for _, sb := range k.previous {
+		if err == nil {
+			break
+		}
+		err = sb.DecryptBase64(s, v)
+	}
+	return err
+}
+
+func (k *Keyring) set(active []byte, previous [][]byte) {
+	sbs := make([]*securebytes.SecureBytes, len(previous))
+	for i := range previous {
+		sbs[i] = newSecureBytes(previous[i])
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.active = newSecureBytes(active)
+	k.previous = sbs
+}
+
+func newSecureBytes(key []byte) *securebytes.SecureBytes {
+	if len(key) < 32 {
+		slog.Warn("Session key is shorter than 32 bytes and may be guessable")
+	}
+	return securebytes.New(key, securebytes.JSONSerializer{})
+}
@@ -0,0 +1,98 @@
+package authware
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	oldKey = []byte("0123456789abcdef0123456789abcdef")
+	newKey = []byte("fedcba9876543210fedcba9876543210")
+)
+
+// opens returns true if a keyring holding only key can decrypt s.
+func opens(key []byte, s string) bool {
+	var v string
+	return NewKeyring(key).DecryptBase64(s, &v) == nil && v == "payload"
+}
+
+func TestKeyringRotate(t *testing.T) {
+	k := NewKeyring(oldKey)
+	before, err := k.EncryptToBase64("payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k.Rotate(newKey)
+	var v string
+	if err := k.DecryptBase64(before, &v); err != nil || v != "payload" {
+		t.Errorf("data sealed before the rotation did not open: %v", err)
+	}
+
+	after, err := k.EncryptToBase64("payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opens(newKey, after) || opens(oldKey, after) {
+		t.Error("data sealed after the rotation was not sealed with the new key")
+	}
+
+	if err := NewKeyring(newKey).DecryptBase64(before, &v); err == nil {
+		t.Error("a keyring without the old key opened data sealed with it")
+	}
+}
+
+func TestKeyringFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys")
+	write := func(text string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("# session keys\n\n" + string(oldKey) + "\n")
+	k, err := LoadKeyring(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := k.EncryptToBase64("payload")
+
+	// Adding a key to the top of the file makes it active and
+	// keeps the old one for decryption.
+	write(string(newKey) + "\n" + string(oldKey) + "\n")
+	if err := k.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	var v string
+	if err := k.DecryptBase64(before, &v); err != nil {
+		t.Errorf("data sealed with the previous key did not open: %v", err)
+	}
+	after, _ := k.EncryptToBase64("payload")
+	if !opens(newKey, after) {
+		t.Error("data was not sealed with the first key in the file")
+	}
+
+	// Once the old key is removed its data no longer opens.
+	write(string(newKey) + "\n")
+	if err := k.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.DecryptBase64(before, &v); err == nil {
+		t.Error("data sealed with a removed key still opened")
+	}
+
+	// An empty file is refused and the keys are kept.
+	write("# nothing here\n")
+	if err := k.Reload(); err == nil {
+		t.Error("empty keyring file was accepted")
+	}
+	if err := k.DecryptBase64(after, &v); err != nil {
+		t.Errorf("keys were lost after a failed reload: %v", err)
+	}
+
+	if err := NewKeyring(oldKey).Reload(); err == nil {
+		t.Error("keyring without a file was reloaded")
+	}
+}
@@ -1,12 +1,11 @@
 package authware
 
 import (
-	"context"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"net/url"
-	"os"
+	"strconv"
 	"time"
 )
 
@@ -15,86 +14,122 @@ import (
 func (b *BasicMiddleware) LoginHandler(loginPath string) func(http.Handler) http.Handler {
 	b.cookieHandler = func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			loginURL := url.URL{Path: loginPath}
-			nextPath := r.URL.EscapedPath()
-			q := loginURL.Query()
-			q.Add("next", nextPath)
-			loginURL.RawQuery = q.Encode()
 			// Check if a cookie exists and if its valid
-			var session Session
-			cookie, err := r.Cookie("session")
+			session, err := b.loadSession(r)
 			if err != nil {
-				http.Redirect(w, r, loginURL.String(), http.StatusSeeOther)
-				return
-			}
-			if err = b.sb.DecryptBase64(cookie.Value, &session); err != nil {
-				http.Redirect(w, r, loginURL.String(), http.StatusSeeOther)
-				return
-			}
-			if time.Now().After(session.Expires) {
-				// Session Expired
-				http.Redirect(w, r, loginURL.String(), http.StatusSeeOther)
+				http.Redirect(w, r, b.loginURL(loginPath, r, 0), http.StatusSeeOther)
 				return
 			}
+			b.refreshSession(w, r, session)
 
 			// Serve the rest of the chain with the user in the
 			// request context.
-			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), UserKey{}, session.User)))
+			next.ServeHTTP(w, r.WithContext(withSession(r.Context(), session)))
 		})
 	}
 	return b.cookieHandler
 }
 
+// MaxAgeParam is the query parameter that RequireRecentAuth adds to
+// the login path, giving in seconds how recently the user must have
+// authenticated.  Login handlers that defer to an identity provider
+// pass it on, as the oidc backend does.
+const MaxAgeParam = "max_age"
+
+// RecentAuthAge is how recently users must have logged in to replace
+// their second factor or issue new recovery codes.  Applications that
+// send users to log in again before they do so, for example with
+// RequireRecentAuth, should ask for the same age.
+const RecentAuthAge = 10 * time.Minute
+
+// loginURL returns the login path with a next parameter that will
+// bring the user back to the current request, and a max age if one
+// is required.
+func (b *BasicMiddleware) loginURL(loginPath string, r *http.Request, maxAge time.Duration) string {
+	loginURL := url.URL{Path: loginPath}
+	q := loginURL.Query()
+	if nextPath := b.safeNext(r.URL.RequestURI(), ""); nextPath != "" {
+		q.Add("next", nextPath)
+	}
+	if maxAge > 0 {
+		q.Add(MaxAgeParam, strconv.Itoa(int(maxAge.Seconds())))
+	}
+	loginURL.RawQuery = q.Encode()
+	return loginURL.String()
+}
+
+// RequireRecentAuth guards sensitive routes, such as those that
+// delete data, by requiring that the user logged in within the last
+// maxAge even though their session may be valid for longer.  Users
+// that logged in too long ago are sent to loginPath, which is
+// normally the same path given to LoginHandler, to log in again, and
+// then return here.  The redirect carries maxAge as MaxAgeParam.
+// Only sessions record when the user logged in, so requests
+// authenticated by any other means are sent to log in as well.
+func (b *BasicMiddleware) RequireRecentAuth(loginPath string, maxAge time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if b.RecentlyAuthenticated(r, maxAge) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			slog.Debug("Requesting reauthentication", "url", r.URL.String())
+			http.Redirect(w, r, b.loginURL(loginPath, r, maxAge), http.StatusSeeOther)
+		})
+	}
+}
+
+// RecentlyAuthenticated returns true if the request has a session
+// whose user logged in within the last maxAge.  Users that
+// EnrollmentHandler admitted have just presented their password, and
+// so are also counted as having logged in recently.
+func (b *BasicMiddleware) RecentlyAuthenticated(r *http.Request, maxAge time.Duration) bool {
+	var p pendingLogin
+	if err := b.peekFlowState(r, pendingFlow, &p); err == nil && p.Enroll {
+		if u, ok := UserFromContext(r.Context()); ok && u.Identity == p.User.Identity {
+			return true
+		}
+	}
+	session, err := b.loadSession(r)
+	return err == nil && time.Since(session.AuthTime) <= maxAge
+}
+
 // SessionHandler does the same verification that the LoginHandler
 // does, but without the redirect.
 func (b *BasicMiddleware) SessionHandler() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			var session Session
-			cookie, err := r.Cookie("session")
+			session, err := b.loadSession(r)
 			if err != nil {
 				next.ServeHTTP(w, r)
 				return
 			}
-			if err = b.sb.DecryptBase64(cookie.Value, &session); err != nil {
-				next.ServeHTTP(w, r)
-				return
-			}
-			if time.Now().After(session.Expires) {
-				// Session Expired
-				next.ServeHTTP(w, r)
-				return
-			}
+			b.refreshSession(w, r, session)
 
 			// Serve the rest of the chain with the user in the
 			// request context.
-			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), UserKey{}, session.User)))
+			next.ServeHTTP(w, r.WithContext(withSession(r.Context(), session)))
 		})
 	}
 }
 
 // LogoutHandler clears the cookie and sends the caller somewhere
-// else.
+// else.  If a SessionStore is configured the session is also removed
+// from the store, so the cookie cannot be replayed.
 func (b *BasicMiddleware) LogoutHandler(nextPath string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c := &http.Cookie{
-			Name:    "session",
-			Expires: time.Now().Add(time.Minute * -1),
-		}
-		http.SetCookie(w, c)
+		b.endSession(w, r)
 		http.Redirect(w, r, nextPath, http.StatusSeeOther)
 	}
 }
 
 // LoginFormHandler responds to the form submit and cookies the
-// request.
+// request.  Unless login CSRF protection has been disabled, the form
+// must include the token obtained from CSRFToken or CSRFField.  Users
+// that have enrolled in a second factor, such as TOTP, are instead
+// sent on to present it, and are only issued a session once they
+// have.
 func (b *BasicMiddleware) LoginFormHandler(userField, passField, defaultNext string) func(http.ResponseWriter, *http.Request) {
-	duration := os.Getenv("AUTHWARE_SESSION_LIFETIME")
-	if duration == "" {
-		duration = "1h"
-	}
-	sessionLifetime, _ := time.ParseDuration(duration)
-
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := r.ParseForm(); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
@@ -102,7 +137,18 @@ func (b *BasicMiddleware) LoginFormHandler(userField, passField, defaultNext str
 			return
 		}
 
-		user, err := b.authByUsernamePassword(r.Context(), r.FormValue(userField), r.FormValue(passField))
+		if b.loginCSRF && !b.checkCSRF(r) {
+			slog.Debug("Denying login with missing or invalid CSRF token")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, "Invalid CSRF Token")
+			return
+		}
+
+		user, err := b.authRateLimited(r, r.FormValue(userField), r.FormValue(passField), true)
+		if rl, ok := err.(ErrRateLimited); ok {
+			writeRateLimited(w, rl)
+			return
+		}
 		if err != nil {
 			slog.Debug("Denying request after no auth method matched")
 			w.WriteHeader(http.StatusUnauthorized)
@@ -110,28 +156,27 @@ func (b *BasicMiddleware) LoginFormHandler(userField, passField, defaultNext str
 			return
 		}
 
-		session := Session{
-			Expires: time.Now().Add(sessionLifetime),
-			User:    user,
+		next := b.safeNext(r.URL.Query().Get("next"), defaultNext)
+		pending, err := b.beginSecondFactor(w, r, user, next)
+		if _, ok := err.(ErrSecondFactorRequired); ok {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, "Second Factor Required")
+			return
 		}
-		b64, err := b.sb.EncryptToBase64(session)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
-			slog.Error("Error creating cookie", "error", err)
+			slog.Error("Error checking second factor", "user", user.Identity, "error", err)
 			return
 		}
-		cookie := &http.Cookie{
-			Name:     "session",
-			Value:    b64,
-			Path:     "/",
-			HttpOnly: true,
-			Expires:  time.Now().Add(sessionLifetime + time.Minute),
+		if pending != "" {
+			http.Redirect(w, r, pending, http.StatusSeeOther)
+			return
 		}
-		http.SetCookie(w, cookie)
-		next := r.URL.Query().Get("next")
-		if next == "" {
-			slog.Debug("Default value for next used on login")
-			next = defaultNext
+
+		if err := b.issueSession(w, r, user, time.Now(), []string{AMRPassword}); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			slog.Error("Error creating session", "error", err)
+			return
 		}
 		http.Redirect(w, r, next, http.StatusSeeOther)
 	}
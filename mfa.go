@@ -0,0 +1,167 @@
+package authware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// pendingFlow names the flow state that carries a login which has
+// passed the password step but still needs a second factor.
+const pendingFlow = "mfa"
+
+// defaultPendingLifetime is how long a user has to present a second
+// factor other than TOTP, which has its own setting.
+const defaultPendingLifetime = 5 * time.Minute
+
+// SecondFactor is a means of authentication that LoginFormHandler
+// asks for after a password has been accepted.  TOTP is provided by
+// WithTOTP, and other factors such as security keys are added with
+// AddSecondFactor.
+type SecondFactor interface {
+	// Enrolled returns true if the identity has registered this
+	// factor, and so must present it to log in.
+	Enrolled(ctx context.Context, identity string) (bool, error)
+
+	// Path is where users that must present this factor are sent
+	// once their password has been accepted.
+	Path() string
+}
+
+// pendingLogin is the partial session held by a user that has passed
+// the password step.  It is kept in flow state rather than in the
+// session cookie, so it is never accepted as a session.
+type pendingLogin struct {
+	User User
+	Next string
+
+	// Enroll is set when the user must enroll in a second factor
+	// before they can complete the login.
+	Enroll bool
+}
+
+// MFAPolicy decides which users must present a second factor when
+// they log in with a password.  Users that the policy does not cover
+// are still asked for any factor they have enrolled in.
+type MFAPolicy struct {
+	// Groups lists the groups whose members must use a second
+	// factor.  The group "*" includes every user.
+	Groups []string
+
+	// Exempt lists groups whose members are not required to use
+	// a second factor, even if they are also in Groups.
+	Exempt []string
+
+	// EnrollPath is where users that must use a second factor
+	// but have not enrolled in one are sent to do so.  The
+	// enrollment handlers there must be placed behind
+	// EnrollmentHandler.  If it is empty, such users cannot log
+	// in with a password until an administrator enrolls them.
+	EnrollPath string
+}
+
+// requires returns true if the policy requires the user to present a
+// second factor.
+func (p MFAPolicy) requires(u User) bool {
+	for _, g := range p.Exempt {
+		if _, ok := u.Groups[g]; ok {
+			return false
+		}
+	}
+	for _, g := range p.Groups {
+		if _, ok := u.Groups[g]; ok || g == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// AddSecondFactor offers an additional second factor to users of
+// LoginFormHandler.  Users enrolled in more than one factor are sent
+// to whichever was added first, with TOTP always coming first.  It
+// must be called before the middleware begins serving requests.
+func (b *BasicMiddleware) AddSecondFactor(f SecondFactor) {
+	b.factors = append(b.factors, f)
+}
+
+// beginSecondFactor checks whether the user must present a second
+// factor, and if so stores a pending login for them.  It returns the
+// path that the user should be sent to, or an empty string if they
+// should be issued a session straight away.  Users that the MFAPolicy
+// covers but have nothing to present are sent to enroll, or refused
+// with ErrSecondFactorRequired if there is nowhere to enroll.
+func (b *BasicMiddleware) beginSecondFactor(w http.ResponseWriter, r *http.Request, user User, next string) (string, error) {
+	for _, f := range b.factors {
+		enrolled, err := f.Enrolled(r.Context(), user.Identity)
+		if err != nil {
+			return "", err
+		}
+		if !enrolled {
+			continue
+		}
+
+		lifetime := defaultPendingLifetime
+		if tf, ok := f.(totpFactor); ok {
+			lifetime = tf.t.Lifetime
+		}
+		return f.Path(), b.SetFlowState(w, pendingFlow, pendingLogin{User: user, Next: next}, lifetime)
+	}
+
+	if !b.mfa.requires(user) {
+		return "", nil
+	}
+	if b.mfa.EnrollPath == "" {
+		slog.Info("Denying login for user that has not enrolled in a required second factor", "user", user.Identity)
+		return "", ErrSecondFactorRequired{}
+	}
+	p := pendingLogin{User: user, Next: next, Enroll: true}
+	return b.mfa.EnrollPath, b.SetFlowState(w, pendingFlow, p, enrollLifetime)
+}
+
+// EnrollmentHandler admits users that the MFAPolicy has sent to
+// enroll in a second factor, with the pending user in the request
+// context.  All other requests are passed to otherwise, which is
+// normally the middleware returned by LoginHandler, so the same
+// enrollment handlers serve users that already have a session.
+// Once enrolled, the user completes their login by presenting the
+// new factor.
+func (b *BasicMiddleware) EnrollmentHandler(otherwise Middleware) Middleware {
+	return func(next http.Handler) http.Handler {
+		fallback := otherwise(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var p pendingLogin
+			if err := b.peekFlowState(r, pendingFlow, &p); err != nil || !p.Enroll {
+				fallback.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), p.User)))
+		})
+	}
+}
+
+// PendingUser returns the user whose password has been accepted but
+// who has yet to present a second factor.  Handlers for a
+// SecondFactor use this to find out who they are verifying.
+func (b *BasicMiddleware) PendingUser(r *http.Request) (User, error) {
+	var p pendingLogin
+	if err := b.peekFlowState(r, pendingFlow, &p); err != nil {
+		return User{}, err
+	}
+	return p.User, nil
+}
+
+// CompletePendingLogin issues the session for the pending user once
+// they have presented a second factor, and returns where they should
+// be sent next.  The method is the AMR value of the second factor,
+// such as AMROneTimeCode.
+func (b *BasicMiddleware) CompletePendingLogin(w http.ResponseWriter, r *http.Request, method string) (string, error) {
+	var p pendingLogin
+	if err := b.TakeFlowState(w, r, pendingFlow, &p); err != nil {
+		return "", err
+	}
+	if err := b.issueSession(w, r, p.User, time.Now(), []string{AMRPassword, method, AMRMultiFactor}); err != nil {
+		return "", err
+	}
+	return p.Next, nil
+}
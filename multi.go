@@ -5,19 +5,55 @@ import (
 )
 
 // MultiAuthHandler tries to find a valid scheme and then perform auth
-// using a given middleware.
+// using a given middleware.  Headers from a trusted authenticating
+// proxy are checked first, then client certificates if they have been
+// enabled with WithClientCertAuth, followed by bearer tokens, basic
+// auth, and finally the session cookie.
 func (b *BasicMiddleware) MultiAuthHandler() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if _, _, ok := r.BasicAuth(); ok {
-				b.BasicHandler(next).ServeHTTP(w, r)
-				return
-			}
-			if _, err := r.Cookie("session"); err == nil {
+		return b.multiAuth(next, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := r.Cookie(b.cookie.Name); err == nil {
 				b.cookieHandler(next).ServeHTTP(w, r)
 				return
 			}
 			w.WriteHeader(http.StatusUnauthorized)
-		})
+		}))
+	}
+}
+
+// MultiAuthOrLoginHandler checks the same schemes as
+// MultiAuthHandler, but hands requests that carry none of them other
+// than a session cookie to LoginHandler, so that browsers are sent to
+// the login page instead of being refused.
+func (b *BasicMiddleware) MultiAuthOrLoginHandler(loginPath string) func(http.Handler) http.Handler {
+	login := b.LoginHandler(loginPath)
+	return func(next http.Handler) http.Handler {
+		return b.multiAuth(next, login(next))
 	}
 }
+
+// multiAuth serves next with the user from the first scheme that the
+// request carries, or serves fallback if it carries none.
+func (b *BasicMiddleware) multiAuth(next, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := b.headerUser(r); ok {
+			next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+			return
+		}
+		if b.clientCert != nil {
+			if user, ok := b.clientCertUser(r); ok {
+				next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+				return
+			}
+		}
+		if _, ok := bearerToken(r); ok {
+			b.BearerHandler(next).ServeHTTP(w, r)
+			return
+		}
+		if _, _, ok := r.BasicAuth(); ok {
+			b.BasicHandler(next).ServeHTTP(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,434 @@
+package authware
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An Option configures a BasicMiddleware during construction.
+type Option func(*options) error
+
+type options struct {
+	mechs            []string
+	authenticators   []Authenticator
+	tokenMechs       []string
+	tokens           []TokenAuthenticator
+	keyring          *Keyring
+	store            SessionStore
+	sessionLifetime  time.Duration
+	idleTimeout      time.Duration
+	refreshThreshold time.Duration
+	cookie           CookieOptions
+	redirect         RedirectOptions
+	loginCSRF        bool
+	limits           RateLimitOptions
+	cache            *CacheOptions
+	header           HeaderOptions
+	clientCert       *ClientCertOptions
+	totp             *TOTPOptions
+	recovery         *RecoveryOptions
+	mfa              MFAPolicy
+}
+
+func defaultOptions() options {
+	return options{
+		mechs:           []string{"htpasswd"},
+		sessionLifetime: time.Hour,
+		cookie:          defaultCookieOptions(),
+		loginCSRF:       true,
+	}
+}
+
+// FromEnv configures the middleware from the AUTHWARE_* environment
+// variables.  This is the configuration that is used if NewAuth is
+// called without any options.  Options that come after FromEnv
+// override values obtained from the environment.
+func FromEnv() Option {
+	return func(o *options) error {
+		ai, ok := os.LookupEnv("AUTHWARE_BASIC_MECHS")
+		authsList := strings.Split(ai, ":")
+		if len(authsList) == 0 || !ok {
+			authsList = []string{"htpasswd"}
+			slog.Warn("No auth mechanisms specified, defaulting to built in list", "list", authsList)
+		}
+		o.mechs = authsList
+		o.authenticators = nil
+
+		if ti := os.Getenv("AUTHWARE_BEARER_MECHS"); ti != "" {
+			o.tokenMechs = strings.Split(ti, ":")
+			o.tokens = nil
+		}
+
+		if kf := os.Getenv("AUTHWARE_SESSION_KEY_FILE"); kf != "" {
+			k, err := LoadKeyring(kf)
+			if err != nil {
+				slog.Error("Could not load session keys", "key", "AUTHWARE_SESSION_KEY_FILE", "error", err)
+				return err
+			}
+			o.keyring = k
+		} else if sk := os.Getenv("AUTHWARE_SESSION_KEY"); sk != "" {
+			o.keyring = NewKeyring([]byte(sk))
+		}
+
+		if duration := os.Getenv("AUTHWARE_SESSION_LIFETIME"); duration != "" {
+			d, err := time.ParseDuration(duration)
+			if err != nil {
+				slog.Error("Invalid session lifetime", "key", "AUTHWARE_SESSION_LIFETIME", "error", err)
+				return err
+			}
+			o.sessionLifetime = d
+		}
+
+		if duration := os.Getenv("AUTHWARE_SESSION_IDLE_TIMEOUT"); duration != "" {
+			d, err := time.ParseDuration(duration)
+			if err != nil {
+				slog.Error("Invalid idle timeout", "key", "AUTHWARE_SESSION_IDLE_TIMEOUT", "error", err)
+				return err
+			}
+			o.idleTimeout = d
+		}
+
+		if duration := os.Getenv("AUTHWARE_SESSION_REFRESH_THRESHOLD"); duration != "" {
+			d, err := time.ParseDuration(duration)
+			if err != nil {
+				slog.Error("Invalid refresh threshold", "key", "AUTHWARE_SESSION_REFRESH_THRESHOLD", "error", err)
+				return err
+			}
+			o.refreshThreshold = d
+		}
+
+		if name := os.Getenv("AUTHWARE_COOKIE_NAME"); name != "" {
+			o.cookie.Name = name
+		}
+		if domain := os.Getenv("AUTHWARE_COOKIE_DOMAIN"); domain != "" {
+			o.cookie.Domain = domain
+		}
+		if path := os.Getenv("AUTHWARE_COOKIE_PATH"); path != "" {
+			o.cookie.Path = path
+		}
+		if secure := os.Getenv("AUTHWARE_COOKIE_SECURE"); secure != "" {
+			b, err := strconv.ParseBool(secure)
+			if err != nil {
+				slog.Error("Invalid cookie secure flag", "key", "AUTHWARE_COOKIE_SECURE", "error", err)
+				return err
+			}
+			o.cookie.Secure = b
+		}
+		if ss := os.Getenv("AUTHWARE_COOKIE_SAMESITE"); ss != "" {
+			mode, err := ParseSameSite(ss)
+			if err != nil {
+				slog.Error("Invalid cookie SameSite mode", "key", "AUTHWARE_COOKIE_SAMESITE", "error", err)
+				return err
+			}
+			o.cookie.SameSite = mode
+		}
+		if partitioned := os.Getenv("AUTHWARE_COOKIE_PARTITIONED"); partitioned != "" {
+			b, err := strconv.ParseBool(partitioned)
+			if err != nil {
+				slog.Error("Invalid cookie partitioned flag", "key", "AUTHWARE_COOKIE_PARTITIONED", "error", err)
+				return err
+			}
+			o.cookie.Partitioned = b
+		}
+		if hosts := os.Getenv("AUTHWARE_REDIRECT_HOSTS"); hosts != "" {
+			o.redirect.AllowedHosts = strings.Split(hosts, ",")
+		}
+		if lc := os.Getenv("AUTHWARE_LOGIN_CSRF"); lc != "" {
+			b, err := strconv.ParseBool(lc)
+			if err != nil {
+				slog.Error("Invalid login CSRF flag", "key", "AUTHWARE_LOGIN_CSRF", "error", err)
+				return err
+			}
+			o.loginCSRF = b
+		}
+		if rl := os.Getenv("AUTHWARE_RATELIMIT_DISABLED"); rl != "" {
+			b, err := strconv.ParseBool(rl)
+			if err != nil {
+				slog.Error("Invalid rate limit flag", "key", "AUTHWARE_RATELIMIT_DISABLED", "error", err)
+				return err
+			}
+			o.limits.Disabled = b
+		}
+		if ttl := os.Getenv("AUTHWARE_CACHE_TTL"); ttl != "" {
+			d, err := time.ParseDuration(ttl)
+			if err != nil {
+				slog.Error("Invalid cache TTL", "key", "AUTHWARE_CACHE_TTL", "error", err)
+				return err
+			}
+			o.cache = &CacheOptions{TTL: d}
+		}
+		if groups := os.Getenv("AUTHWARE_MFA_GROUPS"); groups != "" {
+			o.mfa.Groups = strings.Split(groups, ",")
+		}
+		if exempt := os.Getenv("AUTHWARE_MFA_EXEMPT_GROUPS"); exempt != "" {
+			o.mfa.Exempt = strings.Split(exempt, ",")
+		}
+		o.mfa.EnrollPath = os.Getenv("AUTHWARE_MFA_ENROLL_PATH")
+		if proxies := os.Getenv("AUTHWARE_HEADER_TRUSTED_PROXIES"); proxies != "" {
+			p, err := ParseTrustedProxies(strings.Split(proxies, ",")...)
+			if err != nil {
+				slog.Error("Invalid trusted proxy", "key", "AUTHWARE_HEADER_TRUSTED_PROXIES", "error", err)
+				return err
+			}
+			o.header.TrustedProxies = p
+			o.header.UserHeader = os.Getenv("AUTHWARE_HEADER_USER")
+			o.header.GroupsHeader = os.Getenv("AUTHWARE_HEADER_GROUPS")
+		}
+		if id := os.Getenv("AUTHWARE_CLIENTCERT_IDENTITY"); id != "" {
+			c := &ClientCertOptions{
+				Identity:        id,
+				URIPrefix:       os.Getenv("AUTHWARE_CLIENTCERT_URI_PREFIX"),
+				ForwardedHeader: os.Getenv("AUTHWARE_CLIENTCERT_HEADER"),
+			}
+			if proxies := os.Getenv("AUTHWARE_CLIENTCERT_TRUSTED_PROXIES"); proxies != "" {
+				p, err := ParseTrustedProxies(strings.Split(proxies, ",")...)
+				if err != nil {
+					slog.Error("Invalid trusted proxy", "key", "AUTHWARE_CLIENTCERT_TRUSTED_PROXIES", "error", err)
+					return err
+				}
+				c.ForwardedProxies = p
+			}
+			if ca := os.Getenv("AUTHWARE_CLIENTCERT_CA_FILE"); ca != "" {
+				pool, err := LoadCertPool(ca)
+				if err != nil {
+					slog.Error("Could not load client CA file", "key", "AUTHWARE_CLIENTCERT_CA_FILE", "error", err)
+					return err
+				}
+				c.ForwardedRoots = pool
+			}
+			if err := WithClientCertAuth(*c)(o); err != nil {
+				return err
+			}
+		}
+		return o.cookie.validate()
+	}
+}
+
+// WithMechanisms sets the names of the mechanisms that will be
+// initialized from the registered factories, in the order they will
+// be tried.
+func WithMechanisms(mechs ...string) Option {
+	return func(o *options) error {
+		o.mechs = mechs
+		o.authenticators = nil
+		return nil
+	}
+}
+
+// WithAuthenticators provides an already initialized chain of
+// authenticators.  This bypasses the factory registry entirely, and
+// is the way to run multiple middlewares with differently configured
+// backends in the same process.
+func WithAuthenticators(a ...Authenticator) Option {
+	return func(o *options) error {
+		o.authenticators = a
+		o.mechs = nil
+		return nil
+	}
+}
+
+// WithTokenMechanisms sets the names of the mechanisms used to
+// authenticate bearer tokens.  The mechanisms are initialized from the
+// registered factories, and must implement TokenAuthenticator.
+func WithTokenMechanisms(mechs ...string) Option {
+	return func(o *options) error {
+		o.tokenMechs = mechs
+		o.tokens = nil
+		return nil
+	}
+}
+
+// WithTokenAuthenticators provides an already initialized chain of
+// token authenticators, bypassing the factory registry.
+func WithTokenAuthenticators(t ...TokenAuthenticator) Option {
+	return func(o *options) error {
+		o.tokens = t
+		o.tokenMechs = nil
+		return nil
+	}
+}
+
+// WithSessionKey sets the key that is used to encrypt session
+// cookies.
+func WithSessionKey(key []byte) Option {
+	return func(o *options) error {
+		o.keyring = NewKeyring(key)
+		return nil
+	}
+}
+
+// WithKeyring sets the keyring that is used to encrypt and decrypt
+// session cookies.  Use this instead of WithSessionKey when keys need
+// to be rotated.
+func WithKeyring(k *Keyring) Option {
+	return func(o *options) error {
+		o.keyring = k
+		return nil
+	}
+}
+
+// WithSessionLifetime sets how long a session issued by the login
+// form remains valid.  If an idle timeout is also set, this is the
+// absolute limit beyond which a session cannot be extended.
+func WithSessionLifetime(d time.Duration) Option {
+	return func(o *options) error {
+		o.sessionLifetime = d
+		return nil
+	}
+}
+
+// WithSessionStore keeps sessions on the server in the given store,
+// rather than entirely within the cookie.  This allows sessions to be
+// revoked before they expire.
+func WithSessionStore(s SessionStore) Option {
+	return func(o *options) error {
+		o.store = s
+		return nil
+	}
+}
+
+// WithIdleTimeout enables sliding sessions.  A session that goes
+// unused for longer than d expires, while a session that continues
+// to be used is extended up to the session lifetime.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(o *options) error {
+		o.idleTimeout = d
+		return nil
+	}
+}
+
+// WithRefreshThreshold sets how close to expiry a sliding session
+// must be before its cookie is re-issued with a later expiry.
+// Refreshing less often avoids setting a cookie on every request.
+// It defaults to half the idle timeout.
+func WithRefreshThreshold(d time.Duration) Option {
+	return func(o *options) error {
+		o.refreshThreshold = d
+		return nil
+	}
+}
+
+// WithCookieOptions sets the attributes of the session cookie.  Empty
+// Name, Path, and SameSite fields take their default values.
+func WithCookieOptions(c CookieOptions) Option {
+	return func(o *options) error {
+		def := defaultCookieOptions()
+		if c.Name == "" {
+			c.Name = def.Name
+		}
+		if c.Path == "" {
+			c.Path = def.Path
+		}
+		if c.SameSite == 0 {
+			c.SameSite = def.SameSite
+		}
+		if err := c.validate(); err != nil {
+			return err
+		}
+		o.cookie = c
+		return nil
+	}
+}
+
+// WithRedirectOptions controls which targets the login flow will
+// redirect to.  By default only local paths are permitted.
+func WithRedirectOptions(r RedirectOptions) Option {
+	return func(o *options) error {
+		o.redirect = r
+		return nil
+	}
+}
+
+// WithLoginCSRF controls whether the login form requires a CSRF
+// token.  It is enabled by default, and should only be disabled for
+// login forms that cannot be changed to include the token.
+func WithLoginCSRF(enabled bool) Option {
+	return func(o *options) error {
+		o.loginCSRF = enabled
+		return nil
+	}
+}
+
+// WithRateLimit controls how repeated authentication failures are
+// slowed down.  Rate limiting is enabled by default with an in-memory
+// counter store.
+func WithRateLimit(r RateLimitOptions) Option {
+	return func(o *options) error {
+		o.limits = r
+		return nil
+	}
+}
+
+// WithCache remembers the results of the authenticator chain using
+// the given options, as a CachingAuthenticator would for a single
+// backend.
+func WithCache(c CacheOptions) Option {
+	return func(o *options) error {
+		o.cache = &c
+		return nil
+	}
+}
+
+// WithHeaderAuth trusts the identity asserted in headers by an
+// authenticating proxy, for requests that arrive from one of the
+// trusted proxy networks.
+func WithHeaderAuth(h HeaderOptions) Option {
+	return func(o *options) error {
+		o.header = h
+		return nil
+	}
+}
+
+// WithClientCertAuth enables authentication by client certificate in
+// MultiAuthHandler, and configures ClientCertHandler.
+func WithClientCertAuth(c ClientCertOptions) Option {
+	return func(o *options) error {
+		switch c.Identity {
+		case "", CertIdentityCN, CertIdentityEmail, CertIdentityURI:
+		default:
+			return fmt.Errorf("unknown client certificate identity %q", c.Identity)
+		}
+		o.clientCert = &c
+		return nil
+	}
+}
+
+// WithTOTP enables TOTP as a second factor for LoginFormHandler.
+// Users that have enrolled must present a code at TOTPOptions.Path
+// before their session is issued.
+func WithTOTP(t TOTPOptions) Option {
+	return func(o *options) error {
+		if t.Store == nil {
+			return errors.New("TOTP requires a Store")
+		}
+		o.totp = &t
+		return nil
+	}
+}
+
+// WithRecoveryCodes enables recovery codes, which users may present
+// to RecoveryFormHandler in place of their second factor.
+func WithRecoveryCodes(rc RecoveryOptions) Option {
+	return func(o *options) error {
+		if rc.Store == nil {
+			return errors.New("recovery codes require a Store")
+		}
+		o.recovery = &rc
+		return nil
+	}
+}
+
+// WithMFAPolicy sets which users must present a second factor when
+// they log in with a password.  Those users can no longer
+// authenticate with HTTP Basic auth.
+func WithMFAPolicy(p MFAPolicy) Option {
+	return func(o *options) error {
+		o.mfa = p
+		return nil
+	}
+}
@@ -0,0 +1,268 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/viper"
+
+	"github.com/the-maldridge/authware"
+)
+
+// Rule maps a path pattern and optionally a set of methods to the
+// requirements that a user must satisfy to access it.  Within each
+// of Groups, Identities, and Backends it is sufficient for the user
+// to match any one entry, but every list that is non-empty must be
+// matched.
+type Rule struct {
+	// Path is either a pattern as understood by path.Match, or a
+	// prefix ending in "/**" which matches the prefix itself and
+	// everything underneath it.
+	Path string `mapstructure:"path"`
+
+	// Methods restricts the rule to the listed HTTP methods.  If
+	// empty, the rule applies to all methods.
+	Methods []string `mapstructure:"methods"`
+
+	// Public rules admit requests that have no user at all.
+	Public bool `mapstructure:"public"`
+
+	Groups     []string `mapstructure:"groups"`
+	Identities []string `mapstructure:"identities"`
+	Backends   []string `mapstructure:"backends"`
+}
+
+// Policy is the on-disk representation of a set of rules.  Rules are
+// evaluated in order, and the first rule that matches the request is
+// the only one that is considered.
+type Policy struct {
+	// Default is either "allow" or "deny" and is applied to
+	// requests that no rule matches.  It defaults to "deny".
+	Default string `mapstructure:"default"`
+
+	// DryRun causes requests that would be denied to be logged
+	// and then allowed to proceed anyway.
+	DryRun bool `mapstructure:"dry_run"`
+
+	Rules []Rule `mapstructure:"rules"`
+}
+
+// Decision is the result of evaluating a request against a Policy.
+type Decision int
+
+const (
+	// Allow indicates the request may proceed.
+	Allow Decision = iota
+
+	// DenyUnauthenticated indicates that the request did not
+	// carry a user, but a user is required.
+	DenyUnauthenticated
+
+	// DenyForbidden indicates that the request carried a user,
+	// but the user does not satisfy the matched rule.
+	DenyForbidden
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Allow:
+		return "allow"
+	case DenyUnauthenticated:
+		return "deny-unauthenticated"
+	case DenyForbidden:
+		return "deny-forbidden"
+	}
+	return "unknown"
+}
+
+// Engine evaluates requests against a Policy loaded from a file.  The
+// file is reloaded whenever the process receives SIGHUP.
+type Engine struct {
+	file string
+
+	mu sync.RWMutex
+	p  Policy
+}
+
+// New loads the policy from the named file, which may be in any
+// format understood by viper, and returns an engine ready to be
+// placed in the handler chain.  If file is empty, the value of
+// AUTHWARE_POLICY_FILE is used instead.
+func New(file string) (*Engine, error) {
+	if file == "" {
+		file = os.Getenv("AUTHWARE_POLICY_FILE")
+	}
+	if file == "" {
+		slog.Error("Missing required config value", "key", "AUTHWARE_POLICY_FILE")
+		return nil, errors.New("must specify a policy file")
+	}
+
+	e := &Engine{file: file}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+
+	rChan := make(chan os.Signal, 1)
+	signal.Notify(rChan, syscall.SIGHUP)
+
+	go func() {
+		for {
+			<-rChan
+			if err := e.Reload(); err != nil {
+				slog.Warn("Error reloading policy, keeping previous policy", "error", err)
+				continue
+			}
+			slog.Info("Reloaded policy", "file", e.file)
+		}
+	}()
+
+	slog.Info("Initialized", "policy", e.file)
+	return e, nil
+}
+
+// Reload reads the policy file again and atomically swaps it in if
+// it is valid.  If the file cannot be loaded the previous policy
+// remains in effect.
+func (e *Engine) Reload() error {
+	v := viper.New()
+	v.SetConfigFile(e.file)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+
+	var p Policy
+	if err := v.UnmarshalExact(&p); err != nil {
+		return err
+	}
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.p = p
+	e.mu.Unlock()
+	return nil
+}
+
+// Evaluate determines what should happen to a request.  The user is
+// read from the request context, and so Evaluate must be called
+// after one of the authenticating handlers has had a chance to run.
+func (e *Engine) Evaluate(r *http.Request) Decision {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	user, authed := authware.UserFromContext(r.Context())
+	for _, rule := range e.p.Rules {
+		if !rule.matches(r) {
+			continue
+		}
+		if rule.Public {
+			return Allow
+		}
+		if !authed {
+			return DenyUnauthenticated
+		}
+		if !rule.admits(user) {
+			return DenyForbidden
+		}
+		return Allow
+	}
+
+	if e.p.Default == "allow" {
+		return Allow
+	}
+	if !authed {
+		return DenyUnauthenticated
+	}
+	return DenyForbidden
+}
+
+// Handler is a middleware that enforces the policy.
+func (e *Engine) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := e.Evaluate(r)
+		if d == Allow {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		e.mu.RLock()
+		dryRun := e.p.DryRun
+		e.mu.RUnlock()
+		if dryRun {
+			slog.Info("Policy would deny request", "method", r.Method, "url", r.URL.String(), "decision", d)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		slog.Debug("Policy denied request", "method", r.Method, "url", r.URL.String(), "decision", d)
+		switch d {
+		case DenyUnauthenticated:
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Authentication Required")
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, "Forbidden")
+		}
+	})
+}
+
+func (p *Policy) validate() error {
+	p.Default = strings.ToLower(p.Default)
+	switch p.Default {
+	case "":
+		p.Default = "deny"
+	case "allow", "deny":
+	default:
+		return fmt.Errorf("default: must be one of allow or deny, got %q", p.Default)
+	}
+
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Path == "" {
+			return fmt.Errorf("rules[%d].path: must not be empty", i)
+		}
+		if _, err := path.Match(strings.TrimSuffix(r.Path, "/**"), ""); err != nil {
+			return fmt.Errorf("rules[%d].path: %w", i, err)
+		}
+		for j := range r.Methods {
+			r.Methods[j] = strings.ToUpper(r.Methods[j])
+		}
+	}
+	return nil
+}
+
+func (r Rule) matches(req *http.Request) bool {
+	if len(r.Methods) > 0 && !slices.Contains(r.Methods, req.Method) {
+		return false
+	}
+
+	p := req.URL.Path
+	if prefix, ok := strings.CutSuffix(r.Path, "/**"); ok {
+		return p == prefix || strings.HasPrefix(p, prefix+"/")
+	}
+	match, _ := path.Match(r.Path, p)
+	return match
+}
+
+func (r Rule) admits(u authware.User) bool {
+	if len(r.Identities) > 0 && !slices.Contains(r.Identities, u.Identity) {
+		return false
+	}
+	if len(r.Backends) > 0 && !slices.Contains(r.Backends, u.AuthedBy) {
+		return false
+	}
+	if len(r.Groups) > 0 && !u.InAnyGroup(r.Groups...) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,198 @@
+package policy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/the-maldridge/authware"
+)
+
+const testPolicy = `
+default: deny
+rules:
+  - path: /public/**
+    public: true
+  - path: /admin/audit
+    methods: [get]
+    groups: [auditors]
+  - path: /admin/**
+    groups: [admins]
+  - path: /api/*
+    identities: [alice, bob]
+    backends: [htpasswd]
+`
+
+func writePolicy(t *testing.T, file, text string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newEngine(t *testing.T, text string) (*Engine, string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	writePolicy(t, file, text)
+	e, err := New(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, file
+}
+
+func request(method, target string, user *authware.User) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	if user != nil {
+		r = r.WithContext(authware.WithUser(r.Context(), *user))
+	}
+	return r
+}
+
+func user(identity, backend string, groups ...string) *authware.User {
+	u := &authware.User{Identity: identity, AuthedBy: backend, Groups: make(map[string]struct{})}
+	for _, g := range groups {
+		u.Groups[g] = struct{}{}
+	}
+	return u
+}
+
+func TestEvaluate(t *testing.T) {
+	e, _ := newEngine(t, testPolicy)
+
+	auditor := user("carol", "ldap", "auditors")
+	admin := user("dave", "ldap", "admins")
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		user   *authware.User
+		want   Decision
+	}{
+		{"public prefix", "GET", "/public", nil, Allow},
+		{"public below prefix", "POST", "/public/a/b", nil, Allow},
+		{"not the prefix", "GET", "/publicity", nil, DenyUnauthenticated},
+
+		// The first matching rule is the only one considered,
+		// so auditors may read the audit log even though the
+		// rule for /admin/** would refuse them, and admins may
+		// not even though it would admit them.
+		{"first match admits", "GET", "/admin/audit", auditor, Allow},
+		{"first match refuses", "GET", "/admin/audit", admin, DenyForbidden},
+		{"method falls through", "POST", "/admin/audit", auditor, DenyForbidden},
+		{"method falls through to admins", "POST", "/admin/audit", admin, Allow},
+		{"admins", "GET", "/admin/users", admin, Allow},
+		{"no user", "GET", "/admin/users", nil, DenyUnauthenticated},
+
+		{"identity and backend", "GET", "/api/x", user("alice", "htpasswd"), Allow},
+		{"wrong backend", "GET", "/api/x", user("alice", "ldap"), DenyForbidden},
+		{"wrong identity", "GET", "/api/x", user("mallory", "htpasswd"), DenyForbidden},
+		{"glob does not cross slashes", "GET", "/api/x/y", user("alice", "htpasswd"), DenyForbidden},
+
+		{"default deny", "GET", "/other", admin, DenyForbidden},
+		{"default deny without user", "GET", "/other", nil, DenyUnauthenticated},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := e.Evaluate(request(c.method, c.path, c.user)); got != c.want {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	serve := func(e *Engine, r *http.Request) int {
+		w := httptest.NewRecorder()
+		e.Handler(ok).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	e, _ := newEngine(t, testPolicy)
+	if code := serve(e, request("GET", "/admin/users", nil)); code != http.StatusUnauthorized {
+		t.Errorf("no user returned %d", code)
+	}
+	if code := serve(e, request("GET", "/admin/users", user("eve", "ldap"))); code != http.StatusForbidden {
+		t.Errorf("forbidden user returned %d", code)
+	}
+	if code := serve(e, request("GET", "/public/x", nil)); code != http.StatusNoContent {
+		t.Errorf("public path returned %d", code)
+	}
+
+	// A dry run lets denied requests through.
+	dry, _ := newEngine(t, "dry_run: true\n"+testPolicy)
+	if code := serve(dry, request("GET", "/admin/users", nil)); code != http.StatusNoContent {
+		t.Errorf("dry run returned %d", code)
+	}
+}
+
+func TestDefaultAllow(t *testing.T) {
+	e, _ := newEngine(t, "default: Allow\n")
+	if got := e.Evaluate(request("GET", "/anything", nil)); got != Allow {
+		t.Errorf("got %s with a default of allow", got)
+	}
+}
+
+func TestReload(t *testing.T) {
+	e, file := newEngine(t, testPolicy)
+	admin := user("dave", "ldap", "admins")
+
+	bad := []string{
+		"default: maybe\n",
+		"rules:\n  - methods: [get]\n",
+		"rules:\n  - path: \"/[\"\n",
+		"unknown_key: true\n",
+		"rules: [\n",
+	}
+	for _, text := range bad {
+		writePolicy(t, file, text)
+		if err := e.Reload(); err == nil {
+			t.Errorf("policy %q was accepted", text)
+		}
+		if got := e.Evaluate(request("GET", "/admin/users", admin)); got != Allow {
+			t.Errorf("after rejecting %q, got %s from the previous policy", text, got)
+		}
+	}
+
+	writePolicy(t, file, "default: deny\n")
+	if err := e.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.Evaluate(request("GET", "/admin/users", admin)); got != DenyForbidden {
+		t.Errorf("new policy was not applied, got %s", got)
+	}
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	e, file := newEngine(t, "default: deny\n")
+	writePolicy(t, file, "default: allow\n")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Evaluate(request("GET", "/", nil)) != Allow {
+		if time.Now().After(deadline) {
+			t.Fatal("policy was not reloaded after SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewRejectsBadPolicy(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	writePolicy(t, file, "default: maybe\n")
+	if _, err := New(file); err == nil {
+		t.Error("invalid policy was accepted")
+	}
+	if _, err := New(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing policy file was accepted")
+	}
+}
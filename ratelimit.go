@@ -0,0 +1,325 @@
+package authware
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CounterStore keeps track of failed login attempts for the rate
+// limiter.  Keys are opaque strings derived from identities and
+// client addresses.
+type CounterStore interface {
+	// Incr records a failure against the key and returns the new
+	// number of failures.  Failures are forgotten once the key
+	// has not been incremented for the given ttl.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int, error)
+
+	// Get returns the number of failures recorded against the
+	// key and the time of the most recent one.
+	Get(ctx context.Context, key string) (int, time.Time, error)
+
+	// Reserve counts an attempt that has not been made yet, in
+	// the same way as Incr but without changing the time of the
+	// most recent failure, and returns the new count.
+	Reserve(ctx context.Context, key string, ttl time.Duration) (int, error)
+
+	// Decr takes back one attempt counted by Reserve.  It does
+	// nothing if the key has no failures.
+	Decr(ctx context.Context, key string) error
+
+	// Reset forgets all failures recorded against the key.
+	Reset(ctx context.Context, key string) error
+}
+
+// RateLimitOptions controls how repeated login failures are slowed
+// down.  Once a key has accumulated its threshold of failures, each
+// further attempt is locked out for a delay that doubles with every
+// failure, up to MaxDelay.
+type RateLimitOptions struct {
+	// IdentityThreshold is the number of failures permitted for
+	// a single identity before lockouts begin.  Defaults to 5.
+	IdentityThreshold int
+
+	// IPThreshold is the number of failures permitted from a
+	// single client address before lockouts begin.  This is
+	// higher than the identity threshold by default since many
+	// users may share an address.  Defaults to 20.
+	IPThreshold int
+
+	// BaseDelay is the lockout after the threshold is reached.
+	// Defaults to 1 second.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the lockout.  Defaults to 15 minutes.
+	MaxDelay time.Duration
+
+	// Window is how long failures are remembered after the last
+	// one.  Defaults to 1 hour.
+	Window time.Duration
+
+	// Store keeps the failure counts.  Defaults to an in-memory
+	// store, which is not shared between processes.
+	Store CounterStore
+
+	// Disabled turns off rate limiting entirely.
+	Disabled bool
+}
+
+func (o *RateLimitOptions) setDefaults() {
+	if o.IdentityThreshold <= 0 {
+		o.IdentityThreshold = 5
+	}
+	if o.IPThreshold <= 0 {
+		o.IPThreshold = 20
+	}
+	if o.BaseDelay <= 0 {
+		o.BaseDelay = time.Second
+	}
+	if o.MaxDelay <= 0 {
+		o.MaxDelay = 15 * time.Minute
+	}
+	if o.Window <= 0 {
+		o.Window = time.Hour
+	}
+	if o.Store == nil {
+		o.Store = newMemoryCounters()
+	}
+}
+
+// delay returns how long a key with the given number of failures is
+// locked out after its most recent failure.
+func (o RateLimitOptions) delay(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	d := float64(o.BaseDelay) * math.Pow(2, float64(failures-threshold))
+	if d > float64(o.MaxDelay) {
+		return o.MaxDelay
+	}
+	return time.Duration(d)
+}
+
+type limitKey struct {
+	key       string
+	threshold int
+}
+
+func (b *BasicMiddleware) ipLimitKey(r *http.Request) limitKey {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return limitKey{key: "ip:" + ip, threshold: b.limits.IPThreshold}
+}
+
+func (b *BasicMiddleware) identityLimitKey(identity string) limitKey {
+	return limitKey{key: "identity:" + identity, threshold: b.limits.IdentityThreshold}
+}
+
+// authRateLimited wraps authByUsernamePassword with the rate limiter.
+// If the identity or client is currently locked out, no backend is
+// consulted and ErrRateLimited is returned.  Callers that cannot go on
+// to ask for a second factor pass false for secondFactor, and users
+// that the MFAPolicy requires to present one are then refused with
+// ErrSecondFactorRequired.
+func (b *BasicMiddleware) authRateLimited(r *http.Request, user, pass string, secondFactor bool) (User, error) {
+	// Only the identity is reset on success, otherwise an
+	// attacker with one valid account could clear the counter
+	// for their address.
+	id := b.identityLimitKey(user)
+	u, err := b.rateLimited(r, []limitKey{id, b.ipLimitKey(r)}, &id, func() (User, error) {
+		return b.authByUsernamePassword(r.Context(), user, pass)
+	})
+	if err == nil && !secondFactor && b.mfa.requires(u) {
+		slog.Info("Denying password only login for user that must use a second factor", "user", u.Identity)
+		return User{}, ErrSecondFactorRequired{}
+	}
+	return u, err
+}
+
+// rateLimited performs an authentication attempt if none of the keys
+// are locked out, and records a failure against every key if the
+// attempt fails.  On success the reset key, if any, is cleared.
+//
+// Keys that are already at or past their threshold are reserved
+// before the attempt is made, so that once a lockout ends concurrent
+// attempts cannot all go ahead together: only the first to reserve
+// the key may.  Reservations do not move the time of the most recent
+// failure, and are taken back if the attempt succeeds.  Keys below
+// their threshold are only counted once an attempt has failed, so
+// that concurrent attempts with valid credentials are never refused.
+func (b *BasicMiddleware) rateLimited(r *http.Request, keys []limitKey, reset *limitKey, attempt func() (User, error)) (User, error) {
+	if b.limits.Disabled {
+		return attempt()
+	}
+
+	ctx := r.Context()
+	seen := make([]int, len(keys))
+	var wait time.Duration
+	for i, k := range keys {
+		failures, last, err := b.limits.Store.Get(ctx, k.key)
+		if err != nil {
+			slog.Warn("Error reading rate limit counter", "error", err)
+			continue
+		}
+		seen[i] = failures
+		wait = max(wait, time.Until(last.Add(b.limits.delay(failures, k.threshold))))
+	}
+	if wait > 0 {
+		slog.Info("Rate limiting authentication", "remote", r.RemoteAddr, "retry", wait)
+		return User{}, ErrRateLimited{RetryAfter: wait}
+	}
+
+	var reserved []limitKey
+	for i, k := range keys {
+		if seen[i] < k.threshold {
+			continue
+		}
+		n, err := b.limits.Store.Reserve(ctx, k.key, b.limits.Window)
+		if err != nil {
+			slog.Warn("Error reserving rate limit counter", "error", err)
+			continue
+		}
+		reserved = append(reserved, k)
+		if n-1 > seen[i] {
+			wait = max(wait, b.limits.delay(n-1, k.threshold))
+		}
+	}
+	if wait > 0 {
+		b.release(ctx, reserved)
+		slog.Info("Rate limiting concurrent authentication", "remote", r.RemoteAddr, "retry", wait)
+		return User{}, ErrRateLimited{RetryAfter: wait}
+	}
+
+	u, err := attempt()
+	if err != nil {
+		// The failure is recorded before the reservation is
+		// taken back so that the count never drops below it.
+		for _, k := range keys {
+			if _, err := b.limits.Store.Incr(ctx, k.key, b.limits.Window); err != nil {
+				slog.Warn("Error incrementing rate limit counter", "error", err)
+			}
+		}
+		b.release(ctx, reserved)
+		return User{}, err
+	}
+	if reset != nil {
+		if err := b.limits.Store.Reset(ctx, reset.key); err != nil {
+			slog.Warn("Error resetting rate limit counter", "error", err)
+		}
+		reserved = slices.DeleteFunc(reserved, func(k limitKey) bool { return k.key == reset.key })
+	}
+	b.release(ctx, reserved)
+	return u, nil
+}
+
+// release takes back attempts that were reserved.
+func (b *BasicMiddleware) release(ctx context.Context, keys []limitKey) {
+	for _, k := range keys {
+		if err := b.limits.Store.Decr(ctx, k.key); err != nil {
+			slog.Warn("Error decrementing rate limit counter", "error", err)
+		}
+	}
+}
+
+// writeRateLimited responds to a request that has been rate limited.
+func writeRateLimited(w http.ResponseWriter, err ErrRateLimited) {
+	secs := int(math.Ceil(err.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintln(w, "Too Many Attempts")
+}
+
+type counter struct {
+	n       int
+	last    time.Time
+	expires time.Time
+}
+
+// memoryCounters is the default CounterStore.
+type memoryCounters struct {
+	mu        sync.Mutex
+	c         map[string]counter
+	lastSweep time.Time
+}
+
+func newMemoryCounters() *memoryCounters {
+	return &memoryCounters{c: make(map[string]counter), lastSweep: time.Now()}
+}
+
+func (m *memoryCounters) Incr(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	return m.incr(key, ttl, true)
+}
+
+func (m *memoryCounters) Reserve(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	return m.incr(key, ttl, false)
+}
+
+func (m *memoryCounters) incr(key string, ttl time.Duration, failed bool) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.lastSweep) > time.Minute {
+		for k, c := range m.c {
+			if now.After(c.expires) {
+				delete(m.c, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	c := m.c[key]
+	if now.After(c.expires) {
+		c = counter{}
+	}
+	c.n++
+	if failed {
+		c.last = now
+	}
+	c.expires = now.Add(ttl)
+	m.c[key] = c
+	return c.n, nil
+}
+
+func (m *memoryCounters) Get(ctx context.Context, key string) (int, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.c[key]
+	if !ok || time.Now().After(c.expires) {
+		return 0, time.Time{}, nil
+	}
+	return c.n, c.last, nil
+}
+
+func (m *memoryCounters) Decr(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.c[key]
+	if !ok {
+		return nil
+	}
+	if c.n--; c.n <= 0 {
+		delete(m.c, key)
+		return nil
+	}
+	m.c[key] = c
+	return nil
+}
+
+func (m *memoryCounters) Reset(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.c, key)
+	return nil
+}
@@ -0,0 +1,204 @@
+package authware
+
+import (
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newRateLimited(t *testing.T, opts RateLimitOptions) *BasicMiddleware {
+	t.Helper()
+	b, err := NewAuth(WithAuthenticators(), WithRateLimit(opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func fail() (User, error)    { return User{}, ErrUnauthenticated{} }
+func succeed() (User, error) { return User{Identity: "alice"}, nil }
+
+func TestRateLimitThreshold(t *testing.T) {
+	b := newRateLimited(t, RateLimitOptions{IdentityThreshold: 3, BaseDelay: time.Minute})
+	r := httptest.NewRequest("POST", "/login", nil)
+	id := b.identityLimitKey("alice")
+
+	for i := 0; i < 3; i++ {
+		if _, err := b.rateLimited(r, []limitKey{id}, &id, fail); !errors.Is(err, ErrUnauthenticated{}) {
+			t.Fatalf("attempt %d: expected the attempt to be made, got %v", i, err)
+		}
+	}
+	_, err := b.rateLimited(r, []limitKey{id}, &id, func() (User, error) {
+		t.Error("attempt was made while locked out")
+		return succeed()
+	})
+	var rl ErrRateLimited
+	if !errors.As(err, &rl) || rl.RetryAfter <= 0 || rl.RetryAfter > time.Minute {
+		t.Errorf("expected a lockout of up to a minute, got %v", err)
+	}
+}
+
+func TestRateLimitBackoff(t *testing.T) {
+	o := RateLimitOptions{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	cases := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{4, 0},
+		{5, time.Second},
+		{6, 2 * time.Second},
+		{8, 8 * time.Second},
+		{9, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, c := range cases {
+		if got := o.delay(c.failures, 5); got != c.want {
+			t.Errorf("delay(%d) = %s, want %s", c.failures, got, c.want)
+		}
+	}
+
+	// Each failure after the threshold doubles the lockout.
+	b := newRateLimited(t, RateLimitOptions{IdentityThreshold: 1, BaseDelay: 20 * time.Millisecond})
+	r := httptest.NewRequest("POST", "/login", nil)
+	id := b.identityLimitKey("alice")
+	b.rateLimited(r, []limitKey{id}, &id, fail)
+	time.Sleep(25 * time.Millisecond)
+	b.rateLimited(r, []limitKey{id}, &id, fail)
+
+	var rl ErrRateLimited
+	if _, err := b.rateLimited(r, []limitKey{id}, &id, succeed); !errors.As(err, &rl) || rl.RetryAfter <= 20*time.Millisecond {
+		t.Errorf("expected a lockout of about 40ms, got %v", err)
+	}
+}
+
+func TestRateLimitReset(t *testing.T) {
+	b := newRateLimited(t, RateLimitOptions{IdentityThreshold: 3, IPThreshold: 3, BaseDelay: time.Minute})
+	r := httptest.NewRequest("POST", "/login", nil)
+	id := b.identityLimitKey("alice")
+	ip := b.ipLimitKey(r)
+	ctx := r.Context()
+
+	b.rateLimited(r, []limitKey{id, ip}, &id, fail)
+	b.rateLimited(r, []limitKey{id, ip}, &id, fail)
+	if _, err := b.rateLimited(r, []limitKey{id, ip}, &id, succeed); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _, _ := b.limits.Store.Get(ctx, id.key); n != 0 {
+		t.Errorf("identity has %d failures after a success", n)
+	}
+	// The address keeps its failures, but the success is not
+	// counted against it.
+	if n, _, _ := b.limits.Store.Get(ctx, ip.key); n != 2 {
+		t.Errorf("address has %d failures, want 2", n)
+	}
+}
+
+func TestRateLimitConcurrent(t *testing.T) {
+	b := newRateLimited(t, RateLimitOptions{IdentityThreshold: 3, BaseDelay: 20 * time.Millisecond})
+	r := httptest.NewRequest("POST", "/login", nil)
+	id := b.identityLimitKey("alice")
+	for i := 0; i < 3; i++ {
+		b.rateLimited(r, []limitKey{id}, &id, fail)
+	}
+	time.Sleep(25 * time.Millisecond)
+
+	// Once the lockout ends only one of many concurrent guesses
+	// may be made.
+	var attempts atomic.Int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			b.rateLimited(r, []limitKey{id}, &id, func() (User, error) {
+				attempts.Add(1)
+				time.Sleep(10 * time.Millisecond)
+				return fail()
+			})
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("%d attempts were made after the lockout ended", n)
+	}
+	if n, _, _ := b.limits.Store.Get(r.Context(), id.key); n != 4 {
+		t.Errorf("counted %d failures, want 4", n)
+	}
+}
+
+func TestRateLimitConcurrentValid(t *testing.T) {
+	b := newRateLimited(t, RateLimitOptions{IdentityThreshold: 5, IPThreshold: 20, BaseDelay: time.Minute})
+	r := httptest.NewRequest("POST", "/login", nil)
+	id := b.identityLimitKey("alice")
+	ip := b.ipLimitKey(r)
+
+	var refused atomic.Int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := b.rateLimited(r, []limitKey{id, ip}, &id, func() (User, error) {
+				time.Sleep(10 * time.Millisecond)
+				return succeed()
+			})
+			if err != nil {
+				refused.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if n := refused.Load(); n != 0 {
+		t.Errorf("%d concurrent attempts with valid credentials were refused", n)
+	}
+	for _, k := range []limitKey{id, ip} {
+		if n, _, _ := b.limits.Store.Get(r.Context(), k.key); n != 0 {
+			t.Errorf("%s has %d failures after only successes", k.key, n)
+		}
+	}
+}
+
+func TestRateLimitSuccessDuringLockout(t *testing.T) {
+	b := newRateLimited(t, RateLimitOptions{IPThreshold: 2, BaseDelay: 50 * time.Millisecond})
+	r := httptest.NewRequest("POST", "/login", nil)
+	bob := b.identityLimitKey("bob")
+	ip := b.ipLimitKey(r)
+	ctx := r.Context()
+
+	b.rateLimited(r, []limitKey{bob, ip}, &bob, fail)
+	b.rateLimited(r, []limitKey{bob, ip}, &bob, fail)
+	time.Sleep(60 * time.Millisecond)
+	_, last, _ := b.limits.Store.Get(ctx, ip.key)
+
+	// Another guess against the address locks it again while
+	// alice is still logging in.
+	alice := b.identityLimitKey("alice")
+	_, err := b.rateLimited(r, []limitKey{alice, ip}, &alice, func() (User, error) {
+		if _, err := b.limits.Store.Incr(ctx, ip.key, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		_, last, _ = b.limits.Store.Get(ctx, ip.key)
+		return succeed()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, got, _ := b.limits.Store.Get(ctx, ip.key)
+	if n != 3 || !got.Equal(last) {
+		t.Errorf("address has %d failures, the last at %s, want 3 at %s", n, got, last)
+	}
+}
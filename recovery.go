@@ -0,0 +1,229 @@
+package authware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Recovery codes are 16 base32 characters, which is 80 bits, written
+// in groups of four.  That is enough that a plain hash cannot be
+// reversed, so they are not stretched like passwords.
+const (
+	recoveryBytes = 10
+	recoveryGroup = 4
+)
+
+// RecoveryCodeStore holds the hashes of the unused recovery codes of
+// each identity.
+type RecoveryCodeStore interface {
+	// Put replaces all of the recovery codes of an identity.  An
+	// empty list removes them.
+	Put(ctx context.Context, identity string, hashes [][]byte) error
+
+	// Use removes a code from an identity, or returns
+	// ErrDoesNotExist if the identity has no such code.  It must
+	// be atomic, so that each code can only be used once.
+	Use(ctx context.Context, identity string, hash []byte) error
+
+	// Count returns how many unused codes an identity has.
+	Count(ctx context.Context, identity string) (int, error)
+}
+
+// RecoveryOptions enables recovery codes, which let a user that has
+// lost their second factor complete a login in its place.  Each code
+// can only be used once.
+type RecoveryOptions struct {
+	// Store holds the codes, and is required.
+	Store RecoveryCodeStore
+
+	// Count is the number of codes issued at a time.  It
+	// defaults to 10.
+	Count int
+}
+
+func (o *RecoveryOptions) setDefaults() {
+	if o.Count <= 0 {
+		o.Count = 10
+	}
+}
+
+// hashRecoveryCode hashes a code together with the identity it
+// belongs to, after removing the formatting that users are likely to
+// get wrong.
+func hashRecoveryCode(identity, code string) []byte {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	sum := sha256.Sum256([]byte(identity + "\x00" + code))
+	return sum[:]
+}
+
+func newRecoveryCode() string {
+	b := make([]byte, recoveryBytes)
+	rand.Read(b)
+	s := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+
+	var groups []string
+	for i := 0; i < len(s); i += recoveryGroup {
+		groups = append(groups, s[i:i+recoveryGroup])
+	}
+	return strings.Join(groups, "-")
+}
+
+// GenerateRecoveryCodes issues a new set of recovery codes to an
+// identity, replacing any that were issued before.  The codes are
+// only stored as hashes, so this is the only time they can be shown
+// to the user.
+func (b *BasicMiddleware) GenerateRecoveryCodes(ctx context.Context, identity string) ([]string, error) {
+	if b.recovery == nil {
+		return nil, ErrDoesNotExist{}
+	}
+	codes := make([]string, b.recovery.Count)
+	hashes := make([][]byte, b.recovery.Count)
+	for i := range codes {
+		codes[i] = newRecoveryCode()
+		hashes[i] = hashRecoveryCode(identity, codes[i])
+	}
+	if err := b.recovery.Store.Put(ctx, identity, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RecoveryFormHandler accepts a recovery code in place of the second
+// factor of a pending login.  It is used in the same way as
+// TOTPFormHandler, and is subject to the same rate limits.
+func (b *BasicMiddleware) RecoveryFormHandler(codeField string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if b.recovery == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Form must contain %s as a field\n", codeField)
+			return
+		}
+
+		if b.loginCSRF && !b.checkCSRF(r) {
+			slog.Debug("Denying recovery code with missing or invalid CSRF token")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, "Invalid CSRF Token")
+			return
+		}
+
+		var p pendingLogin
+		if err := b.peekFlowState(r, pendingFlow, &p); err != nil {
+			slog.Debug("Denying recovery code without a pending login", "error", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Login Expired")
+			return
+		}
+		// A user that was sent to enroll has no second factor for
+		// a recovery code to stand in for, and must enroll one.
+		if p.Enroll {
+			slog.Info("Denying recovery code for user that must enroll a second factor", "user", p.User.Identity)
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, "Enrollment Required")
+			return
+		}
+		user := p.User
+
+		id := limitKey{key: "recovery:" + user.Identity, threshold: b.limits.IdentityThreshold}
+		_, err := b.rateLimited(r, []limitKey{id, b.ipLimitKey(r)}, &id, func() (User, error) {
+			return user, b.recovery.Store.Use(r.Context(), user.Identity, hashRecoveryCode(user.Identity, r.FormValue(codeField)))
+		})
+		if rl, ok := err.(ErrRateLimited); ok {
+			writeRateLimited(w, rl)
+			return
+		}
+		if err != nil {
+			slog.Debug("Denying login after an invalid recovery code", "user", user.Identity)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Access Denied")
+			return
+		}
+		slog.Info("Recovery code used", "user", user.Identity)
+
+		next, err := b.CompletePendingLogin(w, r, AMROneTimeCode)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			slog.Error("Error creating session", "error", err)
+			return
+		}
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	}
+}
+
+// RecoveryCodesHandler manages the recovery codes of the user in the
+// request context, and so must be placed behind LoginHandler.  A GET
+// returns the number of unused codes as JSON, and a POST replaces
+// them with a new set which is returned as JSON.  Since the codes
+// stand in for the second factor, a POST is refused unless the user
+// logged in within RecentAuthAge.
+func (b *BasicMiddleware) RecoveryCodesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if b.recovery == nil {
+			http.NotFound(w, r)
+			return
+		}
+		user, ok := UserFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Authentication Required")
+			return
+		}
+
+		var body any
+		switch r.Method {
+		case http.MethodGet:
+			n, err := b.recovery.Store.Count(r.Context(), user.Identity)
+			if err != nil {
+				slog.Error("Error counting recovery codes", "user", user.Identity, "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintln(w, "Internal Server Error")
+				return
+			}
+			body = struct {
+				Remaining int `json:"remaining"`
+			}{n}
+		case http.MethodPost:
+			if !b.checkCSRF(r) {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintln(w, "Invalid CSRF Token")
+				return
+			}
+			if !b.RecentlyAuthenticated(r, RecentAuthAge) {
+				slog.Info("Refusing to issue recovery codes without a recent login", "user", user.Identity)
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintln(w, "Recent Login Required")
+				return
+			}
+			codes, err := b.GenerateRecoveryCodes(r.Context(), user.Identity)
+			if err != nil {
+				slog.Error("Error storing recovery codes", "user", user.Identity, "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintln(w, "Internal Server Error")
+				return
+			}
+			slog.Info("Issued recovery codes", "user", user.Identity)
+			body = struct {
+				Codes []string `json:"codes"`
+			}{codes}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(body)
+	})
+}
@@ -0,0 +1,127 @@
+package authware
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryRecovery is a RecoveryCodeStore for tests.
+type memoryRecovery struct {
+	mu    sync.Mutex
+	codes map[string][][]byte
+}
+
+func (m *memoryRecovery) Put(ctx context.Context, identity string, hashes [][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.codes[identity] = hashes
+	return nil
+}
+
+func (m *memoryRecovery) Use(ctx context.Context, identity string, hash []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.codes[identity], func(h []byte) bool { return bytes.Equal(h, hash) })
+	if i < 0 {
+		return ErrDoesNotExist{}
+	}
+	m.codes[identity] = slices.Delete(m.codes[identity], i, i+1)
+	return nil
+}
+
+func (m *memoryRecovery) Count(ctx context.Context, identity string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.codes[identity]), nil
+}
+
+func TestRecoveryCode(t *testing.T) {
+	cases := []struct {
+		name   string
+		enroll bool
+		want   int
+	}{
+		{"second factor", false, http.StatusSeeOther},
+		{"enrollment", true, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store := &memoryRecovery{codes: make(map[string][][]byte)}
+			b, err := NewAuth(WithAuthenticators(), WithLoginCSRF(false), WithRecoveryCodes(RecoveryOptions{Store: store}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			codes, err := b.GenerateRecoveryCodes(context.Background(), "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tb := testBrowser{}
+			w := httptest.NewRecorder()
+			p := pendingLogin{User: User{Identity: "alice"}, Next: "/private", Enroll: c.enroll}
+			if err := b.SetFlowState(w, pendingFlow, p, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			tb.keep(w)
+
+			h := http.HandlerFunc(b.RecoveryFormHandler("code"))
+			if w := tb.do(h, http.MethodPost, "/login/recovery", url.Values{"code": {codes[0]}}); w.Code != c.want {
+				t.Fatalf("expected %d, got %d", c.want, w.Code)
+			}
+
+			_, err = b.CurrentSession(tb.request(http.MethodGet, "/", nil))
+			if c.enroll == (err == nil) {
+				t.Errorf("unexpected session error %v", err)
+			}
+			used := 0
+			if !c.enroll {
+				used = 1
+			}
+			if n, _ := store.Count(context.Background(), "alice"); n != len(codes)-used {
+				t.Errorf("%d codes remain of %d", n, len(codes))
+			}
+		})
+	}
+}
+
+func TestRecoveryCodesRequireRecentLogin(t *testing.T) {
+	store := &memoryRecovery{codes: make(map[string][][]byte)}
+	b, err := NewAuth(WithAuthenticators(), WithRecoveryCodes(RecoveryOptions{Store: store}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := b.LoginHandler("/login")(b.RecoveryCodesHandler())
+
+	cases := []struct {
+		name     string
+		authTime time.Time
+		want     int
+	}{
+		{"stale login", time.Now().Add(-time.Hour), http.StatusForbidden},
+		{"recent login", time.Now(), http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tb := testBrowser{}
+			tb.login(t, b, "alice", c.authTime)
+			session, err := b.CurrentSession(tb.request(http.MethodGet, "/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			form := url.Values{CSRFFieldName: {session.CSRFToken}}
+			if w := tb.do(h, http.MethodPost, "/recovery", form); w.Code != c.want {
+				t.Errorf("expected %d, got %d", c.want, w.Code)
+			}
+		})
+	}
+	if n, _ := store.Count(context.Background(), "alice"); n == 0 {
+		t.Error("no codes were issued after a recent login")
+	}
+}
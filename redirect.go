@@ -0,0 +1,66 @@
+package authware
+
+import (
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// RedirectOptions controls which targets the login flow is willing
+// to redirect to after a successful login.  Without restrictions, a
+// crafted login link could send a freshly authenticated user to an
+// arbitrary site.
+type RedirectOptions struct {
+	// AllowedHosts lists external hosts that may be redirected
+	// to in addition to local paths.  Only http and https URLs
+	// are permitted.
+	AllowedHosts []string
+
+	// Validate replaces the built in checks entirely if it is
+	// set.  It may call IsLocalRedirect to retain the default
+	// behavior for local paths.
+	Validate func(*url.URL) bool
+}
+
+// IsLocalRedirect returns true if the URL is a path on the same
+// origin, and does not contain anything that a browser might
+// interpret as a reference to another host.
+func IsLocalRedirect(u *url.URL) bool {
+	if u.Scheme != "" || u.Host != "" || u.User != nil || u.Opaque != "" {
+		return false
+	}
+	if !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(u.Path, "//") {
+		return false
+	}
+	// Browsers treat a backslash as a forward slash, so /\host is
+	// equivalent to //host.
+	return !strings.Contains(u.Path, "\\") && !strings.Contains(u.RawPath, "\\")
+}
+
+func (o RedirectOptions) allowed(u *url.URL) bool {
+	if o.Validate != nil {
+		return o.Validate(u)
+	}
+	if IsLocalRedirect(u) {
+		return true
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	return u.User == nil && slices.Contains(o.AllowedHosts, u.Host)
+}
+
+// safeNext returns next if it is a permitted redirect target, and
+// fallback otherwise.
+func (b *BasicMiddleware) safeNext(next, fallback string) string {
+	if next == "" {
+		return fallback
+	}
+	u, err := url.Parse(next)
+	if err != nil || !b.redirect.allowed(u) {
+		slog.Warn("Refusing to redirect to disallowed target", "next", next)
+		return fallback
+	}
+	return next
+}
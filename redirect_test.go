@@ -0,0 +1,80 @@
+package authware
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestIsLocalRedirect(t *testing.T) {
+	cases := []struct {
+		target string
+		want   bool
+	}{
+		{"/", true},
+		{"/private", true},
+		{"/private?a=b#c", true},
+		{"/a//b", true},
+		// Encoded slashes are decoded before checking, which
+		// refuses some harmless paths rather than risk a
+		// browser or proxy decoding them.
+		{"/%2Fprivate", false},
+		{"//evil.com", false},
+		{"///evil.com", false},
+		{"/\\evil.com", false},
+		{"\\\\evil.com", false},
+		{"/%5Cevil.com", false},
+		{"/%5C%5Cevil.com", false},
+		{"/%2F%2Fevil.com", false},
+		{"%2F%2Fevil.com", false},
+		{"https://evil.com", false},
+		{"https://evil.com/private", false},
+		{"http:evil.com", false},
+		{"https:/evil.com", false},
+		{"//user@evil.com", false},
+		{"javascript:alert(1)", false},
+		{"data:text/html,hi", false},
+		{"mailto:a@evil.com", false},
+		{"private", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		u, err := url.Parse(c.target)
+		if err != nil {
+			t.Fatalf("%q: %v", c.target, err)
+		}
+		if got := IsLocalRedirect(u); got != c.want {
+			t.Errorf("IsLocalRedirect(%q) = %v, want %v", c.target, got, c.want)
+		}
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	b, err := NewAuth(WithAuthenticators(), WithRedirectOptions(RedirectOptions{AllowedHosts: []string{"app.example.com"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		next string
+		want string
+	}{
+		{"", "/home"},
+		{"/private", "/private"},
+		{"https://app.example.com/x", "https://app.example.com/x"},
+		{"http://app.example.com/x", "http://app.example.com/x"},
+		{"//app.example.com/x", "/home"},
+		{"https://user@app.example.com/x", "/home"},
+		{"ftp://app.example.com/x", "/home"},
+		{"javascript://app.example.com/%0aalert(1)", "/home"},
+		{"https://app.example.com.evil.com/", "/home"},
+		{"https://evil.com", "/home"},
+		{"//evil.com", "/home"},
+		{"/\t/evil.com", "/home"},
+		{"/\n/evil.com", "/home"},
+		{"/\\evil.com", "/home"},
+	}
+	for _, c := range cases {
+		if got := b.safeNext(c.next, "/home"); got != c.want {
+			t.Errorf("safeNext(%q) = %q, want %q", c.next, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package authware
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// SessionStore keeps sessions on the server.  When a store is
+// configured the session cookie carries only an opaque session ID,
+// which allows sessions to be revoked before they expire.
+type SessionStore interface {
+	// Put stores the session under its ID, replacing any session
+	// that was previously stored there.
+	Put(context.Context, Session) error
+
+	// Get retrieves a session by ID.  Sessions that do not exist
+	// or have expired return ErrDoesNotExist.
+	Get(context.Context, string) (Session, error)
+
+	// Delete removes a single session by ID.
+	Delete(context.Context, string) error
+
+	// List returns the IDs of all sessions held by the given
+	// identity.
+	List(context.Context, string) ([]string, error)
+
+	// DeleteIdentity removes every session held by the given
+	// identity.
+	DeleteIdentity(context.Context, string) error
+}
+
+// Authentication methods recorded in Session.AMR.  The values are
+// those registered by RFC 8176, so they can be passed on as the amr
+// claim of an ID token.
+const (
+	// AMRPassword is recorded for logins with a password.
+	AMRPassword = "pwd"
+
+	// AMROneTimeCode is recorded for TOTP codes and recovery
+	// codes.
+	AMROneTimeCode = "otp"
+
+	// AMRHardwareKey is recorded for WebAuthn credentials.
+	AMRHardwareKey = "hwk"
+
+	// AMRMultiFactor is recorded alongside the individual methods
+	// when more than one was used.
+	AMRMultiFactor = "mfa"
+)
+
+// issueSession creates a new session for the user, stores it if a
+// store is configured, and sets the session cookie.  The user is
+// recorded as having authenticated at authTime with the methods in
+// amr.
+func (b *BasicMiddleware) issueSession(w http.ResponseWriter, r *http.Request, user User, authTime time.Time, amr []string) error {
+	now := time.Now()
+	session := Session{
+		ID:        rand.Text(),
+		IssuedAt:  now,
+		Expires:   now.Add(b.sessionLifetime),
+		CSRFToken: rand.Text(),
+		AuthTime:  authTime,
+		AMR:       amr,
+		User:      user,
+	}
+	if b.idleTimeout > 0 && b.idleTimeout < b.sessionLifetime {
+		session.Expires = now.Add(b.idleTimeout)
+	}
+	return b.writeSession(w, r, session)
+}
+
+// refreshSession extends a session that is within the refresh
+// threshold of expiring, up to the absolute session lifetime, and
+// re-issues the cookie.  Sessions are only ever extended if an idle
+// timeout is configured.
+func (b *BasicMiddleware) refreshSession(w http.ResponseWriter, r *http.Request, session Session) {
+	if b.idleTimeout <= 0 || time.Until(session.Expires) > b.refreshThreshold {
+		return
+	}
+
+	expires := time.Now().Add(b.idleTimeout)
+	if limit := session.IssuedAt.Add(b.sessionLifetime); expires.After(limit) {
+		expires = limit
+	}
+	if !expires.After(session.Expires) {
+		return
+	}
+
+	session.Expires = expires
+	if err := b.writeSession(w, r, session); err != nil {
+		slog.Warn("Error refreshing session", "user", session.User.Identity, "error", err)
+	}
+}
+
+// writeSession stores the session if a store is configured, and sets
+// the session cookie.
+func (b *BasicMiddleware) writeSession(w http.ResponseWriter, r *http.Request, session Session) error {
+	var b64 string
+	var err error
+	if b.store != nil {
+		if err := b.store.Put(r.Context(), session); err != nil {
+			return err
+		}
+		b64, err = b.keys.EncryptToBase64(session.ID)
+	} else {
+		b64, err = b.keys.EncryptToBase64(session)
+	}
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, b.cookie.cookie(b64, session.Expires.Add(time.Minute)))
+	return nil
+}
+
+// loadSession retrieves the session associated with the request and
+// returns an error if there isn't one or it is no longer valid.
+func (b *BasicMiddleware) loadSession(r *http.Request) (Session, error) {
+	var session Session
+	cookie, err := r.Cookie(b.cookie.Name)
+	if err != nil {
+		return Session{}, err
+	}
+
+	if b.store != nil {
+		var id string
+		if err := b.keys.DecryptBase64(cookie.Value, &id); err != nil {
+			return Session{}, err
+		}
+		if session, err = b.store.Get(r.Context(), id); err != nil {
+			return Session{}, err
+		}
+	} else if err := b.keys.DecryptBase64(cookie.Value, &session); err != nil {
+		return Session{}, err
+	}
+
+	if time.Now().After(session.Expires) {
+		return Session{}, ErrSessionExpired{}
+	}
+	return session, nil
+}
+
+// CurrentSession returns the session that accompanies the request,
+// for applications that want to know when or how the user logged in.
+// It returns an error if the request has no valid session.
+func (b *BasicMiddleware) CurrentSession(r *http.Request) (Session, error) {
+	return b.loadSession(r)
+}
+
+// endSession removes the session from the store if there is one, and
+// instructs the client to discard the cookie.
+func (b *BasicMiddleware) endSession(w http.ResponseWriter, r *http.Request) {
+	if session, err := b.loadSession(r); err == nil && b.store != nil {
+		if err := b.store.Delete(r.Context(), session.ID); err != nil {
+			slog.Warn("Error removing session from store", "error", err)
+		}
+	}
+
+	http.SetCookie(w, b.cookie.expired())
+}
+
+// RevokeSession removes a single session, which will immediately
+// cease to be valid.  This requires a SessionStore.
+func (b *BasicMiddleware) RevokeSession(ctx context.Context, id string) error {
+	if b.store == nil {
+		return ErrNoSessionStore{}
+	}
+	return b.store.Delete(ctx, id)
+}
+
+// RevokeIdentity removes every session held by the given identity,
+// logging them out everywhere.  This requires a SessionStore.
+func (b *BasicMiddleware) RevokeIdentity(ctx context.Context, identity string) error {
+	if b.store == nil {
+		return ErrNoSessionStore{}
+	}
+	return b.store.DeleteIdentity(ctx, identity)
+}
+
+// Sessions returns the IDs of the sessions currently held by the
+// given identity.  This requires a SessionStore.
+func (b *BasicMiddleware) Sessions(ctx context.Context, identity string) ([]string, error) {
+	if b.store == nil {
+		return nil, ErrNoSessionStore{}
+	}
+	return b.store.List(ctx, identity)
+}
+
+// LogoutEverywhereHandler revokes every session belonging to the
+// current user, clears the cookie, and sends the caller somewhere
+// else.  This requires a SessionStore.
+func (b *BasicMiddleware) LogoutEverywhereHandler(nextPath string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := b.loadSession(r)
+		if err != nil {
+			http.Redirect(w, r, nextPath, http.StatusSeeOther)
+			return
+		}
+		if err := b.RevokeIdentity(r.Context(), session.User.Identity); err != nil {
+			slog.Error("Error revoking sessions", "user", session.User.Identity, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, "Could not log out all sessions")
+			return
+		}
+		b.endSession(w, r)
+		http.Redirect(w, r, nextPath, http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,199 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/the-maldridge/authware"
+)
+
+var (
+	sessionBucket  = []byte("sessions")
+	identityBucket = []byte("identities")
+	totpBucket     = []byte("totp")
+	webauthnBucket = []byte("webauthn")
+	recoveryBucket = []byte("recovery")
+)
+
+// Store keeps sessions in a bolt database on disk, so they survive a
+// restart.  A bolt database can only be opened by one process at a
+// time.
+type Store struct {
+	db *bolt.DB
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// New opens or creates the database at the given path.
+func New(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(sessionBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(identityBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(totpBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(webauthnBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(recoveryBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	slog.Info("Initialized", "sessiondb", path)
+	return &Store{db: db, lastSweep: time.Now()}, nil
+}
+
+// Close releases the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Put stores a session, replacing any existing session with the same
+// ID.
+func (s *Store) Put(ctx context.Context, session authware.Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	sweep := time.Since(s.lastSweep) > time.Minute
+	if sweep {
+		s.lastSweep = time.Now()
+	}
+	s.mu.Unlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if sweep {
+			if err := s.sweep(tx); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(sessionBucket).Put([]byte(session.ID), data); err != nil {
+			return err
+		}
+		ids, err := tx.Bucket(identityBucket).CreateBucketIfNotExists([]byte(session.User.Identity))
+		if err != nil {
+			return err
+		}
+		return ids.Put([]byte(session.ID), nil)
+	})
+}
+
+// Get retrieves a session by ID.
+func (s *Store) Get(ctx context.Context, id string) (authware.Session, error) {
+	var session authware.Session
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(sessionBucket).Get([]byte(id))
+		if data == nil {
+			return authware.ErrDoesNotExist{}
+		}
+		return json.Unmarshal(data, &session)
+	})
+	if err != nil {
+		return authware.Session{}, err
+	}
+	if time.Now().After(session.Expires) {
+		return authware.Session{}, authware.ErrDoesNotExist{}
+	}
+	return session, nil
+}
+
+// Delete removes a session by ID.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return remove(tx, []byte(id))
+	})
+}
+
+// List returns the IDs of all sessions held by an identity.
+func (s *Store) List(ctx context.Context, identity string) ([]string, error) {
+	out := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		ids := tx.Bucket(identityBucket).Bucket([]byte(identity))
+		if ids == nil {
+			return nil
+		}
+		return ids.ForEach(func(k, _ []byte) error {
+			out = append(out, string(k))
+			return nil
+		})
+	})
+	return out, err
+}
+
+// DeleteIdentity removes all sessions held by an identity.
+func (s *Store) DeleteIdentity(ctx context.Context, identity string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		ids := tx.Bucket(identityBucket).Bucket([]byte(identity))
+		if ids == nil {
+			return nil
+		}
+		sessions := tx.Bucket(sessionBucket)
+		if err := ids.ForEach(func(k, _ []byte) error {
+			return sessions.Delete(k)
+		}); err != nil {
+			return err
+		}
+		return tx.Bucket(identityBucket).DeleteBucket([]byte(identity))
+	})
+}
+
+func (s *Store) sweep(tx *bolt.Tx) error {
+	var expired [][]byte
+	now := time.Now()
+	err := tx.Bucket(sessionBucket).ForEach(func(k, v []byte) error {
+		var session authware.Session
+		if err := json.Unmarshal(v, &session); err != nil || now.After(session.Expires) {
+			expired = append(expired, bytes.Clone(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range expired {
+		if err := remove(tx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func remove(tx *bolt.Tx, id []byte) error {
+	sessions := tx.Bucket(sessionBucket)
+	data := sessions.Get(id)
+	if data == nil {
+		return nil
+	}
+
+	var session authware.Session
+	if err := json.Unmarshal(data, &session); err == nil {
+		if ids := tx.Bucket(identityBucket).Bucket([]byte(session.User.Identity)); ids != nil {
+			if err := ids.Delete(id); err != nil {
+				return err
+			}
+		}
+	}
+	return sessions.Delete(id)
+}
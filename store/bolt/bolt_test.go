@@ -0,0 +1,21 @@
+package bolt
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/the-maldridge/authware/store/storetest"
+)
+
+func TestStore(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "authware.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	t.Run("Sessions", func(t *testing.T) { storetest.Sessions(t, s, nil) })
+	t.Run("TOTP", func(t *testing.T) { storetest.TOTP(t, s.TOTP()) })
+	t.Run("RecoveryCodes", func(t *testing.T) { storetest.RecoveryCodes(t, s.RecoveryCodes()) })
+	t.Run("WebAuthn", func(t *testing.T) { storetest.WebAuthn(t, s.WebAuthn()) })
+}
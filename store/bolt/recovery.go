@@ -0,0 +1,69 @@
+package bolt
+
+import (
+	"context"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/the-maldridge/authware"
+)
+
+type recoveryCodes struct {
+	*Store
+}
+
+// RecoveryCodes returns a RecoveryCodeStore that keeps codes in the
+// same database as the sessions.  Each identity has a bucket holding
+// the hashes of its unused codes.
+func (s *Store) RecoveryCodes() authware.RecoveryCodeStore {
+	return recoveryCodes{s}
+}
+
+func (rc recoveryCodes) Put(ctx context.Context, identity string, hashes [][]byte) error {
+	return rc.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(recoveryBucket)
+		if root.Bucket([]byte(identity)) != nil {
+			if err := root.DeleteBucket([]byte(identity)); err != nil {
+				return err
+			}
+		}
+		if len(hashes) == 0 {
+			return nil
+		}
+		codes, err := root.CreateBucket([]byte(identity))
+		if err != nil {
+			return err
+		}
+		for _, h := range hashes {
+			if err := codes.Put(h, []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (rc recoveryCodes) Use(ctx context.Context, identity string, hash []byte) error {
+	return rc.db.Update(func(tx *bolt.Tx) error {
+		codes := tx.Bucket(recoveryBucket).Bucket([]byte(identity))
+		if codes == nil || codes.Get(hash) == nil {
+			return authware.ErrDoesNotExist{}
+		}
+		return codes.Delete(hash)
+	})
+}
+
+func (rc recoveryCodes) Count(ctx context.Context, identity string) (int, error) {
+	var n int
+	err := rc.db.View(func(tx *bolt.Tx) error {
+		codes := tx.Bucket(recoveryBucket).Bucket([]byte(identity))
+		if codes == nil {
+			return nil
+		}
+		return codes.ForEach(func(_, _ []byte) error {
+			n++
+			return nil
+		})
+	})
+	return n, err
+}
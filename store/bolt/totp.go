@@ -0,0 +1,74 @@
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/the-maldridge/authware"
+)
+
+type totpSecrets struct {
+	*Store
+}
+
+// TOTP returns a TOTPStore that keeps secrets in the same database
+// as the sessions.
+func (s *Store) TOTP() authware.TOTPStore {
+	return totpSecrets{s}
+}
+
+func (t totpSecrets) Get(ctx context.Context, identity string) (authware.TOTPSecret, error) {
+	var secret authware.TOTPSecret
+	err := t.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(totpBucket).Get([]byte(identity))
+		if data == nil {
+			return authware.ErrDoesNotExist{}
+		}
+		return json.Unmarshal(data, &secret)
+	})
+	return secret, err
+}
+
+func (t totpSecrets) Put(ctx context.Context, identity string, secret authware.TOTPSecret) error {
+	data, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+	return t.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(totpBucket).Put([]byte(identity), data)
+	})
+}
+
+func (t totpSecrets) UseStep(ctx context.Context, identity string, step int64) (bool, error) {
+	used := false
+	err := t.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(totpBucket)
+		data := b.Get([]byte(identity))
+		if data == nil {
+			return authware.ErrDoesNotExist{}
+		}
+		var secret authware.TOTPSecret
+		if err := json.Unmarshal(data, &secret); err != nil {
+			return err
+		}
+		if step <= secret.LastStep {
+			return nil
+		}
+		secret.LastStep = step
+		data, err := json.Marshal(secret)
+		if err != nil {
+			return err
+		}
+		used = true
+		return b.Put([]byte(identity), data)
+	})
+	return used, err
+}
+
+func (t totpSecrets) Delete(ctx context.Context, identity string) error {
+	return t.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(totpBucket).Delete([]byte(identity))
+	})
+}
@@ -0,0 +1,64 @@
+package bolt
+
+import (
+	"context"
+	"encoding/json"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/the-maldridge/authware/webauthn"
+)
+
+type credentials struct {
+	*Store
+}
+
+// WebAuthn returns a CredentialStore that keeps credentials in the
+// same database as the sessions.  Each identity has a bucket of its
+// own, keyed by credential ID.
+func (s *Store) WebAuthn() webauthn.CredentialStore {
+	return credentials{s}
+}
+
+func (c credentials) Get(ctx context.Context, identity string) ([]webauthn.Credential, error) {
+	out := []webauthn.Credential{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		creds := tx.Bucket(webauthnBucket).Bucket([]byte(identity))
+		if creds == nil {
+			return nil
+		}
+		return creds.ForEach(func(_, v []byte) error {
+			var cred webauthn.Credential
+			if err := json.Unmarshal(v, &cred); err != nil {
+				return err
+			}
+			out = append(out, cred)
+			return nil
+		})
+	})
+	return out, err
+}
+
+func (c credentials) Put(ctx context.Context, identity string, cred webauthn.Credential) error {
+	data, err := json.Marshal(cred)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		creds, err := tx.Bucket(webauthnBucket).CreateBucketIfNotExists([]byte(identity))
+		if err != nil {
+			return err
+		}
+		return creds.Put(cred.ID, data)
+	})
+}
+
+func (c credentials) Delete(ctx context.Context, identity string, id []byte) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		creds := tx.Bucket(webauthnBucket).Bucket([]byte(identity))
+		if creds == nil {
+			return nil
+		}
+		return creds.Delete(id)
+	})
+}
@@ -0,0 +1,129 @@
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/the-maldridge/authware"
+	"github.com/the-maldridge/authware/webauthn"
+)
+
+// Store keeps sessions in memory.  Sessions do not survive a restart
+// and are not shared between processes.
+type Store struct {
+	mu         sync.Mutex
+	sessions   map[string]authware.Session
+	identities map[string]map[string]struct{}
+	totp       map[string]authware.TOTPSecret
+	webauthn   map[string][]webauthn.Credential
+	recovery   map[string]map[string]struct{}
+	lastSweep  time.Time
+}
+
+// New returns an empty store.
+func New() *Store {
+	return &Store{
+		sessions:   make(map[string]authware.Session),
+		identities: make(map[string]map[string]struct{}),
+		totp:       make(map[string]authware.TOTPSecret),
+		webauthn:   make(map[string][]webauthn.Credential),
+		recovery:   make(map[string]map[string]struct{}),
+		lastSweep:  time.Now(),
+	}
+}
+
+// Put stores a session, replacing any existing session with the same
+// ID.
+func (s *Store) Put(ctx context.Context, session authware.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.lastSweep) > time.Minute {
+		s.sweep()
+	}
+
+	s.sessions[session.ID] = session
+	ids, ok := s.identities[session.User.Identity]
+	if !ok {
+		ids = make(map[string]struct{})
+		s.identities[session.User.Identity] = ids
+	}
+	ids[session.ID] = struct{}{}
+	return nil
+}
+
+// Get retrieves a session by ID.
+func (s *Store) Get(ctx context.Context, id string) (authware.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return authware.Session{}, authware.ErrDoesNotExist{}
+	}
+	if time.Now().After(session.Expires) {
+		s.remove(id)
+		return authware.Session{}, authware.ErrDoesNotExist{}
+	}
+	return session, nil
+}
+
+// Delete removes a session by ID.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(id)
+	return nil
+}
+
+// List returns the IDs of all sessions held by an identity.
+func (s *Store) List(ctx context.Context, identity string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []string{}
+	for id := range s.identities[identity] {
+		out = append(out, id)
+	}
+	return out, nil
+}
+
+// DeleteIdentity removes all sessions held by an identity.
+func (s *Store) DeleteIdentity(ctx context.Context, identity string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id := range s.identities[identity] {
+		delete(s.sessions, id)
+	}
+	delete(s.identities, identity)
+	return nil
+}
+
+// remove must be called with the lock held.
+func (s *Store) remove(id string) {
+	session, ok := s.sessions[id]
+	if !ok {
+		return
+	}
+	delete(s.sessions, id)
+	if ids, ok := s.identities[session.User.Identity]; ok {
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(s.identities, session.User.Identity)
+		}
+	}
+}
+
+// sweep drops expired sessions and must be called with the lock
+// held.
+func (s *Store) sweep() {
+	now := time.Now()
+	for id, session := range s.sessions {
+		if now.After(session.Expires) {
+			s.remove(id)
+		}
+	}
+	s.lastSweep = now
+}
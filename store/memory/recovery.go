@@ -0,0 +1,51 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/the-maldridge/authware"
+)
+
+type recoveryCodes struct {
+	*Store
+}
+
+// RecoveryCodes returns a RecoveryCodeStore that keeps codes
+// alongside the sessions.  Codes are lost on restart, so this is only
+// suitable for testing.
+func (s *Store) RecoveryCodes() authware.RecoveryCodeStore {
+	return recoveryCodes{s}
+}
+
+func (rc recoveryCodes) Put(ctx context.Context, identity string, hashes [][]byte) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if len(hashes) == 0 {
+		delete(rc.recovery, identity)
+		return nil
+	}
+	codes := make(map[string]struct{}, len(hashes))
+	for _, h := range hashes {
+		codes[string(h)] = struct{}{}
+	}
+	rc.recovery[identity] = codes
+	return nil
+}
+
+func (rc recoveryCodes) Use(ctx context.Context, identity string, hash []byte) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if _, ok := rc.recovery[identity][string(hash)]; !ok {
+		return authware.ErrDoesNotExist{}
+	}
+	delete(rc.recovery[identity], string(hash))
+	return nil
+}
+
+func (rc recoveryCodes) Count(ctx context.Context, identity string) (int, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.recovery[identity]), nil
+}
@@ -0,0 +1,59 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/the-maldridge/authware"
+)
+
+type totpSecrets struct {
+	*Store
+}
+
+// TOTP returns a TOTPStore that keeps secrets alongside the
+// sessions.  Secrets are lost on restart, so this is only suitable
+// for testing.
+func (s *Store) TOTP() authware.TOTPStore {
+	return totpSecrets{s}
+}
+
+func (t totpSecrets) Get(ctx context.Context, identity string) (authware.TOTPSecret, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	secret, ok := t.totp[identity]
+	if !ok {
+		return authware.TOTPSecret{}, authware.ErrDoesNotExist{}
+	}
+	return secret, nil
+}
+
+func (t totpSecrets) Put(ctx context.Context, identity string, secret authware.TOTPSecret) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.totp[identity] = secret
+	return nil
+}
+
+func (t totpSecrets) UseStep(ctx context.Context, identity string, step int64) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	secret, ok := t.totp[identity]
+	if !ok {
+		return false, authware.ErrDoesNotExist{}
+	}
+	if step <= secret.LastStep {
+		return false, nil
+	}
+	secret.LastStep = step
+	t.totp[identity] = secret
+	return true, nil
+}
+
+func (t totpSecrets) Delete(ctx context.Context, identity string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.totp, identity)
+	return nil
+}
@@ -0,0 +1,57 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"slices"
+
+	"github.com/the-maldridge/authware/webauthn"
+)
+
+type credentials struct {
+	*Store
+}
+
+// WebAuthn returns a CredentialStore that keeps credentials
+// alongside the sessions.  Credentials are lost on restart, so this is
+// only suitable for testing.
+func (s *Store) WebAuthn() webauthn.CredentialStore {
+	return credentials{s}
+}
+
+func (c credentials) Get(ctx context.Context, identity string) ([]webauthn.Credential, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.webauthn[identity]), nil
+}
+
+func (c credentials) Put(ctx context.Context, identity string, cred webauthn.Credential) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.webauthn[identity] = replaceCredential(c.webauthn[identity], cred)
+	return nil
+}
+
+func (c credentials) Delete(ctx context.Context, identity string, id []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.webauthn[identity] = slices.DeleteFunc(c.webauthn[identity], func(e webauthn.Credential) bool {
+		return bytes.Equal(e.ID, id)
+	})
+	if len(c.webauthn[identity]) == 0 {
+		delete(c.webauthn, identity)
+	}
+	return nil
+}
+
+// replaceCredential returns the list with cred in place of any entry
+// with the same ID, or appended if there is none.
+func replaceCredential(list []webauthn.Credential, cred webauthn.Credential) []webauthn.Credential {
+	for i, e := range list {
+		if bytes.Equal(e.ID, cred.ID) {
+			list[i] = cred
+			return list
+		}
+	}
+	return append(list, cred)
+}
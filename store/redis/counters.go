@@ -0,0 +1,102 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/the-maldridge/authware"
+)
+
+// decrScript decrements a counter only if it exists, so that a
+// counter which has expired is not recreated without a ttl.
+var decrScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+local n = redis.call("DECR", KEYS[1])
+if n <= 0 then
+	redis.call("DEL", KEYS[1], KEYS[2])
+end
+return n
+`)
+
+type counters struct {
+	*Store
+}
+
+// Counters returns a rate limit CounterStore that shares the store's
+// connection.  This allows several processes to enforce rate limits
+// together.
+func (s *Store) Counters() authware.CounterStore {
+	return counters{s}
+}
+
+func (c counters) Incr(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	k := c.counterKey(key)
+	var incr *redis.IntCmd
+	_, err := c.c.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		incr = p.Incr(ctx, k)
+		p.PExpire(ctx, k, ttl)
+		p.Set(ctx, k+":last", time.Now().UnixNano(), ttl)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(incr.Val()), nil
+}
+
+func (c counters) Reserve(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	k := c.counterKey(key)
+	var incr *redis.IntCmd
+	_, err := c.c.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		incr = p.Incr(ctx, k)
+		p.PExpire(ctx, k, ttl)
+		p.PExpire(ctx, k+":last", ttl)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(incr.Val()), nil
+}
+
+func (c counters) Get(ctx context.Context, key string) (int, time.Time, error) {
+	k := c.counterKey(key)
+	vals, err := c.c.MGet(ctx, k, k+":last").Result()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	n, _ := vals[0].(string)
+	last, _ := vals[1].(string)
+	if n == "" || last == "" {
+		return 0, time.Time{}, nil
+	}
+
+	count, err := strconv.Atoi(n)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	nanos, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return count, time.Unix(0, nanos), nil
+}
+
+func (c counters) Decr(ctx context.Context, key string) error {
+	k := c.counterKey(key)
+	return decrScript.Run(ctx, c.c, []string{k, k + ":last"}).Err()
+}
+
+func (c counters) Reset(ctx context.Context, key string) error {
+	k := c.counterKey(key)
+	return c.c.Del(ctx, k, k+":last").Err()
+}
+
+func (s *Store) counterKey(key string) string {
+	return s.prefix + "ratelimit:" + key
+}
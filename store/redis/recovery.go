@@ -0,0 +1,57 @@
+package redis
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/the-maldridge/authware"
+)
+
+type recoveryCodes struct {
+	*Store
+}
+
+// RecoveryCodes returns a RecoveryCodeStore that shares the store's
+// connection.  Each identity's codes are kept in a set of hashes.
+// Codes never expire, so the server must be configured to persist
+// its data.
+func (s *Store) RecoveryCodes() authware.RecoveryCodeStore {
+	return recoveryCodes{s}
+}
+
+func (rc recoveryCodes) Put(ctx context.Context, identity string, hashes [][]byte) error {
+	key := rc.recoveryKey(identity)
+	_, err := rc.c.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Del(ctx, key)
+		if len(hashes) > 0 {
+			members := make([]any, len(hashes))
+			for i, h := range hashes {
+				members[i] = h
+			}
+			p.SAdd(ctx, key, members...)
+		}
+		return nil
+	})
+	return err
+}
+
+func (rc recoveryCodes) Use(ctx context.Context, identity string, hash []byte) error {
+	n, err := rc.c.SRem(ctx, rc.recoveryKey(identity), hash).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return authware.ErrDoesNotExist{}
+	}
+	return nil
+}
+
+func (rc recoveryCodes) Count(ctx context.Context, identity string) (int, error) {
+	n, err := rc.c.SCard(ctx, rc.recoveryKey(identity)).Result()
+	return int(n), err
+}
+
+func (s *Store) recoveryKey(identity string) string {
+	return s.prefix + "recovery:" + identity
+}
@@ -0,0 +1,180 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/the-maldridge/authware"
+)
+
+// Config contains the settings for the redis store.
+type Config struct {
+	// Address of the server in host:port form.
+	Address string `mapstructure:"address"`
+
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	DB       int    `mapstructure:"db"`
+
+	// Prefix is prepended to every key the store creates, and
+	// defaults to "authware:".
+	Prefix string `mapstructure:"prefix"`
+}
+
+// Store keeps sessions in any server that speaks the redis protocol.
+// Sessions are shared by every process pointed at the same server,
+// and expire on their own.
+type Store struct {
+	c      *redis.Client
+	prefix string
+}
+
+// New connects to the server described by the config.
+func New(cfg Config) (*Store, error) {
+	if cfg.Address == "" {
+		slog.Error("Missing required config value", "key", "Address")
+		return nil, errors.New("must specify a redis Address")
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "authware:"
+	}
+
+	c := redis.NewClient(&redis.Options{
+		Addr:     cfg.Address,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+	if err := c.Ping(context.Background()).Err(); err != nil {
+		slog.Error("Error connecting to redis", "error", err)
+		c.Close()
+		return nil, err
+	}
+
+	slog.Info("Initialized", "redis", cfg.Address)
+	return &Store{c: c, prefix: cfg.Prefix}, nil
+}
+
+// Close disconnects from the server.
+func (s *Store) Close() error {
+	return s.c.Close()
+}
+
+// Put stores a session, replacing any existing session with the same
+// ID.
+func (s *Store) Put(ctx context.Context, session authware.Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(session.Expires)
+	if ttl <= 0 {
+		return nil
+	}
+
+	// The identity set must live at least as long as the longest
+	// session in it, so its expiry is only ever extended.
+	idKey := s.identityKey(session.User.Identity)
+	cur, err := s.c.PTTL(ctx, idKey).Result()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.c.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, s.sessionKey(session.ID), data, ttl)
+		p.SAdd(ctx, idKey, session.ID)
+		if cur < ttl {
+			p.PExpire(ctx, idKey, ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+// Get retrieves a session by ID.
+func (s *Store) Get(ctx context.Context, id string) (authware.Session, error) {
+	data, err := s.c.Get(ctx, s.sessionKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return authware.Session{}, authware.ErrDoesNotExist{}
+	}
+	if err != nil {
+		return authware.Session{}, err
+	}
+
+	var session authware.Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return authware.Session{}, err
+	}
+	return session, nil
+}
+
+// Delete removes a session by ID.
+func (s *Store) Delete(ctx context.Context, id string) error {
+	session, err := s.Get(ctx, id)
+	if errors.Is(err, authware.ErrDoesNotExist{}) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = s.c.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Del(ctx, s.sessionKey(id))
+		p.SRem(ctx, s.identityKey(session.User.Identity), id)
+		return nil
+	})
+	return err
+}
+
+// List returns the IDs of all sessions held by an identity.
+// Sessions that have expired are pruned from the identity as a side
+// effect.
+func (s *Store) List(ctx context.Context, identity string) ([]string, error) {
+	idKey := s.identityKey(identity)
+	ids, err := s.c.SMembers(ctx, idKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	out := []string{}
+	for _, id := range ids {
+		n, err := s.c.Exists(ctx, s.sessionKey(id)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			s.c.SRem(ctx, idKey, id)
+			continue
+		}
+		out = append(out, id)
+	}
+	return out, nil
+}
+
+// DeleteIdentity removes all sessions held by an identity.
+func (s *Store) DeleteIdentity(ctx context.Context, identity string) error {
+	idKey := s.identityKey(identity)
+	ids, err := s.c.SMembers(ctx, idKey).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := []string{idKey}
+	for _, id := range ids {
+		keys = append(keys, s.sessionKey(id))
+	}
+	return s.c.Del(ctx, keys...).Err()
+}
+
+func (s *Store) sessionKey(id string) string {
+	return s.prefix + "session:" + id
+}
+
+func (s *Store) identityKey(identity string) string {
+	return s.prefix + "identity:" + identity
+}
@@ -0,0 +1,24 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/the-maldridge/authware/store/storetest"
+)
+
+func TestStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s, err := New(Config{Address: mr.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	t.Run("Sessions", func(t *testing.T) { storetest.Sessions(t, s, mr.FastForward) })
+	t.Run("Counters", func(t *testing.T) { storetest.Counters(t, s.Counters(), mr.FastForward) })
+	t.Run("TOTP", func(t *testing.T) { storetest.TOTP(t, s.TOTP()) })
+	t.Run("RecoveryCodes", func(t *testing.T) { storetest.RecoveryCodes(t, s.RecoveryCodes()) })
+	t.Run("WebAuthn", func(t *testing.T) { storetest.WebAuthn(t, s.WebAuthn()) })
+}
@@ -0,0 +1,99 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/the-maldridge/authware"
+)
+
+type totpSecrets struct {
+	*Store
+}
+
+// TOTP returns a TOTPStore that shares the store's connection.
+// Secrets never expire, so the server must be configured to persist
+// its data.
+func (s *Store) TOTP() authware.TOTPStore {
+	return totpSecrets{s}
+}
+
+func (t totpSecrets) Get(ctx context.Context, identity string) (authware.TOTPSecret, error) {
+	data, err := t.c.Get(ctx, t.totpKey(identity)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return authware.TOTPSecret{}, authware.ErrDoesNotExist{}
+	}
+	if err != nil {
+		return authware.TOTPSecret{}, err
+	}
+
+	var secret authware.TOTPSecret
+	if err := json.Unmarshal(data, &secret); err != nil {
+		return authware.TOTPSecret{}, err
+	}
+	return secret, nil
+}
+
+func (t totpSecrets) Put(ctx context.Context, identity string, secret authware.TOTPSecret) error {
+	data, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+	return t.c.Set(ctx, t.totpKey(identity), data, 0).Err()
+}
+
+// useStepRetries bounds how many times UseStep starts over when the
+// secret changes while it is being updated.
+const useStepRetries = 5
+
+func (t totpSecrets) UseStep(ctx context.Context, identity string, step int64) (bool, error) {
+	key := t.totpKey(identity)
+	used := false
+	update := func(tx *redis.Tx) error {
+		used = false
+		data, err := tx.Get(ctx, key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return authware.ErrDoesNotExist{}
+		}
+		if err != nil {
+			return err
+		}
+		var secret authware.TOTPSecret
+		if err := json.Unmarshal(data, &secret); err != nil {
+			return err
+		}
+		if step <= secret.LastStep {
+			return nil
+		}
+		secret.LastStep = step
+		if data, err = json.Marshal(secret); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.Set(ctx, key, data, 0)
+			return nil
+		})
+		used = err == nil
+		return err
+	}
+
+	for range useStepRetries {
+		err := t.c.Watch(ctx, update, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		return used, err
+	}
+	return false, redis.TxFailedErr
+}
+
+func (t totpSecrets) Delete(ctx context.Context, identity string) error {
+	return t.c.Del(ctx, t.totpKey(identity)).Err()
+}
+
+func (s *Store) totpKey(identity string) string {
+	return s.prefix + "totp:" + identity
+}
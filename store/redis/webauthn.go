@@ -0,0 +1,53 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/the-maldridge/authware/webauthn"
+)
+
+type credentials struct {
+	*Store
+}
+
+// WebAuthn returns a CredentialStore that shares the store's
+// connection.  Each identity's credentials are kept in a hash keyed by
+// credential ID.  Credentials never expire, so the server must be
+// configured to persist its data.
+func (s *Store) WebAuthn() webauthn.CredentialStore {
+	return credentials{s}
+}
+
+func (c credentials) Get(ctx context.Context, identity string) ([]webauthn.Credential, error) {
+	vals, err := c.c.HVals(ctx, c.webauthnKey(identity)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	out := []webauthn.Credential{}
+	for _, v := range vals {
+		var cred webauthn.Credential
+		if err := json.Unmarshal([]byte(v), &cred); err != nil {
+			return nil, err
+		}
+		out = append(out, cred)
+	}
+	return out, nil
+}
+
+func (c credentials) Put(ctx context.Context, identity string, cred webauthn.Credential) error {
+	data, err := json.Marshal(cred)
+	if err != nil {
+		return err
+	}
+	return c.c.HSet(ctx, c.webauthnKey(identity), string(cred.ID), data).Err()
+}
+
+func (c credentials) Delete(ctx context.Context, identity string, id []byte) error {
+	return c.c.HDel(ctx, c.webauthnKey(identity), string(id)).Err()
+}
+
+func (s *Store) webauthnKey(identity string) string {
+	return s.prefix + "webauthn:" + identity
+}
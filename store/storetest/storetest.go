@@ -0,0 +1,395 @@
+// Package storetest checks that a store behaves as the interfaces it
+// implements describe.  Each store runs these checks from its own
+// tests, so that every store is held to the same behaviour.
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	webauthnlib "github.com/go-webauthn/webauthn/webauthn"
+
+	"github.com/the-maldridge/authware"
+	"github.com/the-maldridge/authware/webauthn"
+)
+
+// Advance moves time forward by d for stores that expire data on a
+// server with its own clock, such as miniredis.  The checks sleep for
+// d before calling it, so stores that use the local clock may pass
+// nil.
+type Advance func(d time.Duration)
+
+func wait(advance Advance, d time.Duration) {
+	time.Sleep(d)
+	if advance != nil {
+		advance(d)
+	}
+}
+
+func isDoesNotExist(err error) bool {
+	return errors.Is(err, authware.ErrDoesNotExist{})
+}
+
+// Sessions checks an authware.SessionStore.
+func Sessions(t *testing.T, s authware.SessionStore, advance Advance) {
+	t.Helper()
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	session := func(id, identity string, expires time.Time) authware.Session {
+		return authware.Session{
+			ID:        id,
+			IssuedAt:  now,
+			Expires:   expires,
+			CSRFToken: "csrf-" + id,
+			AuthTime:  now,
+			AMR:       []string{authware.AMRPassword},
+			User: authware.User{
+				Identity: identity,
+				Groups:   map[string]struct{}{"staff": {}},
+				AuthedBy: "test",
+			},
+		}
+	}
+	put := func(sess authware.Session) {
+		t.Helper()
+		if err := s.Put(ctx, sess); err != nil {
+			t.Fatalf("Put(%s): %v", sess.ID, err)
+		}
+	}
+	list := func(identity string) []string {
+		t.Helper()
+		ids, err := s.List(ctx, identity)
+		if err != nil {
+			t.Fatalf("List(%s): %v", identity, err)
+		}
+		slices.Sort(ids)
+		return ids
+	}
+
+	a1 := session("a1", "alice", now.Add(time.Hour))
+	put(a1)
+	put(session("a2", "alice", now.Add(time.Hour)))
+	put(session("b1", "bob", now.Add(time.Hour)))
+
+	got, err := s.Get(ctx, "a1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.User.Identity != "alice" || got.CSRFToken != "csrf-a1" || !got.Expires.Equal(a1.Expires) ||
+		!got.AuthTime.Equal(now) || !slices.Equal(got.AMR, a1.AMR) {
+		t.Errorf("Get returned %+v, want %+v", got, a1)
+	}
+	if _, ok := got.User.Groups["staff"]; !ok {
+		t.Errorf("Get lost the groups: %v", got.User.Groups)
+	}
+	if _, err := s.Get(ctx, "missing"); !isDoesNotExist(err) {
+		t.Errorf("Get of a missing session returned %v", err)
+	}
+	if ids := list("alice"); !slices.Equal(ids, []string{"a1", "a2"}) {
+		t.Errorf("List returned %v", ids)
+	}
+
+	a1.Expires = now.Add(2 * time.Hour)
+	put(a1)
+	if got, _ := s.Get(ctx, "a1"); !got.Expires.Equal(a1.Expires) {
+		t.Errorf("Put did not replace the session, expires %s", got.Expires)
+	}
+
+	if err := s.Delete(ctx, "a2"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get(ctx, "a2"); !isDoesNotExist(err) {
+		t.Errorf("Get of a deleted session returned %v", err)
+	}
+	if ids := list("alice"); !slices.Equal(ids, []string{"a1"}) {
+		t.Errorf("List after Delete returned %v", ids)
+	}
+	if err := s.Delete(ctx, "missing"); err != nil {
+		t.Errorf("Delete of a missing session returned %v", err)
+	}
+
+	if err := s.DeleteIdentity(ctx, "alice"); err != nil {
+		t.Fatalf("DeleteIdentity: %v", err)
+	}
+	if _, err := s.Get(ctx, "a1"); !isDoesNotExist(err) {
+		t.Errorf("Get after DeleteIdentity returned %v", err)
+	}
+	if ids := list("alice"); len(ids) != 0 {
+		t.Errorf("List after DeleteIdentity returned %v", ids)
+	}
+	if _, err := s.Get(ctx, "b1"); err != nil {
+		t.Errorf("DeleteIdentity removed another identity's session: %v", err)
+	}
+
+	put(session("c1", "carol", time.Now().Add(100*time.Millisecond)))
+	wait(advance, 200*time.Millisecond)
+	if _, err := s.Get(ctx, "c1"); !isDoesNotExist(err) {
+		t.Errorf("Get of an expired session returned %v", err)
+	}
+}
+
+// Counters checks an authware.CounterStore.
+func Counters(t *testing.T, c authware.CounterStore, advance Advance) {
+	t.Helper()
+	ctx := context.Background()
+	get := func(key string) int {
+		t.Helper()
+		n, _, err := c.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", key, err)
+		}
+		return n
+	}
+
+	if n, last, err := c.Get(ctx, "missing"); n != 0 || !last.IsZero() || err != nil {
+		t.Errorf("Get of a missing key returned %d, %s, %v", n, last, err)
+	}
+
+	before := time.Now()
+	for want := 1; want <= 3; want++ {
+		n, err := c.Incr(ctx, "k", time.Hour)
+		if err != nil || n != want {
+			t.Fatalf("Incr returned %d, %v, want %d", n, err, want)
+		}
+	}
+	n, last, err := c.Get(ctx, "k")
+	if err != nil || n != 3 || last.Before(before.Add(-time.Second)) {
+		t.Errorf("Get returned %d, %s, %v", n, last, err)
+	}
+
+	// Reservations are counted but leave the time of the last
+	// failure alone.
+	if n, err := c.Reserve(ctx, "k", time.Hour); err != nil || n != 4 {
+		t.Fatalf("Reserve returned %d, %v, want 4", n, err)
+	}
+	if n, l, _ := c.Get(ctx, "k"); n != 4 || !l.Equal(last) {
+		t.Errorf("Get after Reserve returned %d, %s, want 4, %s", n, l, last)
+	}
+	if err := c.Decr(ctx, "k"); err != nil {
+		t.Fatalf("Decr: %v", err)
+	}
+	if n, l, _ := c.Get(ctx, "k"); n != 3 || !l.Equal(last) {
+		t.Errorf("Get after Decr returned %d, %s, want 3, %s", n, l, last)
+	}
+	if err := c.Reset(ctx, "k"); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if n := get("k"); n != 0 {
+		t.Errorf("Get after Reset returned %d", n)
+	}
+
+	// Taking back the only failure, or one that was never
+	// counted, leaves nothing behind.
+	c.Reserve(ctx, "once", time.Hour)
+	c.Decr(ctx, "once")
+	c.Decr(ctx, "once")
+	if n := get("once"); n != 0 {
+		t.Errorf("Get after taking back every failure returned %d", n)
+	}
+	if n, _ := c.Incr(ctx, "once", time.Hour); n != 1 {
+		t.Errorf("Incr after taking back every failure returned %d", n)
+	}
+
+	c.Incr(ctx, "short", 100*time.Millisecond)
+	wait(advance, 200*time.Millisecond)
+	if n := get("short"); n != 0 {
+		t.Errorf("Get of an expired key returned %d", n)
+	}
+	if n, _ := c.Incr(ctx, "short", time.Hour); n != 1 {
+		t.Errorf("Incr of an expired key returned %d", n)
+	}
+}
+
+// TOTP checks an authware.TOTPStore.
+func TOTP(t *testing.T, s authware.TOTPStore) {
+	t.Helper()
+	ctx := context.Background()
+	secret := []byte("0123456789abcdefghij")
+
+	if _, err := s.Get(ctx, "alice"); !isDoesNotExist(err) {
+		t.Errorf("Get before enrolling returned %v", err)
+	}
+	if _, err := s.UseStep(ctx, "alice", 1); !isDoesNotExist(err) {
+		t.Errorf("UseStep before enrolling returned %v", err)
+	}
+
+	if err := s.Put(ctx, "alice", authware.TOTPSecret{Secret: secret, LastStep: 3}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	got, err := s.Get(ctx, "alice")
+	if err != nil || !bytes.Equal(got.Secret, secret) || got.LastStep != 3 {
+		t.Fatalf("Get returned %+v, %v", got, err)
+	}
+
+	for _, c := range []struct {
+		step int64
+		want bool
+	}{{3, false}, {5, true}, {5, false}, {4, false}, {6, true}} {
+		if used, err := s.UseStep(ctx, "alice", c.step); used != c.want || err != nil {
+			t.Errorf("UseStep(%d) returned %t, %v, want %t", c.step, used, err, c.want)
+		}
+	}
+	if got, _ := s.Get(ctx, "alice"); got.LastStep != 6 || !bytes.Equal(got.Secret, secret) {
+		t.Errorf("Get after UseStep returned %+v", got)
+	}
+
+	var used atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := s.UseStep(ctx, "alice", 10); ok {
+				used.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := used.Load(); n != 1 {
+		t.Errorf("concurrent UseStep succeeded %d times", n)
+	}
+
+	if err := s.Delete(ctx, "alice"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get(ctx, "alice"); !isDoesNotExist(err) {
+		t.Errorf("Get after Delete returned %v", err)
+	}
+}
+
+// RecoveryCodes checks an authware.RecoveryCodeStore.
+func RecoveryCodes(t *testing.T, s authware.RecoveryCodeStore) {
+	t.Helper()
+	ctx := context.Background()
+	count := func() int {
+		t.Helper()
+		n, err := s.Count(ctx, "alice")
+		if err != nil {
+			t.Fatalf("Count: %v", err)
+		}
+		return n
+	}
+	hashes := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+
+	if n := count(); n != 0 {
+		t.Errorf("Count before issuing returned %d", n)
+	}
+	if err := s.Use(ctx, "alice", hashes[0]); !isDoesNotExist(err) {
+		t.Errorf("Use before issuing returned %v", err)
+	}
+
+	if err := s.Put(ctx, "alice", hashes); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if n := count(); n != 3 {
+		t.Errorf("Count returned %d", n)
+	}
+	if err := s.Use(ctx, "alice", hashes[0]); err != nil {
+		t.Errorf("Use: %v", err)
+	}
+	if err := s.Use(ctx, "alice", hashes[0]); !isDoesNotExist(err) {
+		t.Errorf("second Use of a code returned %v", err)
+	}
+	if err := s.Use(ctx, "bob", hashes[1]); !isDoesNotExist(err) {
+		t.Errorf("Use of another identity's code returned %v", err)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("Count after Use returned %d", n)
+	}
+
+	var used atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.Use(ctx, "alice", hashes[1]) == nil {
+				used.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := used.Load(); n != 1 {
+		t.Errorf("concurrent Use succeeded %d times", n)
+	}
+
+	if err := s.Put(ctx, "alice", hashes[:1]); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if n := count(); n != 1 {
+		t.Errorf("Put did not replace the codes, Count returned %d", n)
+	}
+	if err := s.Put(ctx, "alice", nil); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if n := count(); n != 0 {
+		t.Errorf("Count after removing the codes returned %d", n)
+	}
+}
+
+// WebAuthn checks a webauthn.CredentialStore.
+func WebAuthn(t *testing.T, s webauthn.CredentialStore) {
+	t.Helper()
+	ctx := context.Background()
+	cred := func(id string, count uint32) webauthn.Credential {
+		return webauthn.Credential{
+			Credential: webauthnlib.Credential{
+				ID:            []byte(id),
+				PublicKey:     []byte("key-" + id),
+				Authenticator: webauthnlib.Authenticator{SignCount: count},
+			},
+			Backend: "test",
+		}
+	}
+	get := func() map[string]webauthn.Credential {
+		t.Helper()
+		creds, err := s.Get(ctx, "alice")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		out := make(map[string]webauthn.Credential)
+		for _, c := range creds {
+			out[string(c.ID)] = c
+		}
+		return out
+	}
+
+	if creds := get(); len(creds) != 0 {
+		t.Errorf("Get before registering returned %v", creds)
+	}
+
+	for _, c := range []webauthn.Credential{cred("one", 0), cred("two", 0)} {
+		if err := s.Put(ctx, "alice", c); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	creds := get()
+	if len(creds) != 2 || creds["one"].Backend != "test" || !bytes.Equal(creds["one"].PublicKey, []byte("key-one")) {
+		t.Fatalf("Get returned %+v", creds)
+	}
+
+	if err := s.Put(ctx, "alice", cred("one", 7)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	creds = get()
+	if len(creds) != 2 || creds["one"].Authenticator.SignCount != 7 {
+		t.Errorf("Put did not replace the credential: %+v", creds)
+	}
+
+	if err := s.Delete(ctx, "alice", []byte("one")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := s.Delete(ctx, "alice", []byte("missing")); err != nil {
+		t.Errorf("Delete of a missing credential returned %v", err)
+	}
+	creds = get()
+	if _, ok := creds["two"]; len(creds) != 1 || !ok {
+		t.Errorf("Get after Delete returned %+v", creds)
+	}
+}
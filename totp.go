@@ -0,0 +1,373 @@
+package authware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Codes are the parameters that every authenticator app supports, and
+// so they are not configurable.
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	totpModulo = 1000000
+)
+
+// enrollFlow names the flow state that holds a new secret until the
+// user confirms it, which they have enrollLifetime to do.
+const (
+	enrollFlow     = "totp_enroll"
+	enrollLifetime = 10 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPSecret is the enrollment of a single identity.
+type TOTPSecret struct {
+	Secret []byte
+
+	// LastStep is the time step of the most recently accepted
+	// code.  Codes from that step or earlier are rejected so that
+	// each code can only be used once.
+	LastStep int64
+}
+
+// TOTPStore holds the secrets of identities that have enrolled for
+// TOTP.  Identities that have a secret must present a code after
+// their password.
+type TOTPStore interface {
+	// Get returns the enrollment of an identity, or
+	// ErrDoesNotExist if the identity has not enrolled.
+	Get(ctx context.Context, identity string) (TOTPSecret, error)
+
+	// Put stores the enrollment of an identity, replacing any
+	// previous enrollment.
+	Put(ctx context.Context, identity string, secret TOTPSecret) error
+
+	// UseStep sets the LastStep of an identity to step if it is
+	// currently earlier, and returns false if it is not.  It
+	// returns ErrDoesNotExist if the identity has not enrolled.
+	// It must be atomic, so that each code can only be used once.
+	UseStep(ctx context.Context, identity string, step int64) (bool, error)
+
+	// Delete removes the enrollment of an identity, which will
+	// then log in with only a password.
+	Delete(ctx context.Context, identity string) error
+}
+
+// TOTPOptions enables time based one time passwords (RFC 6238) as a
+// second factor for LoginFormHandler.  Codes are 6 digits, change
+// every 30 seconds, and use HMAC-SHA1, which is what authenticator
+// apps expect.
+type TOTPOptions struct {
+	// Store holds the secrets of enrolled identities, and is
+	// required.
+	Store TOTPStore
+
+	// Issuer is shown alongside the identity in authenticator
+	// apps.  It defaults to "authware".
+	Issuer string
+
+	// Path is where the form that collects the code is served.
+	// LoginFormHandler redirects enrolled users here after their
+	// password is accepted.  It defaults to "/login/totp".
+	Path string
+
+	// Skew is the number of time steps either side of the current
+	// one that are accepted, to allow for clock drift.  It
+	// defaults to 1.
+	Skew int
+
+	// Lifetime is how long a user has to enter a code after their
+	// password is accepted.  It defaults to 5 minutes.
+	Lifetime time.Duration
+}
+
+func (t *TOTPOptions) setDefaults() {
+	if t.Issuer == "" {
+		t.Issuer = "authware"
+	}
+	if t.Path == "" {
+		t.Path = "/login/totp"
+	}
+	if t.Skew <= 0 {
+		t.Skew = 1
+	}
+	if t.Lifetime <= 0 {
+		t.Lifetime = 5 * time.Minute
+	}
+}
+
+// totpEnrollment is held in flow state between offering a new secret
+// and the user confirming it with a code.
+type totpEnrollment struct {
+	Identity string
+	Secret   []byte
+}
+
+// totpCode computes the code for a secret at a time step, as
+// described in RFC 4226.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%totpModulo)
+}
+
+// match returns the time step of the code if it is valid for the
+// secret and has not been used before.
+func (t *TOTPOptions) match(secret TOTPSecret, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for i := -t.Skew; i <= t.Skew; i++ {
+		step := current + int64(i)
+		if step <= secret.LastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret.Secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// URI returns the otpauth:// URI that authenticator apps accept,
+// usually by way of a QR code.
+func (t *TOTPOptions) URI(identity string, secret []byte) string {
+	u := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + t.Issuer + ":" + identity,
+	}
+	q := url.Values{}
+	q.Set("secret", totpEncoding.EncodeToString(secret))
+	q.Set("issuer", t.Issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// totpFactor offers TOTP to LoginFormHandler as a SecondFactor.
+type totpFactor struct {
+	t *TOTPOptions
+}
+
+func (f totpFactor) Enrolled(ctx context.Context, identity string) (bool, error) {
+	_, err := f.t.Store.Get(ctx, identity)
+	if errors.Is(err, ErrDoesNotExist{}) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (f totpFactor) Path() string { return f.t.Path }
+
+// verifyTOTP checks a code for an identity and records its time step
+// so that it cannot be used again.
+func (b *BasicMiddleware) verifyTOTP(ctx context.Context, identity, code string) error {
+	secret, err := b.totp.Store.Get(ctx, identity)
+	if err != nil {
+		return err
+	}
+	step, ok := b.totp.match(secret, code, time.Now())
+	if !ok {
+		return ErrUnauthenticated{}
+	}
+	used, err := b.totp.Store.UseStep(ctx, identity, step)
+	if err != nil {
+		return err
+	}
+	if !used {
+		slog.Debug("Rejecting TOTP code that was used concurrently", "user", identity)
+		return ErrUnauthenticated{}
+	}
+	return nil
+}
+
+// TOTPFormHandler responds to the submission of the form served at
+// TOTPOptions.Path.  If the code is valid for the user whose password
+// was just accepted, the session is issued and the user is sent on to
+// wherever LoginFormHandler would have sent them.  Codes are subject
+// to the same rate limits as passwords.
+func (b *BasicMiddleware) TOTPFormHandler(codeField string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if b.totp == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Form must contain %s as a field\n", codeField)
+			return
+		}
+
+		if b.loginCSRF && !b.checkCSRF(r) {
+			slog.Debug("Denying second factor with missing or invalid CSRF token")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, "Invalid CSRF Token")
+			return
+		}
+
+		user, err := b.PendingUser(r)
+		if err != nil {
+			slog.Debug("Denying second factor without a pending login", "error", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Login Expired")
+			return
+		}
+
+		// The pending login is left in place on failure so that
+		// the user can try again until it expires.
+		id := limitKey{key: "totp:" + user.Identity, threshold: b.limits.IdentityThreshold}
+		_, err = b.rateLimited(r, []limitKey{id, b.ipLimitKey(r)}, &id, func() (User, error) {
+			return user, b.verifyTOTP(r.Context(), user.Identity, r.FormValue(codeField))
+		})
+		if rl, ok := err.(ErrRateLimited); ok {
+			writeRateLimited(w, rl)
+			return
+		}
+		if err != nil {
+			slog.Debug("Denying login after an invalid code", "user", user.Identity)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Access Denied")
+			return
+		}
+
+		next, err := b.CompletePendingLogin(w, r, AMROneTimeCode)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			slog.Error("Error creating session", "error", err)
+			return
+		}
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	}
+}
+
+// BeginTOTPEnrollment generates a new secret for the user and holds
+// it until the user confirms it by POSTing a code to
+// TOTPEnrollHandler.  The secret is returned both in base32 and as an
+// otpauth:// URI, for applications that render their own enrollment
+// page.
+func (b *BasicMiddleware) BeginTOTPEnrollment(w http.ResponseWriter, user User) (string, string, error) {
+	if b.totp == nil {
+		return "", "", ErrDoesNotExist{}
+	}
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	e := totpEnrollment{Identity: user.Identity, Secret: secret}
+	if err := b.SetFlowState(w, enrollFlow, e, enrollLifetime); err != nil {
+		return "", "", err
+	}
+	return totpEncoding.EncodeToString(secret), b.totp.URI(user.Identity, secret), nil
+}
+
+// TOTPEnrollHandler enrolls the user in the request context for
+// TOTP, and so must be placed behind LoginHandler or another
+// authenticating handler.  A GET generates a new secret and returns
+// it as JSON along with its otpauth:// URI.  The secret is not used
+// until the user proves that their authenticator app has it by
+// POSTing a valid code in codeField.  A user that is already enrolled
+// may only replace their secret if their session shows that they
+// logged in within RecentAuthAge, so a stolen session cookie
+// cannot be used to take over the second factor.
+func (b *BasicMiddleware) TOTPEnrollHandler(codeField string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if b.totp == nil {
+			http.NotFound(w, r)
+			return
+		}
+		user, ok := UserFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Authentication Required")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			secret, uri, err := b.BeginTOTPEnrollment(w, user)
+			if err != nil {
+				slog.Error("Error storing TOTP enrollment", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintln(w, "Internal Server Error")
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			json.NewEncoder(w).Encode(struct {
+				Secret string `json:"secret"`
+				URI    string `json:"uri"`
+			}{secret, uri})
+		case http.MethodPost:
+			if !b.checkCSRF(r) {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintln(w, "Invalid CSRF Token")
+				return
+			}
+			_, err := b.totp.Store.Get(r.Context(), user.Identity)
+			if err != nil && !errors.Is(err, ErrDoesNotExist{}) {
+				slog.Error("Error loading TOTP secret", "user", user.Identity, "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintln(w, "Internal Server Error")
+				return
+			}
+			if err == nil && !b.RecentlyAuthenticated(r, RecentAuthAge) {
+				slog.Info("Refusing to replace TOTP secret without a recent login", "user", user.Identity)
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintln(w, "Recent Login Required")
+				return
+			}
+
+			var e totpEnrollment
+			if err := b.TakeFlowState(w, r, enrollFlow, &e); err != nil || e.Identity != user.Identity {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, "No Enrollment In Progress")
+				return
+			}
+			step, ok := b.totp.match(TOTPSecret{Secret: e.Secret}, r.FormValue(codeField), time.Now())
+			if !ok {
+				// Keep the enrollment so the user can
+				// try another code.
+				b.SetFlowState(w, enrollFlow, e, enrollLifetime)
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintln(w, "Invalid Code")
+				return
+			}
+			if err := b.totp.Store.Put(r.Context(), user.Identity, TOTPSecret{Secret: e.Secret, LastStep: step}); err != nil {
+				slog.Error("Error storing TOTP secret", "user", user.Identity, "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintln(w, "Internal Server Error")
+				return
+			}
+			slog.Info("Enrolled user for TOTP", "user", user.Identity)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package authware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memoryTOTP is a TOTPStore for tests.
+type memoryTOTP struct {
+	mu      sync.Mutex
+	secrets map[string]TOTPSecret
+}
+
+func (m *memoryTOTP) Get(ctx context.Context, identity string) (TOTPSecret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.secrets[identity]
+	if !ok {
+		return TOTPSecret{}, ErrDoesNotExist{}
+	}
+	return s, nil
+}
+
+func (m *memoryTOTP) Put(ctx context.Context, identity string, secret TOTPSecret) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.secrets[identity] = secret
+	return nil
+}
+
+func (m *memoryTOTP) UseStep(ctx context.Context, identity string, step int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.secrets[identity]
+	if !ok {
+		return false, ErrDoesNotExist{}
+	}
+	if step <= s.LastStep {
+		return false, nil
+	}
+	s.LastStep = step
+	m.secrets[identity] = s
+	return true, nil
+}
+
+func (m *memoryTOTP) Delete(ctx context.Context, identity string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.secrets, identity)
+	return nil
+}
+
+func newTOTPMiddleware(t *testing.T) (*BasicMiddleware, *memoryTOTP) {
+	t.Helper()
+	store := &memoryTOTP{secrets: make(map[string]TOTPSecret)}
+	b, err := NewAuth(WithAuthenticators(), WithTOTP(TOTPOptions{Store: store}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, store
+}
+
+// testBrowser carries cookies between requests.
+type testBrowser map[string]*http.Cookie
+
+func (tb testBrowser) request(method, target string, form url.Values) *http.Request {
+	var r *http.Request
+	if form != nil {
+		r = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r = httptest.NewRequest(method, target, nil)
+	}
+	for _, c := range tb {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func (tb testBrowser) keep(w *httptest.ResponseRecorder) {
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(tb, c.Name)
+		} else {
+			tb[c.Name] = c
+		}
+	}
+}
+
+func (tb testBrowser) do(h http.Handler, method, target string, form url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, tb.request(method, target, form))
+	tb.keep(w)
+	return w
+}
+
+// login gives the browser a session for the identity that records a
+// login at authTime.
+func (tb testBrowser) login(t *testing.T, b *BasicMiddleware, identity string, authTime time.Time) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if err := b.issueSession(w, tb.request(http.MethodGet, "/", nil), User{Identity: identity}, authTime, []string{AMRPassword}); err != nil {
+		t.Fatal(err)
+	}
+	tb.keep(w)
+}
+
+// enroll runs TOTPEnrollHandler as a logged in user and returns the
+// status of the POST and the secret that was offered.
+func (tb testBrowser) enroll(t *testing.T, b *BasicMiddleware) (int, []byte) {
+	t.Helper()
+	h := b.LoginHandler("/login")(b.TOTPEnrollHandler("code"))
+
+	w := tb.do(h, http.MethodGet, "/enroll", nil)
+	var offer struct{ Secret string }
+	if err := json.NewDecoder(w.Body).Decode(&offer); err != nil {
+		t.Fatalf("enrollment GET returned %d: %v", w.Code, err)
+	}
+	secret, err := totpEncoding.DecodeString(offer.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := b.CurrentSession(tb.request(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{
+		"code":        {totpCode(secret, time.Now().Unix()/totpPeriod)},
+		CSRFFieldName: {session.CSRFToken},
+	}
+	return tb.do(h, http.MethodPost, "/enroll", form).Code, secret
+}
+
+func TestTOTPEnroll(t *testing.T) {
+	b, store := newTOTPMiddleware(t)
+
+	tb := testBrowser{}
+	tb.login(t, b, "alice", time.Now().Add(-time.Hour))
+	code, secret := tb.enroll(t, b)
+	if code != http.StatusNoContent {
+		t.Fatalf("first enrollment returned %d", code)
+	}
+	if s, err := store.Get(context.Background(), "alice"); err != nil || string(s.Secret) != string(secret) {
+		t.Errorf("secret was not stored: %v", err)
+	}
+}
+
+func TestTOTPReenrollRequiresRecentLogin(t *testing.T) {
+	b, store := newTOTPMiddleware(t)
+	original := TOTPSecret{Secret: []byte("0123456789abcdefghij")}
+	store.Put(context.Background(), "alice", original)
+
+	tb := testBrowser{}
+	tb.login(t, b, "alice", time.Now().Add(-time.Hour))
+	if code, _ := tb.enroll(t, b); code != http.StatusForbidden {
+		t.Errorf("expected 403 without a recent login, got %d", code)
+	}
+	if s, _ := store.Get(context.Background(), "alice"); string(s.Secret) != string(original.Secret) {
+		t.Error("secret was replaced without a recent login")
+	}
+
+	tb = testBrowser{}
+	tb.login(t, b, "alice", time.Now())
+	code, secret := tb.enroll(t, b)
+	if code != http.StatusNoContent {
+		t.Errorf("expected 204 after a recent login, got %d", code)
+	}
+	if s, _ := store.Get(context.Background(), "alice"); string(s.Secret) != string(secret) {
+		t.Error("secret was not replaced after a recent login")
+	}
+}
+
+func TestVerifyTOTPConcurrent(t *testing.T) {
+	b, store := newTOTPMiddleware(t)
+	secret := []byte("0123456789abcdefghij")
+	store.Put(context.Background(), "alice", TOTPSecret{Secret: secret})
+	code := totpCode(secret, time.Now().Unix()/totpPeriod)
+
+	var accepted atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b.verifyTOTP(context.Background(), "alice", code) == nil {
+				accepted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("code was accepted %d times", n)
+	}
+}
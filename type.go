@@ -4,14 +4,18 @@ import (
 	"context"
 	"net/http"
 	"time"
-
-	"github.com/meehow/securebytes"
 )
 
 // A Factory is an initializer that makes a concrete insantiation of
 // an auth method.
 type Factory func() (Authenticator, error)
 
+// A ConfigFactory is an initializer that obtains its configuration
+// by passing a pointer to its config structure to the provided decode
+// function, and then makes a concrete instantiation of an auth
+// method.
+type ConfigFactory func(decode func(any) error) (Authenticator, error)
+
 // Authenticator authenticates a user based on some information they
 // have provided.  If an authenticator cannot satisfy a given request,
 // it should return non-nil and the next authenticator in the chain
@@ -23,6 +27,15 @@ type Authenticator interface {
 	Name() string
 }
 
+// TokenAuthenticator authenticates a request based on an opaque
+// token, such as an API key, rather than a username and password.
+// Since the token alone identifies the user, a successful
+// authentication returns the complete User.
+type TokenAuthenticator interface {
+	AuthToken(context.Context, string) (User, error)
+	Name() string
+}
+
 // The UserKey type exists purely as a key to insert into the
 // http.Request contxt so that a user can be fished out by
 // applications that want to have access to it later.
@@ -55,16 +68,56 @@ type Middleware func(http.Handler) http.Handler
 // BasicMiddleware inserts HTTP basic auth requirements into the
 // handler chain.
 type BasicMiddleware struct {
-	a []Authenticator
+	a     []Authenticator
+	t     []TokenAuthenticator
+	cache *resultCache
 
-	sb *securebytes.SecureBytes
+	keys             *Keyring
+	store            SessionStore
+	sessionLifetime  time.Duration
+	idleTimeout      time.Duration
+	refreshThreshold time.Duration
+	cookie           CookieOptions
+	redirect         RedirectOptions
+	loginCSRF        bool
+	limits           RateLimitOptions
+	header           HeaderOptions
+	clientCert       *ClientCertOptions
+	totp             *TOTPOptions
+	factors          []SecondFactor
+	recovery         *RecoveryOptions
+	mfa              MFAPolicy
 
 	cookieHandler Middleware
 }
 
 // Session contains the information that is encoded into the session
-// cookie.
+// cookie, or held in the SessionStore if one is configured.
 type Session struct {
+	ID string
+
+	// IssuedAt is when the user logged in.  A session can never
+	// be extended beyond IssuedAt plus the session lifetime.
+	IssuedAt time.Time
+
+	// Expires is when the session stops being valid.  If an idle
+	// timeout is configured, this is pushed forward as the
+	// session is used.
 	Expires time.Time
-	User    User
+
+	// CSRFToken must accompany unsafe requests made using this
+	// session.
+	CSRFToken string
+
+	// AuthTime is when the user last presented their credentials.
+	// RequireRecentAuth compares against it.  It is zero if the
+	// time is not known, such as when an identity provider did
+	// not report it.
+	AuthTime time.Time
+
+	// AMR lists the methods the user authenticated with, using
+	// the values from RFC 8176 such as AMRPassword.
+	AMR []string
+
+	User User
 }
@@ -0,0 +1,324 @@
+package webauthn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	webauthnlib "github.com/go-webauthn/webauthn/webauthn"
+
+	"github.com/the-maldridge/authware"
+)
+
+// registration is the state of a registration ceremony in progress.
+type registration struct {
+	Identity string
+	Backend  string
+	Session  webauthnlib.SessionData
+}
+
+// login is the state of a login ceremony in progress.  Identity is
+// empty for a passwordless login, where the user is not known until
+// the authenticator names them.
+type login struct {
+	Identity string
+	Next     string
+	Session  webauthnlib.SessionData
+}
+
+// guardRegistration refuses registration requests that do not carry
+// the CSRF token, or that come from a user who has not logged in
+// within authware.RecentAuthAge.  A new passkey logs the user in
+// without a password if Passwordless is enabled, so a stolen session
+// cookie must not be enough to add one.
+func (rp *RelyingParty) guardRegistration(h http.Handler) http.Handler {
+	csrf := rp.b.CSRFHandler()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rp.b.RecentlyAuthenticated(r, authware.RecentAuthAge) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, "Recent Login Required")
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := authware.UserFromContext(r.Context()); !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Authentication Required")
+			return
+		}
+		csrf.ServeHTTP(w, r)
+	})
+}
+
+// RegisterBeginHandler starts registering a new credential for the
+// user in the request context, and so must be placed behind
+// LoginHandler.  It responds with the options to pass to
+// navigator.credentials.create().  The request must carry the CSRF
+// token, and the user must have logged in within
+// authware.RecentAuthAge.
+func (rp *RelyingParty) RegisterBeginHandler() http.Handler {
+	return rp.guardRegistration(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current, ok := authware.UserFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Authentication Required")
+			return
+		}
+		if len(current.Identity) > 64 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "Identity Too Long")
+			return
+		}
+
+		u, err := rp.loadUser(r.Context(), current.Identity)
+		if err != nil {
+			rp.internalError(w, "Error loading WebAuthn credentials", err)
+			return
+		}
+
+		// Passwordless logins look up groups in the backend that
+		// the user belongs to, so the credential must remember
+		// which backend that is.
+		backend := current.AuthedBy
+		if backend == rp.Name() && len(u.creds) > 0 {
+			backend = u.creds[0].Backend
+		}
+		if _, err := rp.b.LookupUser(r.Context(), current.Identity, backend); err != nil {
+			slog.Debug("Refusing WebAuthn registration outside of a backend", "user", current.Identity, "backend", backend)
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, "Registration Not Permitted")
+			return
+		}
+
+		opts := []webauthnlib.RegistrationOption{
+			webauthnlib.WithExclusions(webauthnlib.Credentials(u.WebAuthnCredentials()).CredentialDescriptors()),
+		}
+		if rp.passwordless {
+			opts = append(opts, webauthnlib.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired))
+		}
+		creation, session, err := rp.w.BeginRegistration(u, opts...)
+		if err != nil {
+			rp.internalError(w, "Error beginning WebAuthn registration", err)
+			return
+		}
+
+		reg := registration{Identity: current.Identity, Backend: backend, Session: *session}
+		if err := rp.b.SetFlowState(w, registerFlow, reg, ceremonyLifetime); err != nil {
+			rp.internalError(w, "Error saving WebAuthn registration state", err)
+			return
+		}
+		writeJSON(w, creation)
+	}))
+}
+
+// RegisterFinishHandler verifies the response of
+// navigator.credentials.create() and stores the new credential.  It
+// must be placed behind LoginHandler, and the user must be the same
+// one that began the registration.  It is guarded in the same way as
+// RegisterBeginHandler.
+func (rp *RelyingParty) RegisterFinishHandler() http.Handler {
+	return rp.guardRegistration(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current, ok := authware.UserFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Authentication Required")
+			return
+		}
+
+		var reg registration
+		if err := rp.b.TakeFlowState(w, r, registerFlow, &reg); err != nil || reg.Identity != current.Identity {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "No Registration In Progress")
+			return
+		}
+
+		u, err := rp.loadUser(r.Context(), reg.Identity)
+		if err != nil {
+			rp.internalError(w, "Error loading WebAuthn credentials", err)
+			return
+		}
+		cred, err := rp.w.FinishRegistration(u, reg.Session, r)
+		if err != nil {
+			slog.Debug("Rejecting WebAuthn registration", "user", reg.Identity, "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "Registration Failed")
+			return
+		}
+
+		if err := rp.store.Put(r.Context(), reg.Identity, Credential{Credential: *cred, Backend: reg.Backend}); err != nil {
+			rp.internalError(w, "Error storing WebAuthn credential", err)
+			return
+		}
+		slog.Info("Registered WebAuthn credential", "user", reg.Identity)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// LoginBeginHandler starts a login ceremony and responds with the
+// options to pass to navigator.credentials.get().  If the client has
+// a pending login from LoginFormHandler, only that user's credentials
+// are accepted.  Otherwise the ceremony is a passwordless one, which
+// must be enabled, and any passkey registered here is accepted.  The
+// next query parameter is carried through a passwordless login in the
+// same way as it is for LoginFormHandler.
+func (rp *RelyingParty) LoginBeginHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var l login
+		var assertion *protocol.CredentialAssertion
+		var session *webauthnlib.SessionData
+		var err error
+
+		if pending, perr := rp.b.PendingUser(r); perr == nil {
+			var u user
+			if u, err = rp.loadUser(r.Context(), pending.Identity); err != nil {
+				rp.internalError(w, "Error loading WebAuthn credentials", err)
+				return
+			}
+			if len(u.creds) == 0 {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintln(w, "No Credentials Registered")
+				return
+			}
+			l.Identity = pending.Identity
+			assertion, session, err = rp.w.BeginLogin(u)
+		} else if rp.passwordless {
+			l.Next = rp.b.SafeNext(r.URL.Query().Get("next"), rp.defaultNext)
+			assertion, session, err = rp.w.BeginDiscoverableLogin()
+		} else {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Login Expired")
+			return
+		}
+		if err != nil {
+			rp.internalError(w, "Error beginning WebAuthn login", err)
+			return
+		}
+
+		l.Session = *session
+		if err := rp.b.SetFlowState(w, loginFlow, l, ceremonyLifetime); err != nil {
+			rp.internalError(w, "Error saving WebAuthn login state", err)
+			return
+		}
+		writeJSON(w, assertion)
+	})
+}
+
+// LoginFinishHandler verifies the response of
+// navigator.credentials.get().  If it is valid, the same session
+// cookie that LoginFormHandler issues is set, and the response names
+// where the browser should go next as {"redirect": "..."}.
+func (rp *RelyingParty) LoginFinishHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var l login
+		if err := rp.b.TakeFlowState(w, r, loginFlow, &l); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, "No Login In Progress")
+			return
+		}
+
+		var next string
+		var err error
+		if l.Identity != "" {
+			next, err = rp.finishSecondFactor(w, r, l)
+		} else {
+			next, err = rp.finishPasswordless(w, r, l)
+		}
+		if errors.Is(err, authware.ErrUnauthenticated{}) {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, "Access Denied")
+			return
+		}
+		if err != nil {
+			rp.internalError(w, "Error completing WebAuthn login", err)
+			return
+		}
+
+		writeJSON(w, struct {
+			Redirect string `json:"redirect"`
+		}{next})
+	})
+}
+
+// finishSecondFactor verifies an assertion from the user with a
+// pending login and completes that login.
+func (rp *RelyingParty) finishSecondFactor(w http.ResponseWriter, r *http.Request, l login) (string, error) {
+	pending, err := rp.b.PendingUser(r)
+	if err != nil || pending.Identity != l.Identity {
+		slog.Debug("WebAuthn login does not match the pending login", "user", l.Identity)
+		return "", authware.ErrUnauthenticated{}
+	}
+	u, err := rp.loadUser(r.Context(), l.Identity)
+	if err != nil {
+		return "", err
+	}
+	cred, err := rp.w.FinishLogin(u, l.Session, r)
+	if err != nil {
+		slog.Debug("Rejecting WebAuthn assertion", "user", l.Identity, "error", err)
+		return "", authware.ErrUnauthenticated{}
+	}
+	if err := rp.update(r, u, cred); err != nil {
+		return "", err
+	}
+	return rp.b.CompletePendingLogin(w, r, authware.AMRHardwareKey)
+}
+
+// finishPasswordless verifies an assertion from a passkey, looks up
+// the user it belongs to, and starts a session for them.
+func (rp *RelyingParty) finishPasswordless(w http.ResponseWriter, r *http.Request, l login) (string, error) {
+	var u user
+	handler := func(rawID, userHandle []byte) (webauthnlib.User, error) {
+		var err error
+		u, err = rp.loadUser(r.Context(), string(userHandle))
+		return u, err
+	}
+	cred, err := rp.w.FinishDiscoverableLogin(handler, l.Session, r)
+	if err != nil {
+		slog.Debug("Rejecting WebAuthn assertion", "error", err)
+		return "", authware.ErrUnauthenticated{}
+	}
+	if err := rp.update(r, u, cred); err != nil {
+		return "", err
+	}
+
+	stored, _ := u.find(cred.ID)
+	current, err := rp.b.LookupUser(r.Context(), u.identity, stored.Backend)
+	if err != nil {
+		slog.Info("Rejecting passkey for user unknown to its backend", "user", u.identity, "backend", stored.Backend, "error", err)
+		return "", authware.ErrUnauthenticated{}
+	}
+	current.AuthedBy = rp.Name()
+	if err := rp.b.StartSession(w, r, current, authware.AMRHardwareKey); err != nil {
+		return "", err
+	}
+	return rp.b.SafeNext(l.Next, rp.defaultNext), nil
+}
+
+// update stores the sign count of a credential after it has been
+// used.  Credentials that appear to have been cloned are refused.
+func (rp *RelyingParty) update(r *http.Request, u user, cred *webauthnlib.Credential) error {
+	if cred.Authenticator.CloneWarning {
+		slog.Warn("Refusing WebAuthn credential that may have been cloned", "user", u.identity)
+		return authware.ErrUnauthenticated{}
+	}
+	stored, ok := u.find(cred.ID)
+	if !ok {
+		return authware.ErrUnauthenticated{}
+	}
+	stored.Credential = *cred
+	return rp.store.Put(r.Context(), u.identity, stored)
+}
+
+func (rp *RelyingParty) internalError(w http.ResponseWriter, msg string, err error) {
+	slog.Error(msg, "error", err)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintln(w, "Internal Server Error")
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,214 @@
+package webauthn
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	webauthnlib "github.com/go-webauthn/webauthn/webauthn"
+
+	"github.com/the-maldridge/authware"
+)
+
+// Ceremonies keep their state in flow state, and must be completed
+// within ceremonyLifetime.
+const (
+	registerFlow     = "webauthn_register"
+	loginFlow        = "webauthn_login"
+	ceremonyLifetime = 5 * time.Minute
+)
+
+// Credential is an authenticator that has been registered to an
+// identity.
+type Credential struct {
+	webauthnlib.Credential
+
+	// Backend is the backend that the identity belonged to when
+	// the credential was registered.  Logins without a password
+	// look up the user's groups there.
+	Backend string
+}
+
+// CredentialStore holds the credentials registered to each identity.
+type CredentialStore interface {
+	// Get returns the credentials registered to an identity.  An
+	// identity with no credentials returns an empty list.
+	Get(ctx context.Context, identity string) ([]Credential, error)
+
+	// Put adds a credential to an identity, replacing any
+	// credential with the same ID.
+	Put(ctx context.Context, identity string, cred Credential) error
+
+	// Delete removes the credential with the given ID from an
+	// identity.
+	Delete(ctx context.Context, identity string, id []byte) error
+}
+
+// Config contains the settings for the WebAuthn relying party.
+type Config struct {
+	// RPID is the domain that credentials are scoped to, such as
+	// "example.com".  It must be the host of every origin, or a
+	// parent domain of it.
+	RPID string `mapstructure:"rp_id"`
+
+	// RPDisplayName is shown by the browser during ceremonies.
+	// It defaults to "authware".
+	RPDisplayName string `mapstructure:"rp_display_name"`
+
+	// RPOrigins lists the origins, such as
+	// "https://app.example.com", that ceremonies may be performed
+	// from.
+	RPOrigins []string `mapstructure:"rp_origins"`
+
+	// LoginPath is where the page that performs the login
+	// ceremony is served.  LoginFormHandler sends users that have
+	// registered a credential here once their password has been
+	// accepted.  It defaults to "/login/webauthn".
+	LoginPath string `mapstructure:"login_path"`
+
+	// Passwordless allows users to log in with a passkey alone,
+	// without first entering a password.
+	Passwordless bool `mapstructure:"passwordless"`
+
+	// DefaultNext is where users are sent after a passwordless
+	// login that did not carry a next parameter.  It defaults to
+	// "/".
+	DefaultNext string `mapstructure:"default_next"`
+
+	// Store holds the registered credentials, and is required.
+	Store CredentialStore `mapstructure:"-"`
+}
+
+// RelyingParty performs WebAuthn registration and login ceremonies,
+// and issues sessions through a BasicMiddleware.
+type RelyingParty struct {
+	b     *authware.BasicMiddleware
+	w     *webauthnlib.WebAuthn
+	store CredentialStore
+
+	loginPath    string
+	passwordless bool
+	defaultNext  string
+}
+
+// ConfigFromEnv obtains the relying party configuration from
+// AUTHWARE_WEBAUTHN_RP_ID, AUTHWARE_WEBAUTHN_RP_DISPLAY_NAME,
+// AUTHWARE_WEBAUTHN_RP_ORIGINS (comma separated),
+// AUTHWARE_WEBAUTHN_LOGIN_PATH, and AUTHWARE_WEBAUTHN_PASSWORDLESS.
+// The Store must still be provided.
+func ConfigFromEnv() Config {
+	cfg := Config{
+		RPID:          os.Getenv("AUTHWARE_WEBAUTHN_RP_ID"),
+		RPDisplayName: os.Getenv("AUTHWARE_WEBAUTHN_RP_DISPLAY_NAME"),
+		LoginPath:     os.Getenv("AUTHWARE_WEBAUTHN_LOGIN_PATH"),
+		Passwordless:  os.Getenv("AUTHWARE_WEBAUTHN_PASSWORDLESS") == "true",
+	}
+	if origins := os.Getenv("AUTHWARE_WEBAUTHN_RP_ORIGINS"); origins != "" {
+		cfg.RPOrigins = strings.Split(origins, ",")
+	}
+	return cfg
+}
+
+// New returns a relying party that issues sessions through b.  It is
+// also added to b as a second factor, so users that have registered a
+// credential must use it after entering their password.
+func New(cfg Config, b *authware.BasicMiddleware) (*RelyingParty, error) {
+	if cfg.RPID == "" {
+		slog.Error("Missing required config value", "key", "RPID")
+		return nil, fmt.Errorf("must specify a WebAuthn RPID")
+	}
+	if len(cfg.RPOrigins) == 0 {
+		slog.Error("Missing required config value", "key", "RPOrigins")
+		return nil, fmt.Errorf("must specify at least one WebAuthn RPOrigin")
+	}
+	if cfg.Store == nil {
+		slog.Error("Missing required config value", "key", "Store")
+		return nil, fmt.Errorf("must specify a WebAuthn Store")
+	}
+	if cfg.RPDisplayName == "" {
+		cfg.RPDisplayName = "authware"
+	}
+	if cfg.LoginPath == "" {
+		cfg.LoginPath = "/login/webauthn"
+	}
+	if cfg.DefaultNext == "" {
+		cfg.DefaultNext = "/"
+	}
+
+	w, err := webauthnlib.New(&webauthnlib.Config{
+		RPID:          cfg.RPID,
+		RPDisplayName: cfg.RPDisplayName,
+		RPOrigins:     cfg.RPOrigins,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	x := &RelyingParty{
+		b:            b,
+		w:            w,
+		store:        cfg.Store,
+		loginPath:    cfg.LoginPath,
+		passwordless: cfg.Passwordless,
+		defaultNext:  cfg.DefaultNext,
+	}
+	b.AddSecondFactor(x)
+
+	slog.Info("Initialized", "webauthn", cfg.RPID)
+	return x, nil
+}
+
+// Name is recorded as the AuthedBy of users that log in without a
+// password.
+func (rp *RelyingParty) Name() string { return "webauthn" }
+
+// Enrolled returns true if the identity has registered a credential.
+func (rp *RelyingParty) Enrolled(ctx context.Context, identity string) (bool, error) {
+	creds, err := rp.store.Get(ctx, identity)
+	return len(creds) > 0, err
+}
+
+// Path is where LoginFormHandler sends users that must use their
+// credential.
+func (rp *RelyingParty) Path() string { return rp.loginPath }
+
+// user presents an identity and its credentials to the WebAuthn
+// library.  The identity is used as the user handle so that a
+// passkey can be traced back to its owner without a username.
+type user struct {
+	identity string
+	creds    []Credential
+}
+
+func (u user) WebAuthnID() []byte          { return []byte(u.identity) }
+func (u user) WebAuthnName() string        { return u.identity }
+func (u user) WebAuthnDisplayName() string { return u.identity }
+
+func (u user) WebAuthnCredentials() []webauthnlib.Credential {
+	out := make([]webauthnlib.Credential, len(u.creds))
+	for i, c := range u.creds {
+		out[i] = c.Credential
+	}
+	return out
+}
+
+// find returns the stored credential with the given ID.
+func (u user) find(id []byte) (Credential, bool) {
+	for _, c := range u.creds {
+		if string(c.ID) == string(id) {
+			return c, true
+		}
+	}
+	return Credential{}, false
+}
+
+func (rp *RelyingParty) loadUser(ctx context.Context, identity string) (user, error) {
+	creds, err := rp.store.Get(ctx, identity)
+	if err != nil {
+		return user{}, err
+	}
+	return user{identity: identity, creds: creds}, nil
+}
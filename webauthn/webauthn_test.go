@@ -0,0 +1,487 @@
+package webauthn
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/the-maldridge/authware"
+)
+
+const (
+	testRPID   = "example.com"
+	testOrigin = "https://app.example.com"
+)
+
+var b64 = base64.RawURLEncoding
+
+// passwords accepts "secret" for any identity, and puts everyone in
+// the staff group.
+type passwords struct{}
+
+func (passwords) AuthUserPassword(ctx context.Context, identity, password string) error {
+	if password != "secret" {
+		return authware.ErrUnauthenticated{}
+	}
+	return nil
+}
+
+func (passwords) UserGroups(ctx context.Context, identity string) (map[string]struct{}, error) {
+	return map[string]struct{}{"staff": {}}, nil
+}
+
+func (passwords) Name() string { return "passwords" }
+
+// memoryCredentials is a CredentialStore for tests.
+type memoryCredentials struct {
+	mu    sync.Mutex
+	creds map[string][]Credential
+}
+
+func (m *memoryCredentials) Get(ctx context.Context, identity string) ([]Credential, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.creds[identity]), nil
+}
+
+func (m *memoryCredentials) Put(ctx context.Context, identity string, cred Credential) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.creds[identity], func(c Credential) bool { return bytes.Equal(c.ID, cred.ID) })
+	if i < 0 {
+		m.creds[identity] = append(m.creds[identity], cred)
+	} else {
+		m.creds[identity][i] = cred
+	}
+	return nil
+}
+
+func (m *memoryCredentials) Delete(ctx context.Context, identity string, id []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.creds[identity] = slices.DeleteFunc(m.creds[identity], func(c Credential) bool { return bytes.Equal(c.ID, id) })
+	return nil
+}
+
+// authenticator is a software authenticator holding a single P-256
+// credential.  It produces "none" attestations and signs assertions
+// over the authenticator data followed by the hash of the client
+// data, as a security key would.
+type authenticator struct {
+	key    *ecdsa.PrivateKey
+	id     []byte
+	handle []byte
+	count  uint32
+}
+
+func newAuthenticator(t *testing.T, identity string) *authenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &authenticator{key: key, id: id, handle: []byte(identity)}
+}
+
+func clientData(t *testing.T, typ string, options []byte, origin string) []byte {
+	t.Helper()
+	var opts struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &opts); err != nil {
+		t.Fatalf("bad ceremony options %q: %v", options, err)
+	}
+	data, _ := json.Marshal(map[string]string{
+		"type":      typ,
+		"challenge": opts.PublicKey.Challenge,
+		"origin":    origin,
+	})
+	return data
+}
+
+// authData returns the authenticator data with the user present and
+// verified flags set, and flags added to them.
+func (a *authenticator) authData(flags byte) *bytes.Buffer {
+	rpHash := sha256.Sum256([]byte(testRPID))
+	var ad bytes.Buffer
+	ad.Write(rpHash[:])
+	ad.WriteByte(0x01 | 0x04 | flags)
+	binary.Write(&ad, binary.BigEndian, a.count)
+	return &ad
+}
+
+// create answers navigator.credentials.create() with the options
+// returned by RegisterBeginHandler.
+func (a *authenticator) create(t *testing.T, options []byte) string {
+	t.Helper()
+	x := a.key.PublicKey.X.FillBytes(make([]byte, 32))
+	y := a.key.PublicKey.Y.FillBytes(make([]byte, 32))
+	cose, err := cbor.Marshal(map[int]any{1: 2, 3: -7, -1: 1, -2: x, -3: y})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Attested credential data follows the counter: an all zero
+	// AAGUID, then the credential ID and public key.
+	ad := a.authData(0x40)
+	ad.Write(make([]byte, 16))
+	binary.Write(ad, binary.BigEndian, uint16(len(a.id)))
+	ad.Write(a.id)
+	ad.Write(cose)
+	att, err := cbor.Marshal(map[string]any{"fmt": "none", "attStmt": map[string]any{}, "authData": ad.Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, _ := json.Marshal(map[string]any{
+		"id":    b64.EncodeToString(a.id),
+		"rawId": b64.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(clientData(t, "webauthn.create", options, testOrigin)),
+			"attestationObject": b64.EncodeToString(att),
+		},
+	})
+	return string(resp)
+}
+
+// get answers navigator.credentials.get() with the options returned
+// by LoginBeginHandler, incrementing the sign count first.
+func (a *authenticator) get(t *testing.T, options []byte, origin string) string {
+	t.Helper()
+	a.count++
+	ad := a.authData(0)
+	cd := clientData(t, "webauthn.get", options, origin)
+	cdHash := sha256.Sum256(cd)
+	digest := sha256.Sum256(append(ad.Bytes(), cdHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, _ := json.Marshal(map[string]any{
+		"id":    b64.EncodeToString(a.id),
+		"rawId": b64.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(cd),
+			"authenticatorData": b64.EncodeToString(ad.Bytes()),
+			"signature":         b64.EncodeToString(sig),
+			"userHandle":        b64.EncodeToString(a.handle),
+		},
+	})
+	return string(resp)
+}
+
+// browser carries cookies between requests.
+type browser map[string]*http.Cookie
+
+func (b browser) request(method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for _, c := range b {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func (b browser) do(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	for _, c := range w.Result().Cookies() {
+		if c.MaxAge < 0 {
+			delete(b, c.Name)
+		} else {
+			b[c.Name] = c
+		}
+	}
+	return w
+}
+
+func (b browser) post(h http.Handler, target, body string) *httptest.ResponseRecorder {
+	return b.do(h, b.request(http.MethodPost, target, body))
+}
+
+type fixture struct {
+	mw    *authware.BasicMiddleware
+	rp    *RelyingParty
+	store *memoryCredentials
+}
+
+func newFixture(t *testing.T, passwordless bool) *fixture {
+	t.Helper()
+	mw, err := authware.NewAuth(authware.WithAuthenticators(passwords{}), authware.WithLoginCSRF(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &memoryCredentials{creds: make(map[string][]Credential)}
+	rp, err := New(Config{
+		RPID:         testRPID,
+		RPOrigins:    []string{testOrigin},
+		Passwordless: passwordless,
+		Store:        store,
+	}, mw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fixture{mw: mw, rp: rp, store: store}
+}
+
+// password submits the login form as alice.
+func (f *fixture) password(b browser) *httptest.ResponseRecorder {
+	r := b.request(http.MethodPost, "/login?next=/private", url.Values{"username": {"alice"}, "password": {"secret"}}.Encode())
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(http.HandlerFunc(f.mw.LoginFormHandler("username", "password", "/")), r)
+}
+
+// session returns the user that the browser's session belongs to.
+func (f *fixture) session(t *testing.T, b browser) (authware.Session, bool) {
+	t.Helper()
+	s, err := f.mw.CurrentSession(b.request(http.MethodGet, "/", ""))
+	return s, err == nil
+}
+
+// register logs alice in with her password and registers the
+// authenticator to her.
+func (f *fixture) register(t *testing.T, a *authenticator) {
+	t.Helper()
+	b := browser{}
+	if w := f.password(b); w.Code != http.StatusSeeOther {
+		t.Fatalf("password login returned %d", w.Code)
+	}
+	w := f.registerBegin(t, b, true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("registration begin returned %d", w.Code)
+	}
+	r := b.request(http.MethodPost, "/webauthn/register/finish", a.create(t, w.Body.Bytes()))
+	r.Header.Set(authware.CSRFHeaderName, f.csrf(t, b))
+	w = b.do(f.mw.LoginHandler("/login")(f.rp.RegisterFinishHandler()), r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("registration finish returned %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// csrf returns the CSRF token of the browser's session.
+func (f *fixture) csrf(t *testing.T, b browser) string {
+	t.Helper()
+	s, ok := f.session(t, b)
+	if !ok {
+		t.Fatal("browser has no session")
+	}
+	return s.CSRFToken
+}
+
+// registerBegin starts a registration for the browser's session,
+// with or without its CSRF token.
+func (f *fixture) registerBegin(t *testing.T, b browser, withCSRF bool) *httptest.ResponseRecorder {
+	t.Helper()
+	r := b.request(http.MethodPost, "/webauthn/register/begin", "")
+	if withCSRF {
+		r.Header.Set(authware.CSRFHeaderName, f.csrf(t, b))
+	}
+	return b.do(f.mw.LoginHandler("/login")(f.rp.RegisterBeginHandler()), r)
+}
+
+// login runs a login ceremony, and returns the finish response along
+// with the assertion that was sent.
+func (f *fixture) login(t *testing.T, b browser, a *authenticator, begin, origin string) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	w := b.post(f.rp.LoginBeginHandler(), begin, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("login begin returned %d", w.Code)
+	}
+	assertion := a.get(t, w.Body.Bytes(), origin)
+	return b.post(f.rp.LoginFinishHandler(), "/webauthn/login/finish", assertion), assertion
+}
+
+func redirectOf(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct{ Redirect string }
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Redirect
+}
+
+func TestRegistration(t *testing.T) {
+	f := newFixture(t, false)
+	f.register(t, newAuthenticator(t, "alice"))
+
+	creds, _ := f.store.Get(context.Background(), "alice")
+	if len(creds) != 1 || creds[0].Backend != "passwords" {
+		t.Fatalf("unexpected credentials %+v", creds)
+	}
+
+	// Registration is only for users with a session.
+	w := browser{}.post(f.rp.RegisterBeginHandler(), "/webauthn/register/begin", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a session, got %d", w.Code)
+	}
+}
+
+func TestRegistrationGuard(t *testing.T) {
+	f := newFixture(t, true)
+	alice := authware.User{Identity: "alice", AuthedBy: "passwords"}
+
+	cases := []struct {
+		name     string
+		authTime time.Time
+		withCSRF bool
+		want     int
+	}{
+		{"recent login", time.Now(), true, http.StatusOK},
+		{"stale login", time.Now().Add(-time.Hour), true, http.StatusForbidden},
+		{"no csrf token", time.Now(), false, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := browser{}
+			b.do(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := f.mw.StartSessionAt(w, r, alice, c.authTime, authware.AMRPassword); err != nil {
+					t.Fatal(err)
+				}
+			}), b.request(http.MethodGet, "/", ""))
+			if w := f.registerBegin(t, b, c.withCSRF); w.Code != c.want {
+				t.Errorf("expected %d, got %d", c.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestSecondFactor(t *testing.T) {
+	f := newFixture(t, false)
+	a := newAuthenticator(t, "alice")
+	f.register(t, a)
+
+	b := browser{}
+	w := f.password(b)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != f.rp.Path() {
+		t.Fatalf("expected to be sent to the WebAuthn page, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+	if _, ok := f.session(t, b); ok {
+		t.Fatal("session issued before the second factor")
+	}
+
+	if w, _ := f.login(t, b, a, "/webauthn/login/begin", "https://evil.example.com"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for the wrong origin, got %d", w.Code)
+	}
+
+	w, _ = f.login(t, b, a, "/webauthn/login/begin", testOrigin)
+	if w.Code != http.StatusOK || redirectOf(t, w) != "/private" {
+		t.Fatalf("login finish returned %d", w.Code)
+	}
+	s, ok := f.session(t, b)
+	if !ok || s.User.Identity != "alice" || s.User.AuthedBy != "passwords" {
+		t.Fatalf("unexpected session %+v", s)
+	}
+	if !slices.Contains(s.AMR, authware.AMRHardwareKey) || !slices.Contains(s.AMR, authware.AMRMultiFactor) {
+		t.Errorf("unexpected amr %v", s.AMR)
+	}
+}
+
+func TestPasswordless(t *testing.T) {
+	f := newFixture(t, true)
+	a := newAuthenticator(t, "alice")
+	f.register(t, a)
+
+	b := browser{}
+	w, _ := f.login(t, b, a, "/webauthn/login/begin?next=/reports", testOrigin)
+	if w.Code != http.StatusOK || redirectOf(t, w) != "/reports" {
+		t.Fatalf("passwordless login returned %d", w.Code)
+	}
+	s, ok := f.session(t, b)
+	if !ok || s.User.Identity != "alice" || s.User.AuthedBy != "webauthn" {
+		t.Fatalf("unexpected session %+v", s)
+	}
+	if _, ok := s.User.Groups["staff"]; !ok {
+		t.Errorf("groups were not looked up in the backend: %v", s.User.Groups)
+	}
+}
+
+func TestPasswordlessDisabled(t *testing.T) {
+	f := newFixture(t, false)
+	f.register(t, newAuthenticator(t, "alice"))
+
+	w := browser{}.post(f.rp.LoginBeginHandler(), "/webauthn/login/begin", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a pending login, got %d", w.Code)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	f := newFixture(t, true)
+	a := newAuthenticator(t, "alice")
+	f.register(t, a)
+
+	b := browser{}
+	w, assertion := f.login(t, b, a, "/webauthn/login/begin", testOrigin)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login returned %d", w.Code)
+	}
+
+	// The ceremony state is consumed by the first use.
+	if w := b.post(f.rp.LoginFinishHandler(), "/webauthn/login/finish", assertion); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a finished ceremony, got %d", w.Code)
+	}
+
+	// A new ceremony has a new challenge, which the old assertion
+	// does not answer.
+	b = browser{}
+	if w := b.post(f.rp.LoginBeginHandler(), "/webauthn/login/begin", ""); w.Code != http.StatusOK {
+		t.Fatalf("login begin returned %d", w.Code)
+	}
+	if w := b.post(f.rp.LoginFinishHandler(), "/webauthn/login/finish", assertion); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a replayed assertion, got %d", w.Code)
+	}
+	if _, ok := f.session(t, b); ok {
+		t.Error("session issued for a replayed assertion")
+	}
+}
+
+func TestClonedCredential(t *testing.T) {
+	f := newFixture(t, true)
+	a := newAuthenticator(t, "alice")
+	f.register(t, a)
+
+	if w, _ := f.login(t, browser{}, a, "/webauthn/login/begin", testOrigin); w.Code != http.StatusOK {
+		t.Fatalf("login returned %d", w.Code)
+	}
+	if w, _ := f.login(t, browser{}, a, "/webauthn/login/begin", testOrigin); w.Code != http.StatusOK {
+		t.Fatalf("login returned %d", w.Code)
+	}
+
+	// A copy of the key that has not kept up with the sign count
+	// is refused, and does not wind the stored count back.
+	clone := *a
+	clone.count = 0
+	b := browser{}
+	if w, _ := f.login(t, b, &clone, "/webauthn/login/begin", testOrigin); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a stale sign count, got %d", w.Code)
+	}
+	if _, ok := f.session(t, b); ok {
+		t.Error("session issued for a cloned credential")
+	}
+	creds, _ := f.store.Get(context.Background(), "alice")
+	if creds[0].Authenticator.SignCount != 2 {
+		t.Errorf("stored sign count is %d, want 2", creds[0].Authenticator.SignCount)
+	}
+}